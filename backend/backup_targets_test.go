@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+// testDestinationRoundTrip stores, lists, reads, replaces and deletes files
+// through dest, and checks that missing files are reported as
+// fs.ErrNotExist.
+func testDestinationRoundTrip(t *testing.T, dest BackupDestination) {
+	t.Helper()
+	defer dest.Close()
+
+	names, err := dest.List("objects")
+	if err != nil || len(names) != 0 {
+		t.Fatalf("List of an empty repository = %v, %v", names, err)
+	}
+
+	files := map[string]string{
+		"key.age":                "key",
+		"objects/ab/abcdef":      "first object",
+		"objects/cd/cdef01":      strings.Repeat("large object ", 10000),
+		"snapshots/2024.json":    `{"id":"2024"}`,
+		"snapshots/2024.objects": `["objects/ab/abcdef"]`,
+	}
+	for name, content := range files {
+		if err := dest.Put(name, strings.NewReader(content), int64(len(content))); err != nil {
+			t.Fatalf("Put %s: %v", name, err)
+		}
+	}
+	for name, content := range files {
+		data, err := readBackupFile(dest, name)
+		if err != nil || string(data) != content {
+			t.Fatalf("Get %s = %d bytes, %v; want %d bytes", name, len(data), err, len(content))
+		}
+	}
+
+	names, err = dest.List("objects")
+	slices.Sort(names)
+	if err != nil || !slices.Equal(names, []string{"objects/ab/abcdef", "objects/cd/cdef01"}) {
+		t.Fatalf("List objects = %v, %v", names, err)
+	}
+
+	// Replacing a file leaves no temporary file behind.
+	if err := dest.Put("objects/ab/abcdef", bytes.NewReader([]byte("replaced")), 8); err != nil {
+		t.Fatalf("Put over existing file: %v", err)
+	}
+	if data, err := readBackupFile(dest, "objects/ab/abcdef"); err != nil || string(data) != "replaced" {
+		t.Fatalf("Get replaced file = %q, %v", data, err)
+	}
+	if names, _ := dest.List("objects"); len(names) != 2 {
+		t.Fatalf("List after replacing = %v", names)
+	}
+
+	if err := dest.Delete("objects/ab/abcdef"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := dest.Get("objects/ab/abcdef"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Get of deleted file: %v, want fs.ErrNotExist", err)
+	}
+	if err := dest.Delete("objects/ab/abcdef"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Delete of deleted file: %v, want fs.ErrNotExist", err)
+	}
+	if names, err := dest.List("objects"); err != nil || !slices.Equal(names, []string{"objects/cd/cdef01"}) {
+		t.Fatalf("List after delete = %v, %v", names, err)
+	}
+	if names, err := dest.List("missing"); err != nil || len(names) != 0 {
+		t.Fatalf("List of missing directory = %v, %v", names, err)
+	}
+}
+
+func TestLocalDestination(t *testing.T) {
+	dest, err := openBackupDestination(BackupTarget{Name: "disk", Type: "local", Path: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDestinationRoundTrip(t, dest)
+}
+
+func TestWebDAVDestination(t *testing.T) {
+	dav := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.Dir(t.TempDir()),
+		LockSystem: webdav.NewMemLS(),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "backup" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		dav.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	target := BackupTarget{Name: "dav", Type: "webdav", URL: server.URL + "/dav", Path: "notes/repo", Username: "backup", Password: "secret"}
+	dest, err := openBackupDestination(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDestinationRoundTrip(t, dest)
+
+	target.Password = "wrong"
+	if _, err := openBackupDestination(target); err == nil {
+		t.Fatal("opening with a wrong password succeeded")
+	}
+}
+
+func TestCheckBackupTargets(t *testing.T) {
+	for _, tc := range []struct {
+		targets []BackupTarget
+		ok      bool
+	}{
+		{nil, true},
+		{[]BackupTarget{{Name: "disk", Type: "local"}, {Name: "offsite", Type: "s3"}}, true},
+		{[]BackupTarget{{Type: "s3"}}, false},
+		{[]BackupTarget{{Name: "s3", Type: "s3"}, {Name: "s3", Type: "s3"}}, false},
+	} {
+		if err := checkBackupTargets(tc.targets); (err == nil) != tc.ok {
+			t.Errorf("checkBackupTargets(%v) = %v, want ok %v", tc.targets, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gitIn runs git in dir and returns its trimmed output.
+func gitIn(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=Remote", "GIT_AUTHOR_EMAIL=remote@example.com",
+		"GIT_COMMITTER_NAME=Remote", "GIT_COMMITTER_EMAIL=remote@example.com")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// TestGitSyncDeleteConflicts checks that a note deleted on one side and
+// edited on the other keeps the local side, keeps the remote side on a
+// conflict branch, and does not stop later syncs from pushing.
+func TestGitSyncDeleteConflicts(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	oldDir, oldGit := AppConfig.MarkdownDir, AppConfig.Git
+	defer func() { AppConfig.MarkdownDir, AppConfig.Git = oldDir, oldGit }()
+
+	for _, tc := range []struct {
+		name        string
+		localDelete bool
+	}{
+		{"local delete, remote edit", true},
+		{"local edit, remote delete", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			remote := filepath.Join(tmp, "remote.git")
+			gitIn(t, tmp, "init", "-q", "--bare", "-b", "main", remote)
+			AppConfig.MarkdownDir = filepath.Join(tmp, "notes")
+			AppConfig.Git = GitConfig{Users: map[string]GitUserConfig{"u": {Remote: remote}}}
+			gitRepos.Lock()
+			gitRepos.repos = make(map[string]*gitRepo)
+			gitRepos.Unlock()
+
+			repo, err := gitRepoFor("u")
+			if err != nil {
+				t.Fatalf("gitRepoFor: %v", err)
+			}
+			note := filepath.Join(repo.dir, "note.md")
+			if err := os.WriteFile(note, []byte("first\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := repo.sync(); err != nil {
+				t.Fatalf("first sync: %v", err)
+			}
+
+			clone := filepath.Join(tmp, "clone")
+			gitIn(t, tmp, "clone", "-q", remote, clone)
+			if tc.localDelete {
+				os.WriteFile(filepath.Join(clone, "note.md"), []byte("remote edit\n"), 0644)
+				os.Remove(note)
+			} else {
+				os.Remove(filepath.Join(clone, "note.md"))
+				os.WriteFile(note, []byte("local edit\n"), 0644)
+			}
+			gitIn(t, clone, "commit", "-q", "-a", "-m", "Remote change")
+			gitIn(t, clone, "push", "-q", "origin", "main")
+
+			if err := repo.sync(); err != nil {
+				t.Fatalf("sync with conflict: %v", err)
+			}
+			if status := gitIn(t, repo.dir, "status", "--porcelain"); status != "" {
+				t.Fatalf("working tree after sync:\n%s", status)
+			}
+			branches := gitIn(t, tmp, "--git-dir", remote, "for-each-ref", "--format=%(refname:short)", "refs/heads/main-conflict-*")
+			if branches == "" || strings.Contains(branches, "\n") {
+				t.Fatalf("conflict branches on the remote = %q, want one", branches)
+			}
+			mainFiles := gitIn(t, tmp, "--git-dir", remote, "ls-tree", "--name-only", "main")
+			conflict := gitIn(t, tmp, "--git-dir", remote, "ls-tree", "--name-only", branches)
+			if tc.localDelete {
+				if strings.Contains(mainFiles, "note.md") {
+					t.Fatalf("remote main still has the note deleted locally")
+				}
+				if got := gitIn(t, tmp, "--git-dir", remote, "show", branches+":note.md"); got != "remote edit" {
+					t.Fatalf("note on the conflict branch = %q", got)
+				}
+			} else {
+				if got := gitIn(t, tmp, "--git-dir", remote, "show", "main:note.md"); got != "local edit" {
+					t.Fatalf("note on remote main = %q", got)
+				}
+				if strings.Contains(conflict, "note.md") {
+					t.Fatalf("conflict branch has the note deleted remotely")
+				}
+			}
+
+			// The next change is pushed as usual.
+			if err := os.WriteFile(filepath.Join(repo.dir, "later.md"), []byte("later\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := repo.sync(); err != nil {
+				t.Fatalf("sync after conflict: %v", err)
+			}
+			if got := gitIn(t, tmp, "--git-dir", remote, "show", "main:later.md"); got != "later" {
+				t.Fatalf("later.md on remote main = %q", got)
+			}
+		})
+	}
+}
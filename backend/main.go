@@ -3,38 +3,71 @@ package main
 
 import (
 	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"container/list"
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"embed"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
+	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/fs"
+	"iter"
 	"log"
+	"math"
 	"math/big"
 	rnd "math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/smtp"
+	"net/url"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
 
+	"filippo.io/age"
 	"github.com/fsnotify/fsnotify"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
+	"github.com/gorilla/websocket"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/pkg/sftp"
 	"github.com/robfig/cron/v3" // 新增的依赖
 	"github.com/sergi/go-diff/diffmatchpatch"
 	"go.etcd.io/bbolt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/webdav"
+	"gopkg.in/yaml.v3"
 )
 
 //go:embed all:embed
@@ -48,24 +81,129 @@ var helpMarkdownEn []byte
 
 // --- config.go ---
 
-// 新增: 用于备份配置的结构体
+// BackupConfig configures scheduled backups. Snapshots are thinned out by
+// keeping the newest snapshot of the last KeepHourly hours, KeepDaily days,
+// KeepWeekly weeks, KeepMonthly months and KeepYearly years; snapshots
+// younger than RetentionDays are always kept. Legacy zip backups are deleted
+// after RetentionDays, or legacyRetentionDays if it is 0.
 type BackupConfig struct {
 	Enabled       bool   `json:"enabled"`
 	Dir           string `json:"dir"`
 	Cron          string `json:"cron"`
 	RetentionDays int    `json:"retention_days"`
+	KeepHourly    int    `json:"keep_hourly"`
+	KeepDaily     int    `json:"keep_daily"`
+	KeepWeekly    int    `json:"keep_weekly"`
+	KeepMonthly   int    `json:"keep_monthly"`
+	KeepYearly    int    `json:"keep_yearly"`
+	// Passphrase or Recipient (an age X25519 public key) enables encryption
+	// of backups. Identity is the path of an age identity file that can
+	// decrypt backups encrypted to Recipient.
+	Passphrase string `json:"passphrase"`
+	Recipient  string `json:"recipient"`
+	Identity   string `json:"identity"`
+	// Targets are the destinations every backup is written to. Without
+	// targets, backups are written to the local directory Dir.
+	Targets []BackupTarget `json:"targets"`
+	// Notify is told about failed backups.
+	Notify BackupNotifyConfig `json:"notify"`
+}
+
+// BackupNotifyConfig configures the notifications about failed backups. A
+// JSON description of the failed runs is posted to Webhook, and an email is
+// sent through the SMTP server SMTPHost (host:port) to EmailTo.
+type BackupNotifyConfig struct {
+	Webhook      string   `json:"webhook"`
+	SMTPHost     string   `json:"smtp_host"`
+	SMTPUsername string   `json:"smtp_username"`
+	SMTPPassword string   `json:"smtp_password"`
+	EmailFrom    string   `json:"email_from"`
+	EmailTo      []string `json:"email_to"`
+}
+
+// BackupTarget is a destination of backups, each holding a complete backup
+// repository. Type is "local" (Path is a directory), "s3" (URL is the
+// endpoint of an S3-compatible service, Path a key prefix in Bucket),
+// "webdav" (URL of a collection, Path below it) or "sftp" (URL is host:port,
+// Path the remote directory, HostKey the server's public key in
+// authorized_keys format).
+type BackupTarget struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	URL        string `json:"url,omitempty"`
+	Path       string `json:"path,omitempty"`
+	Bucket     string `json:"bucket,omitempty"`
+	Region     string `json:"region,omitempty"`
+	AccessKey  string `json:"access_key,omitempty"`
+	SecretKey  string `json:"secret_key,omitempty"`
+	Username   string `json:"username,omitempty"`
+	Password   string `json:"password,omitempty"`
+	PrivateKey string `json:"private_key,omitempty"`
+	HostKey    string `json:"host_key,omitempty"`
+}
+
+// GitConfig configures git-backed storage. The users in Users keep their
+// notes in a git repository rooted at their directory instead of
+// versions.db; every change is a commit. On the Cron schedule, each
+// repository is merged with the branch of its remote and pushed.
+type GitConfig struct {
+	Cron  string                   `json:"cron"`
+	Users map[string]GitUserConfig `json:"users"`
+}
+
+// GitUserConfig configures the repository of a user. Remote is any URL git
+// understands, including the path of a local bare repository; without it,
+// changes are only committed. Branch defaults to "main".
+type GitUserConfig struct {
+	Remote string `json:"remote,omitempty"`
+	Branch string `json:"branch,omitempty"`
+}
+
+// EmbeddingConfig configures semantic search. Provider is "hash" for the
+// built-in offline embedder or "openai" for an OpenAI-compatible endpoint.
+type EmbeddingConfig struct {
+	Enabled    bool   `json:"enabled"`
+	Provider   string `json:"provider"`
+	URL        string `json:"url"`
+	Model      string `json:"model"`
+	APIKey     string `json:"api_key"`
+	Dimensions int    `json:"dimensions"`
+	ChunkSize  int    `json:"chunk_size"`
+}
+
+// StoreConfig selects the document cache backend: "memory" keeps every note
+// in memory, "disk" keeps only metadata and indexes and caches at most
+// CacheSizeMB of note content.
+type StoreConfig struct {
+	Backend     string `json:"backend"`
+	CacheSizeMB int    `json:"cache_size_mb"`
+	// ReconcileMinutes is the interval of the scan that repairs drift between
+	// disk and cache. 0 disables it.
+	ReconcileMinutes int `json:"reconcile_minutes"`
+}
+
+// CollabConfig configures collaborative editing. Share maps a user to the
+// other users who may open that user's notes in a collaboration session.
+type CollabConfig struct {
+	Share map[string][]string `json:"share"`
 }
 
 type Config struct {
-	Bind        string       `json:"bind"`
-	TLS         bool         `json:"tls"`
-	CertFile    string       `json:"cert_file"`
-	KeyFile     string       `json:"key_file"`
-	VisitLog    string       `json:"visit_log"`
-	MarkdownDir string       `json:"markdown_dir"`
-	WWWDir      string       `json:"www_dir"`
-	UsersFile   string       `json:"users_file"`
-	Backup      BackupConfig `json:"backup"` // 新增
+	Bind        string          `json:"bind"`
+	TLS         bool            `json:"tls"`
+	CertFile    string          `json:"cert_file"`
+	KeyFile     string          `json:"key_file"`
+	VisitLog    string          `json:"visit_log"`
+	MarkdownDir string          `json:"markdown_dir"`
+	WWWDir      string          `json:"www_dir"`
+	UsersFile   string          `json:"users_file"`
+	Backup      BackupConfig    `json:"backup"` // 新增
+	Embedding   EmbeddingConfig `json:"embedding"`
+	Store       StoreConfig     `json:"store"`
+	Git         GitConfig       `json:"git"`
+	Collab      CollabConfig    `json:"collab"`
+	// Admins lists the users allowed to use the /api/admin endpoints.
+	Admins []string `json:"admins"`
 }
 
 var defaultConfig = Config{
@@ -82,8 +220,35 @@ var defaultConfig = Config{
 		Enabled:       false,
 		Dir:           "backup",
 		Cron:          "0 0 1 * *", // 每月1日午夜
-		RetentionDays: 180,
+		RetentionDays: 0,
+		KeepHourly:    24,
+		KeepDaily:     7,
+		KeepWeekly:    4,
+		KeepMonthly:   12,
+		KeepYearly:    3,
+		Targets:       []BackupTarget{},
+		Notify:        BackupNotifyConfig{EmailTo: []string{}},
+	},
+	Embedding: EmbeddingConfig{
+		Enabled:    false,
+		Provider:   "hash",
+		Model:      "text-embedding-3-small",
+		Dimensions: 256,
+		ChunkSize:  1000,
+	},
+	Store: StoreConfig{
+		Backend:          "memory",
+		CacheSizeMB:      64,
+		ReconcileMinutes: 10,
 	},
+	Git: GitConfig{
+		Cron:  "*/15 * * * *",
+		Users: map[string]GitUserConfig{},
+	},
+	Collab: CollabConfig{
+		Share: map[string][]string{},
+	},
+	Admins: []string{},
 }
 
 var AppConfig Config
@@ -117,6 +282,10 @@ func LoadConfig() {
 	flag.StringVar(&AppConfig.WWWDir, "www", AppConfig.WWWDir, "Path to static web assets")
 	flag.StringVar(&AppConfig.UsersFile, "users", AppConfig.UsersFile, "Path to users file for basic auth")
 	flag.Parse()
+
+	if err := checkBackupTargets(AppConfig.Backup.Targets); err != nil {
+		log.Fatalf("FATAL: Invalid backup configuration: %v", err)
+	}
 }
 
 // --- auth.go ---
@@ -229,23 +398,66 @@ func AuthMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// AdminMiddleware restricts a route to the users listed in Config.Admins.
+func AdminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(userContextKey).(string)
+		for _, admin := range AppConfig.Admins {
+			if admin == user {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		respondError(w, http.StatusForbidden, "Admin access required")
+	})
+}
+
 // --- backup.go ---
 
+const backupTimeFormat = "2006-01-02T15-04-05"
+
+// backupMutex serializes backup runs and cleanups, so that garbage
+// collection never removes objects a running backup refers to.
+var backupMutex sync.Mutex
+
+// writeGate keeps the server from changing the markdown directory while a
+// backup captures its view of it. Every change made by the server holds a
+// read lock; runBackup holds the write lock for the short time it takes to
+// copy the changed files.
+var writeGate sync.RWMutex
+
+// withWriteGate runs fn, which changes the markdown directory, under a read
+// lock of writeGate.
+func withWriteGate(fn func() error) error {
+	writeGate.RLock()
+	defer writeGate.RUnlock()
+	return fn()
+}
+
 func StartBackupScheduler() {
 	if !AppConfig.Backup.Enabled {
 		log.Println("Automatic backup is disabled.")
 		return
 	}
 
-	log.Printf("Starting backup scheduler. Cron: '%s', Retention: %d days.", AppConfig.Backup.Cron, AppConfig.Backup.RetentionDays)
+	if err := checkBackupKeys(); err != nil {
+		log.Fatalf("FATAL: Invalid backup encryption key: %v", err)
+	}
+
+	cfg := AppConfig.Backup
+	log.Printf("Starting backup scheduler. Cron: '%s', Retention: %d days, keep %d hourly, %d daily, %d weekly, %d monthly, %d yearly.",
+		cfg.Cron, cfg.RetentionDays, cfg.KeepHourly, cfg.KeepDaily, cfg.KeepWeekly, cfg.KeepMonthly, cfg.KeepYearly)
 
 	c := cron.New()
 
 	// Add the main backup job
-	_, err := c.AddFunc(AppConfig.Backup.Cron, performBackup)
+	entry, err := c.AddFunc(AppConfig.Backup.Cron, performBackup)
 	if err != nil {
 		log.Fatalf("FATAL: Invalid backup cron expression: %v", err)
 	}
+	backupState.Lock()
+	backupState.scheduler, backupState.entry = c, entry
+	backupState.Unlock()
 
 	// Add a daily cleanup job (runs at 1 AM every day)
 	_, err = c.AddFunc("0 1 * * *", performBackupCleanup)
@@ -256,616 +468,9679 @@ func StartBackupScheduler() {
 	go c.Start()
 }
 
-func performBackup() {
-	log.Println("Starting scheduled backup...")
+// checkBackupKeys connects to every backup target, loads the encryption
+// keys of its repository and decrypts the newest snapshot with them, so that
+// a wrong passphrase, identity or credential is reported at startup instead
+// of when the next backup runs.
+func checkBackupKeys() error {
+	for _, target := range backupTargets() {
+		repo, err := openBackupRepository(target)
+		if err != nil {
+			return fmt.Errorf("backup target '%s': %w", target.Name, err)
+		}
+		ids, err := repo.snapshotIDs()
+		if err == nil && len(ids) > 0 {
+			if _, err = repo.loadSnapshot(ids[len(ids)-1]); errors.Is(err, errNoBackupIdentity) {
+				err = nil
+			}
+		}
+		repo.Close()
+		if err != nil {
+			return fmt.Errorf("backup target '%s': %w", target.Name, err)
+		}
+	}
+	return nil
+}
 
-	backupDir := AppConfig.Backup.Dir
-	if err := os.MkdirAll(backupDir, 0755); err != nil {
-		log.Printf("ERROR: Could not create backup directory '%s': %v", backupDir, err)
-		return
+// checkBackupTargets reports targets without a name or with the name of
+// another target. The name identifies the keys and state of a target's
+// repository, so it has to be unique.
+func checkBackupTargets(targets []BackupTarget) error {
+	seen := make(map[string]bool)
+	for i, target := range targets {
+		if target.Name == "" {
+			return fmt.Errorf("backup target %d (%s) has no name", i+1, target.Type)
+		}
+		if seen[target.Name] {
+			return fmt.Errorf("backup target name '%s' is used more than once", target.Name)
+		}
+		seen[target.Name] = true
+	}
+	return nil
+}
+
+// backupTargets returns the configured backup targets, or the local
+// directory Dir when none are configured.
+func backupTargets() []BackupTarget {
+	if len(AppConfig.Backup.Targets) == 0 {
+		return []BackupTarget{{Name: "local", Type: "local", Path: AppConfig.Backup.Dir}}
+	}
+	return AppConfig.Backup.Targets
+}
+
+// findBackupTarget returns the target called name, or the first target if
+// name is empty.
+func findBackupTarget(name string) (BackupTarget, error) {
+	targets := backupTargets()
+	if name == "" {
+		return targets[0], nil
+	}
+	for _, target := range targets {
+		if target.Name == name {
+			return target, nil
+		}
 	}
+	return BackupTarget{}, fmt.Errorf("%w: unknown backup target %q", errBackupNotFound, name)
+}
 
-	timestamp := time.Now().Format("2006-01-02T15-04-05")
-	zipFileName := fmt.Sprintf("markdown-%s.zip", timestamp)
-	zipFilePath := filepath.Join(backupDir, zipFileName)
+const backupKeyFile = "key.age"
 
-	zipFile, err := os.Create(zipFilePath)
+var errNoBackupIdentity = errors.New("backup is encrypted and no identity to decrypt it is configured (backup.identity)")
+
+type backupKeySet struct {
+	recipient  age.Recipient
+	identities []age.Identity
+	nameKey    []byte
+}
+
+// backupKeys caches the age keys of the repository of each target.
+var backupKeys = struct {
+	sync.Mutex
+	targets map[string]backupKeySet
+}{targets: make(map[string]backupKeySet)}
+
+// loadBackupKeys returns the recipient new backups of the target are
+// encrypted to, nil without encryption, the identities that decrypt
+// existing backups and, with encryption, the key that names the objects.
+func loadBackupKeys(target string, dest BackupDestination) (backupKeySet, error) {
+	backupKeys.Lock()
+	defer backupKeys.Unlock()
+	if keys, ok := backupKeys.targets[target]; ok {
+		return keys, nil
+	}
+	recipient, identities, err := readBackupKeys(AppConfig.Backup, dest)
 	if err != nil {
-		log.Printf("ERROR: Could not create zip file '%s': %v", zipFilePath, err)
-		return
+		return backupKeySet{}, err
+	}
+	keys := backupKeySet{recipient: recipient, identities: identities}
+	if recipient != nil {
+		if keys.nameKey, err = objectNameKey(target, dest, recipient, identities); err != nil {
+			return backupKeySet{}, err
+		}
 	}
-	defer zipFile.Close()
+	backupKeys.targets[target] = keys
+	return keys, nil
+}
 
-	zipWriter := zip.NewWriter(zipFile)
-	defer zipWriter.Close()
+// backupStateDir is the local directory that keeps the state of the backup
+// targets. It lies next to the markdown directory, so it is not part of the
+// backups itself.
+func backupStateDir() string {
+	markdownDir := filepath.Clean(AppConfig.MarkdownDir)
+	return filepath.Join(filepath.Dir(markdownDir), "."+filepath.Base(markdownDir)+".backup")
+}
 
-	sourceDir := AppConfig.MarkdownDir
+const backupNameKeyFile = "names.key.age"
+
+// objectNameKey returns the key of the HMAC that names the objects of an
+// encrypted repository, so that the names do not reveal the SHA1s of the
+// content. The key is stored in the repository encrypted to its recipient,
+// and in the backup state directory for servers that only have the
+// recipient. Without either, a new key is generated; content stored under
+// the old key is then stored once more.
+func objectNameKey(target string, dest BackupDestination, recipient age.Recipient, identities []age.Identity) ([]byte, error) {
+	var key []byte
+	data, err := readBackupFile(dest, backupNameKeyFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("could not read backup name key: %w", err)
+	}
+	if err == nil && len(identities) > 0 {
+		r, err := age.Decrypt(bytes.NewReader(data), identities...)
+		if err == nil {
+			data, err = io.ReadAll(r)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt backup name key: %w", err)
+		}
+		key, _ = hex.DecodeString(strings.TrimSpace(string(data)))
+	}
 
-	err = filepath.Walk(sourceDir, func(path string, info fs.FileInfo, err error) error {
+	localPath := filepath.Join(backupStateDir(), url.PathEscape(target)+".names.key")
+	if key == nil {
+		if data, err := os.ReadFile(localPath); err == nil {
+			key, _ = hex.DecodeString(strings.TrimSpace(string(data)))
+		}
+	}
+	if key == nil {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		w, err := age.Encrypt(&buf, recipient)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if info.IsDir() {
-			return nil // Skip directories themselves
+		io.WriteString(w, hex.EncodeToString(key)+"\n")
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		if err := dest.Put(backupNameKeyFile, &buf, int64(buf.Len())); err != nil {
+			return nil, fmt.Errorf("could not write backup name key: %w", err)
 		}
+	}
 
-		relPath, err := filepath.Rel(sourceDir, path)
+	if data, err := os.ReadFile(localPath); err != nil || strings.TrimSpace(string(data)) != hex.EncodeToString(key) {
+		err := os.MkdirAll(filepath.Dir(localPath), 0700)
+		if err == nil {
+			err = writeFileAtomic(localPath, []byte(hex.EncodeToString(key)+"\n"), 0600)
+		}
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("could not store backup name key: %w", err)
 		}
+	}
+	return key, nil
+}
 
-		// Use forward slashes for zip compatibility
-		zipPath := filepath.ToSlash(relPath)
-		writer, err := zipWriter.Create(zipPath)
+func readBackupKeys(cfg BackupConfig, dest BackupDestination) (age.Recipient, []age.Identity, error) {
+	switch {
+	case cfg.Passphrase != "" && cfg.Recipient != "":
+		return nil, nil, errors.New("set either backup.passphrase or backup.recipient, not both")
+	case cfg.Passphrase != "":
+		identity, err := passphraseIdentity(dest, cfg.Passphrase)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-
-		fileToZip, err := os.Open(path)
+		return identity.Recipient(), []age.Identity{identity}, nil
+	case cfg.Recipient != "":
+		recipient, err := age.ParseX25519Recipient(cfg.Recipient)
 		if err != nil {
-			return err
+			return nil, nil, fmt.Errorf("invalid backup.recipient: %w", err)
+		}
+		if cfg.Identity == "" {
+			return recipient, nil, nil
+		}
+		identities, err := readIdentityFile(cfg.Identity)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, identity := range identities {
+			if x, ok := identity.(*age.X25519Identity); ok && x.Recipient().String() == recipient.String() {
+				return recipient, identities, nil
+			}
 		}
-		defer fileToZip.Close()
+		return nil, nil, fmt.Errorf("backup.identity '%s' does not match backup.recipient", cfg.Identity)
+	case cfg.Identity != "":
+		// Backups are no longer encrypted, but older ones may still be.
+		identities, err := readIdentityFile(cfg.Identity)
+		return nil, identities, err
+	}
+	return nil, nil, nil
+}
 
-		_, err = io.Copy(writer, fileToZip)
-		return err
-	})
+func readIdentityFile(path string) ([]age.Identity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read backup.identity: %w", err)
+	}
+	defer f.Close()
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup.identity '%s': %w", path, err)
+	}
+	return identities, nil
+}
+
+// passphraseIdentity returns the X25519 identity of a passphrase-protected
+// repository. The identity is generated on first use and stored in the
+// repository encrypted with the passphrase, so that the slow scrypt key
+// derivation runs once instead of for every object.
+func passphraseIdentity(dest BackupDestination, passphrase string) (*age.X25519Identity, error) {
+	data, err := readBackupFile(dest, backupKeyFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		identity, err := age.GenerateX25519Identity()
+		if err != nil {
+			return nil, err
+		}
+		recipient, err := age.NewScryptRecipient(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		w, err := age.Encrypt(&buf, recipient)
+		if err != nil {
+			return nil, err
+		}
+		io.WriteString(w, identity.String()+"\n")
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		if err := dest.Put(backupKeyFile, &buf, int64(buf.Len())); err != nil {
+			return nil, fmt.Errorf("could not write backup key: %w", err)
+		}
+		return identity, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read backup key: %w", err)
+	}
 
+	scrypt, err := age.NewScryptIdentity(passphrase)
 	if err != nil {
-		log.Printf("ERROR: Failed during backup zipping process: %v", err)
-		// Attempt to clean up partially created zip file
-		os.Remove(zipFilePath)
-		return
+		return nil, err
+	}
+	r, err := age.Decrypt(bytes.NewReader(data), scrypt)
+	if err != nil {
+		return nil, fmt.Errorf("wrong backup passphrase for %s: %w", backupKeyFile, err)
 	}
+	key, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return age.ParseX25519Identity(strings.TrimSpace(string(key)))
+}
 
-	log.Printf("Successfully created backup: %s", zipFilePath)
+// BackupFile is an entry of a snapshot manifest. Its content is stored in
+// the repository object Object. Manifests of earlier versions leave Object
+// empty; their objects are named by SHA1.
+type BackupFile struct {
+	Path    string    `json:"path"`
+	SHA1    string    `json:"sha1"`
+	Object  string    `json:"object,omitempty"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
 }
 
-func performBackupCleanup() {
-	log.Println("Starting backup cleanup task...")
+// BackupSnapshot is the manifest of one backup run. AddedFiles and AddedSize
+// count the objects the run had to store because no earlier snapshot
+// contained their content.
+type BackupSnapshot struct {
+	ID         string       `json:"id"`
+	Time       time.Time    `json:"time"`
+	Size       int64        `json:"size"`
+	AddedFiles int          `json:"added_files"`
+	AddedSize  int64        `json:"added_size"`
+	Files      []BackupFile `json:"files"`
+}
 
-	backupDir := AppConfig.Backup.Dir
-	retentionDays := AppConfig.Backup.RetentionDays
-	if retentionDays <= 0 {
-		log.Println("Backup retention is disabled (retention_days <= 0).")
-		return
+// backupRepository is a content-addressed backup store on a destination.
+// Every distinct file content is kept once, zlib-compressed, in
+// objects/<aa>/<sha1>, and every backup run is a manifest in
+// snapshots/<id>.json listing the files, their SHA1s and objects. With
+// encryption, objects and manifests are age-encrypted and carry an
+// additional .age suffix, and objects are named by an HMAC of their SHA1
+// instead. snapshots/<id>.objects lists the objects of a snapshot in plain
+// text, so that unreferenced objects can be found without decrypting the
+// manifests.
+type backupRepository struct {
+	target     string
+	dest       BackupDestination
+	recipient  age.Recipient
+	identities []age.Identity
+	nameKey    []byte
+	// objects holds the names of the stored objects once loadObjects has
+	// listed them.
+	objects map[string]bool
+}
+
+func openBackupRepository(target BackupTarget) (*backupRepository, error) {
+	dest, err := openBackupDestination(target)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := loadBackupKeys(target.Name, dest)
+	if err != nil {
+		dest.Close()
+		return nil, err
 	}
+	return &backupRepository{target: target.Name, dest: dest, recipient: keys.recipient, identities: keys.identities, nameKey: keys.nameKey}, nil
+}
 
-	cutoffTime := time.Now().Add(-time.Duration(retentionDays) * 24 * time.Hour)
-	log.Printf("Deleting backups older than %s", cutoffTime.Format("2006-01-02"))
+func (repo *backupRepository) Close() error {
+	return repo.dest.Close()
+}
 
-	entries, err := os.ReadDir(backupDir)
+// loadObjects lists the stored objects with a single listing of the
+// destination. It must be called before the objects are looked up.
+func (repo *backupRepository) loadObjects() error {
+	if repo.objects != nil {
+		return nil
+	}
+	names, err := repo.dest.List("objects")
 	if err != nil {
-		log.Printf("ERROR: Could not read backup directory '%s' for cleanup: %v", backupDir, err)
-		return
+		return fmt.Errorf("could not list backup objects: %w", err)
 	}
+	repo.objects = make(map[string]bool, len(names))
+	for _, name := range names {
+		repo.objects[name] = true
+	}
+	return nil
+}
 
-	deletedCount := 0
-	for _, entry := range entries {
-		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".zip") || !strings.HasPrefix(entry.Name(), "markdown-") {
-			continue
-		}
+// objectName returns the name of the object with the given SHA1 as it is
+// stored by this repository, encrypted or not.
+func (repo *backupRepository) objectName(sha1 string) string {
+	name := sha1
+	if repo.recipient != nil {
+		mac := hmac.New(sha256.New, repo.nameKey)
+		mac.Write([]byte(sha1))
+		name = hex.EncodeToString(mac.Sum(nil)) + ".age"
+	}
+	return "objects/" + name[:2] + "/" + name
+}
 
-		// Extract timestamp from filename: markdown-YYYY-MM-DDTHH-MM-SS.zip
-		timestampStr := strings.TrimSuffix(strings.TrimPrefix(entry.Name(), "markdown-"), ".zip")
-		backupTime, err := time.Parse("2006-01-02T15-04-05", timestampStr)
-		if err != nil {
-			log.Printf("WARNING: Could not parse timestamp from backup file '%s', skipping.", entry.Name())
-			continue
-		}
+// hasObject reports whether the object is stored in the current mode of the
+// repository. Objects stored before encryption was switched on or off are
+// stored again.
+func (repo *backupRepository) hasObject(sha1 string) bool {
+	return repo.objects[repo.objectName(sha1)]
+}
 
-		if backupTime.Before(cutoffTime) {
-			filePath := filepath.Join(backupDir, entry.Name())
-			log.Printf("Deleting old backup: %s", filePath)
-			if err := os.Remove(filePath); err != nil {
-				log.Printf("ERROR: Failed to delete old backup '%s': %v", filePath, err)
-			} else {
-				deletedCount++
-			}
+// findObject returns the name of the object that holds the content of file.
+func (repo *backupRepository) findObject(file BackupFile) (string, bool) {
+	if file.Object != "" {
+		return file.Object, repo.objects[file.Object]
+	}
+	for _, candidate := range legacyObjectNames(file.SHA1) {
+		if repo.objects[candidate] {
+			return candidate, true
 		}
 	}
-	log.Printf("Backup cleanup task finished. Deleted %d old backup(s).", deletedCount)
+	return "", false
 }
 
-// --- store.go ---
-// ... (rest of the file is unchanged, so I will omit it for brevity and just show the main function)
-// ... all store.go, file_monitor.go, versioning.go, search.go, handlers.go, utils.go code remains the same ...
-
-// --- store.go ---
-
-type Document struct {
-	Path    string
-	SHA1    string
-	Content string
+// legacyObjectNames returns the names an object with the given SHA1 had in
+// repositories of earlier versions, encrypted or not.
+func legacyObjectNames(sha1 string) []string {
+	name := "objects/" + sha1[:2] + "/" + sha1
+	return []string{name + ".age", name}
 }
 
-type InMemoryStore struct {
-	sync.RWMutex
-	docs map[string]Document
+// encrypt wraps w so that the data written is encrypted to the recipient of
+// the repository, if any.
+func (repo *backupRepository) encrypt(w io.Writer) (io.WriteCloser, error) {
+	if repo.recipient == nil {
+		return nopWriteCloser{w}, nil
+	}
+	return age.Encrypt(w, repo.recipient)
 }
 
-var store = InMemoryStore{docs: make(map[string]Document)}
-
-func isSpecialPath(path string) bool {
-	return strings.Contains(path, ".extra") || strings.HasSuffix(path, ".attach")
+func (repo *backupRepository) decrypt(r io.Reader) (io.Reader, error) {
+	if len(repo.identities) == 0 {
+		return nil, errNoBackupIdentity
+	}
+	return age.Decrypt(r, repo.identities...)
 }
 
-func (s *InMemoryStore) Scan() {
-	s.Lock()
-	defer s.Unlock()
-	log.Println("Scanning markdown directory for initial cache...")
+type nopWriteCloser struct{ io.Writer }
 
-	s.docs = make(map[string]Document)
+func (nopWriteCloser) Close() error { return nil }
 
-	users, err := os.ReadDir(AppConfig.MarkdownDir)
+// storeFile adds the content of the file at path to the repository. The
+// content is hashed while it is compressed, so the object always matches
+// its name even if the file changes during the backup.
+func (repo *backupRepository) storeFile(path string) (sha1Hex string, size int64, added bool, err error) {
+	src, err := os.Open(path)
 	if err != nil {
-		log.Printf("Could not read markdown dir: %v. It may be created later.", err)
-		return
+		return "", 0, false, err
 	}
+	defer src.Close()
 
-	for _, userEntry := range users {
-		if !userEntry.IsDir() {
-			continue
-		}
-		user := userEntry.Name()
-		userPath := filepath.Join(AppConfig.MarkdownDir, user)
-
-		filepath.WalkDir(userPath, func(path string, d fs.DirEntry, err error) error {
-			if err != nil {
-				return err
-			}
-			if isSpecialPath(path) {
-				return nil
-			}
-			if d.IsDir() || !strings.HasSuffix(strings.ToLower(d.Name()), ".md") {
-				return nil
-			}
-
-			content, err := os.ReadFile(path)
-			if err != nil {
-				log.Printf("Error reading file for cache %s: %v", path, err)
-				return nil
-			}
-
-			relPath, _ := filepath.Rel(AppConfig.MarkdownDir, path)
+	// The object is prepared in a local temporary file, as its name is only
+	// known once the content has been hashed.
+	tmp, err := os.CreateTemp("", "gonote-object-*")
+	if err != nil {
+		return "", 0, false, err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+	defer tmp.Close()
 
-			doc := Document{
-				Path:    relPath,
-				Content: string(content),
-				SHA1:    calculateSHA1(content),
-			}
-			s.docs[relPath] = doc
+	hasher := sha1.New()
+	ew, err := repo.encrypt(tmp)
+	if err != nil {
+		return "", 0, false, err
+	}
+	zw := zlib.NewWriter(ew)
+	size, err = io.Copy(io.MultiWriter(zw, hasher), src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = ew.Close()
+	}
+	if err != nil {
+		return "", 0, false, err
+	}
 
-			return nil
-		})
+	sha1Hex = hex.EncodeToString(hasher.Sum(nil))
+	if repo.hasObject(sha1Hex) {
+		return sha1Hex, size, false, nil
+	}
+	stored, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", 0, false, err
 	}
-	log.Printf("Initial cache populated with %d documents.", len(s.docs))
+	name := repo.objectName(sha1Hex)
+	if err := repo.dest.Put(name, tmp, stored); err != nil {
+		return "", 0, false, err
+	}
+	repo.objects[name] = true
+	return sha1Hex, size, true, nil
 }
 
-func (s *InMemoryStore) UpdateDoc(relPath string, content []byte) {
-	s.Lock()
-	defer s.Unlock()
-
-	doc := Document{
-		Path:    relPath,
-		Content: string(content),
-		SHA1:    calculateSHA1(content),
+// openObject returns the decrypted and decompressed content of file.
+func (repo *backupRepository) openObject(file BackupFile) (io.ReadCloser, error) {
+	name, ok := repo.findObject(file)
+	if !ok {
+		return nil, fmt.Errorf("object %s: %w", file.SHA1, fs.ErrNotExist)
 	}
-	s.docs[relPath] = doc
-	log.Printf("Cache updated for: %s", relPath)
+	f, err := repo.dest.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = f
+	if strings.HasSuffix(name, ".age") {
+		if r, err = repo.decrypt(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, f}, nil
 }
 
-func (s *InMemoryStore) DeleteDoc(relPath string) {
-	s.Lock()
-	defer s.Unlock()
-	delete(s.docs, relPath)
-	log.Printf("Cache deleted for: %s", relPath)
+// newSnapshotID returns the ID of a snapshot taken at t that none of ids
+// uses. IDs have second resolution, so "-2", "-3", ... is appended when
+// another snapshot was taken in the same second.
+func newSnapshotID(t time.Time, ids []string) string {
+	id := t.Format(backupTimeFormat)
+	for n := 2; slices.Contains(ids, id); n++ {
+		id = fmt.Sprintf("%s-%d", t.Format(backupTimeFormat), n)
+	}
+	return id
 }
 
-// --- file_monitor.go ---
+// snapshotTime returns the time encoded in a snapshot ID.
+func snapshotTime(id string) (time.Time, error) {
+	if len(id) > len(backupTimeFormat) {
+		id = id[:len(backupTimeFormat)]
+	}
+	return time.ParseInLocation(backupTimeFormat, id, time.Local)
+}
 
-func WatchMarkdownDir() {
-	watcher, err := fsnotify.NewWatcher()
+// snapshotIDs lists the snapshots of the repository, oldest first.
+func (repo *backupRepository) snapshotIDs() ([]string, error) {
+	names, err := repo.dest.List("snapshots")
 	if err != nil {
-		log.Fatalf("Failed to create file watcher: %v", err)
+		return nil, err
 	}
-	go func() {
-		defer watcher.Close()
-		for {
-			select {
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return
-				}
-
-				relPath, err := filepath.Rel(AppConfig.MarkdownDir, event.Name)
-				if err != nil || isSpecialPath(relPath) {
-					continue
-				}
-
-				if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) {
-					info, err := os.Stat(event.Name)
-					if err == nil && !info.IsDir() {
-						log.Printf("Watcher detected change in %s, updating cache.", relPath)
-						content, err := os.ReadFile(event.Name)
-						if err == nil {
-							store.UpdateDoc(relPath, content)
-						}
-					}
-				}
-				if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
-					store.DeleteDoc(relPath)
-				}
+	var ids []string
+	for _, name := range names {
+		if id, ok := strings.CutSuffix(strings.TrimSuffix(path.Base(name), ".age"), ".json"); ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
 
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return
-				}
-				log.Printf("Watcher error: %v", err)
-			}
+func (repo *backupRepository) loadSnapshot(id string) (*BackupSnapshot, error) {
+	snapshotName := "snapshots/" + id + ".json"
+	data, err := readBackupFile(repo.dest, snapshotName+".age")
+	if err == nil {
+		r, err := repo.decrypt(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt snapshot manifest '%s': %w", id, err)
 		}
-	}()
+		if data, err = io.ReadAll(r); err != nil {
+			return nil, fmt.Errorf("could not decrypt snapshot manifest '%s': %w", id, err)
+		}
+	} else if errors.Is(err, fs.ErrNotExist) {
+		data, err = readBackupFile(repo.dest, snapshotName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshot BackupSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("invalid snapshot manifest '%s': %w", id, err)
+	}
+	return &snapshot, nil
+}
 
-	filepath.WalkDir(AppConfig.MarkdownDir, func(path string, d fs.DirEntry, err error) error {
+// saveSnapshot stores the object index and then the manifest of snapshot.
+func (repo *backupRepository) saveSnapshot(snapshot *BackupSnapshot) error {
+	objects := []string{}
+	for _, file := range snapshot.Files {
+		objects = append(objects, file.Object)
+	}
+	slices.Sort(objects)
+	index, err := json.Marshal(slices.Compact(objects))
+	if err != nil {
+		return err
+	}
+	if err := repo.dest.Put("snapshots/"+snapshot.ID+".objects", bytes.NewReader(index), int64(len(index))); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	name := snapshot.ID + ".json"
+	if repo.recipient != nil {
+		var buf bytes.Buffer
+		w, err := repo.encrypt(&buf)
 		if err != nil {
 			return err
 		}
-		if d.IsDir() && !isSpecialPath(path) {
-			watcher.Add(path)
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			return err
 		}
-		return nil
-	})
-	log.Println("File watcher started.")
+		data, name = buf.Bytes(), name+".age"
+	}
+	return repo.dest.Put("snapshots/"+name, bytes.NewReader(data), int64(len(data)))
 }
 
-// --- versioning.go ---
+func (repo *backupRepository) deleteSnapshot(id string) error {
+	snapshotName := "snapshots/" + id + ".json"
+	err := repo.dest.Delete(snapshotName + ".age")
+	if errors.Is(err, fs.ErrNotExist) {
+		err = repo.dest.Delete(snapshotName)
+	}
+	if err != nil {
+		return err
+	}
+	if err := repo.dest.Delete("snapshots/" + id + ".objects"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
 
-const backupBucket = "versions"
-const maxPatchChain = 50
+// snapshotObjects returns the names of the objects a snapshot refers to.
+// Snapshots of earlier versions have no object index; their manifest is
+// read instead, which needs the identity if it is encrypted.
+func (repo *backupRepository) snapshotObjects(id string) ([]string, error) {
+	data, err := readBackupFile(repo.dest, "snapshots/"+id+".objects")
+	if err == nil {
+		var objects []string
+		if err := json.Unmarshal(data, &objects); err != nil {
+			return nil, fmt.Errorf("invalid object index of snapshot '%s': %w", id, err)
+		}
+		return objects, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
 
-type VersionRecord struct {
-	ID        uint64    `json:"id"`
-	OldSHA1   string    `json:"old_sha1"`
-	NewSHA1   string    `json:"new_sha1"`
-	Patch     string    `json:"patch"`
-	Type      string    `json:"type"`
-	Comment   string    `json:"comment"`
-	Timestamp time.Time `json:"timestamp"`
+	snapshot, err := repo.loadSnapshot(id)
+	if err != nil {
+		return nil, err
+	}
+	var objects []string
+	for _, file := range snapshot.Files {
+		if file.Object != "" {
+			objects = append(objects, file.Object)
+		} else {
+			objects = append(objects, legacyObjectNames(file.SHA1)...)
+		}
+	}
+	return objects, nil
 }
 
-type VersionManager struct {
-	db *bbolt.DB
+// collectGarbage removes the objects that no snapshot refers to anymore.
+func (repo *backupRepository) collectGarbage(ids []string) (int, error) {
+	referenced := make(map[string]bool)
+	for _, id := range ids {
+		objects, err := repo.snapshotObjects(id)
+		if err != nil {
+			return 0, err
+		}
+		for _, name := range objects {
+			referenced[name] = true
+		}
+	}
+
+	if err := repo.loadObjects(); err != nil {
+		return 0, err
+	}
+	removed := 0
+	for name := range repo.objects {
+		if referenced[name] {
+			continue
+		}
+		if err := repo.dest.Delete(name); err != nil {
+			return removed, err
+		}
+		delete(repo.objects, name)
+		removed++
+	}
+	return removed, nil
 }
 
-func NewVersionManager(user string) (*VersionManager, error) {
-	dbPath := filepath.Join(AppConfig.MarkdownDir, user, ".extra", "versions.db")
-	os.MkdirAll(filepath.Dir(dbPath), 0755)
+// runBackup stores a new snapshot of the markdown directory in the
+// repository of target. Files whose size and modification time match the
+// previous snapshot are not read again, and content the repository already
+// holds is not stored again. Writes are paused only while the other files
+// are copied to a staging directory; they are uploaded from there.
+func runBackup(target BackupTarget) (*BackupSnapshot, error) {
+	backupMutex.Lock()
+	defer backupMutex.Unlock()
 
-	db, err := bbolt.Open(dbPath, 0600, nil)
+	repo, err := openBackupRepository(target)
 	if err != nil {
 		return nil, err
 	}
+	defer repo.Close()
+	if err := repo.loadObjects(); err != nil {
+		return nil, err
+	}
 
-	err = db.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(backupBucket))
-		return err
+	// Without an identity the previous manifest of an encrypted repository
+	// cannot be read; every file is then hashed again, but content the
+	// repository holds is still not stored twice.
+	previous := make(map[string]BackupFile)
+	ids, err := repo.snapshotIDs()
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) > 0 {
+		last, err := repo.loadSnapshot(ids[len(ids)-1])
+		if err != nil && !errors.Is(err, errNoBackupIdentity) {
+			return nil, err
+		}
+		if last != nil {
+			for _, file := range last.Files {
+				previous[file.Path] = file
+			}
+		}
+	}
+
+	staging, err := os.MkdirTemp(filepath.Dir(filepath.Clean(AppConfig.MarkdownDir)), ".backup-*")
+	if err != nil {
+		return nil, fmt.Errorf("could not create staging directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	writeGate.Lock()
+	now := time.Now()
+	files, err := captureBackupView(staging, func(file *BackupFile) bool {
+		prev, ok := previous[file.Path]
+		if ok && prev.Size == file.Size && prev.ModTime.Equal(file.ModTime) && repo.hasObject(prev.SHA1) {
+			file.SHA1 = prev.SHA1
+			return true
+		}
+		return false
 	})
+	writeGate.Unlock()
 	if err != nil {
-		db.Close()
 		return nil, err
 	}
 
-	return &VersionManager{db: db}, nil
-}
+	snapshot := &BackupSnapshot{ID: newSnapshotID(now, ids), Time: now, Files: files}
+	for i := range snapshot.Files {
+		file := &snapshot.Files[i]
+		if file.SHA1 == "" {
+			sha1, size, added, err := repo.storeFile(filepath.Join(staging, filepath.FromSlash(file.Path)))
+			if err != nil {
+				return nil, fmt.Errorf("could not back up '%s': %w", file.Path, err)
+			}
+			file.SHA1, file.Size = sha1, size
+			if added {
+				snapshot.AddedFiles++
+				snapshot.AddedSize += size
+			}
+		}
+		file.Object = repo.objectName(file.SHA1)
+		snapshot.Size += file.Size
+	}
 
-func (vm *VersionManager) Close() {
-	vm.db.Close()
+	if err := repo.saveSnapshot(snapshot); err != nil {
+		return nil, fmt.Errorf("could not save snapshot manifest: %w", err)
+	}
+	return snapshot, nil
 }
 
-func (vm *VersionManager) CreateBackup(filePath, oldSHA1, newSHA1, oldContent, newContent, comment string) error {
-	return vm.db.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(backupBucket))
-		fileBucket, err := b.CreateBucketIfNotExists([]byte(filePath))
+// captureBackupView lists the files of the markdown directory and copies
+// those that reuse does not accept, because the repository lacks their
+// content, to the same path below staging. The caller holds writeGate, so
+// the copies are consistent with each other and with the version history.
+// The files without a SHA1 in the result are the copied ones.
+//
+// versions.db is copied with a read transaction instead of byte by byte, and
+// embeddings.db is skipped, as it is rebuilt from the notes.
+func captureBackupView(staging string, reuse func(file *BackupFile) bool) ([]BackupFile, error) {
+	sourceDir := AppConfig.MarkdownDir
+	files := []BackupFile{}
+	err := filepath.WalkDir(sourceDir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
+			// Files deleted while the backup runs are skipped.
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
 			return err
 		}
-
-		stats := fileBucket.Stats()
-		backupType := "patch"
-		if stats.KeyN%maxPatchChain == 0 {
-			backupType = "full"
+		inExtra := filepath.Base(filepath.Dir(path)) == ".extra"
+		if d.IsDir() && inExtra && d.Name() == attachmentTextDir {
+			return filepath.SkipDir // Rebuilt from the attachments themselves
 		}
-
-		patchContent := newContent
-		if backupType == "patch" {
-			dmp := diffmatchpatch.New()
-			patches := dmp.PatchMake(oldContent, newContent)
-			patchContent = dmp.PatchToText(patches)
+		if d.IsDir() || (strings.HasPrefix(d.Name(), ".") && strings.HasSuffix(d.Name(), ".tmp")) {
+			return nil // Skip directories and files being written
 		}
-
-		id, _ := fileBucket.NextSequence()
-		record := VersionRecord{
-			ID:        id,
-			OldSHA1:   oldSHA1,
-			NewSHA1:   newSHA1,
-			Patch:     patchContent,
-			Type:      backupType,
-			Comment:   comment,
-			Timestamp: time.Now(),
+		if inExtra && (d.Name() == "embeddings.db" || d.Name() == "journal.db") {
+			return nil
 		}
-
-		buf, err := json.Marshal(record)
+		info, err := d.Info()
 		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
 			return err
 		}
-		return fileBucket.Put(itob(id), buf)
-	})
-}
-
-func (vm *VersionManager) GetHistory(filePath string) ([]VersionRecord, error) {
-	var history []VersionRecord
-	err := vm.db.View(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(backupBucket))
-		fileBucket := b.Bucket([]byte(filePath))
-		if fileBucket == nil {
-			return nil
+		relPath, err := filepath.Rel(sourceDir, path)
+		if err != nil {
+			return err
 		}
 
-		c := fileBucket.Cursor()
-		for k, v := c.Last(); k != nil; k, v = c.Prev() {
-			var record VersionRecord
-			if err := json.Unmarshal(v, &record); err == nil {
-				history = append(history, record)
+		file := BackupFile{Path: filepath.ToSlash(relPath), Size: info.Size(), ModTime: info.ModTime()}
+		isBoltDB := inExtra && d.Name() == "versions.db"
+		if isBoltDB || !reuse(&file) {
+			dst := filepath.Join(staging, relPath)
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return err
 			}
-		}
-		return nil
-	})
-	return history, err
-}
-
-func (vm *VersionManager) GetVersionContent(filePath string, targetVersionID uint64) (string, error) {
-	var recordsToApply []VersionRecord
-	var baseContent string
-
-	err := vm.db.View(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(backupBucket))
-		fileBucket := b.Bucket([]byte(filePath))
-		if fileBucket == nil {
-			return fmt.Errorf("no history for file: %s", filePath)
-		}
-
-		c := fileBucket.Cursor()
-		for k, v := c.Seek(itob(targetVersionID)); k != nil; k, v = c.Prev() {
-			var record VersionRecord
-			if err := json.Unmarshal(v, &record); err != nil {
-				continue
+			if isBoltDB {
+				err = copyBoltDB(path, dst)
+			} else {
+				err = copyFile(path, dst)
 			}
-			recordsToApply = append(recordsToApply, record)
-			if record.Type == "full" {
-				baseContent = record.Patch
-				break
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("could not back up '%s': %w", path, err)
 			}
 		}
+		files = append(files, file)
 		return nil
 	})
+	return files, err
+}
 
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
 	if err != nil {
-		return "", err
+		return err
 	}
-	if baseContent == "" {
-		return "", fmt.Errorf("could not find a full backup base for version %d", targetVersionID)
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
 	}
-
-	dmp := diffmatchpatch.New()
-	currentContent := baseContent
-	for i := len(recordsToApply) - 2; i >= 0; i-- {
-		record := recordsToApply[i]
-		if record.Type == "patch" {
-			patches, err := dmp.PatchFromText(record.Patch)
-			if err != nil {
-				return "", fmt.Errorf("error parsing patch for version %d: %v", record.ID, err)
-			}
-			newContent, _ := dmp.PatchApply(patches, currentContent)
-			currentContent = newContent
-		}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
 	}
-
-	return currentContent, nil
+	return err
 }
 
-// --- search.go ---
-
-type SearchResult struct {
-	Path    string   `json:"path"`
-	Context []string `json:"context"`
+// copyBoltDB writes a consistent copy of a bbolt database with a read
+// transaction, so that a write committed at the same time cannot tear it.
+func copyBoltDB(src, dst string) error {
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+	db, err := bbolt.Open(src, 0600, &bbolt.Options{ReadOnly: true, Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	err = db.View(func(tx *bbolt.Tx) error {
+		_, err := tx.WriteTo(out)
+		return err
+	})
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
-func SearchInMemory(query string, useRegex bool, user string) []SearchResult {
-	store.RLock()
-	defer store.RUnlock()
+func performBackup() {
+	if !beginBackupRun() {
+		log.Println("Skipping scheduled backup: the previous backup is still running.")
+		return
+	}
+	defer endBackupRun()
 
-	var results []SearchResult
-	var re *regexp.Regexp
-	var err error
+	log.Println("Starting scheduled backup...")
+	backupAllTargets()
+}
 
-	keywords := []string{}
-	if useRegex {
-		re, err = regexp.Compile(query)
+// backupAllTargets backs up to every target, records the runs and sends a
+// notification if any of them failed. The caller has called beginBackupRun.
+func backupAllTargets() {
+	var failed []BackupRun
+	for _, target := range backupTargets() {
+		run := BackupRun{Target: target.Name, Start: time.Now()}
+		snapshot, err := runBackup(target)
+		run.DurationMS = time.Since(run.Start).Milliseconds()
 		if err != nil {
-			return results
-		}
-	} else {
-		keywords = strings.Fields(strings.ToLower(query))
-		if len(keywords) == 0 {
-			return results
+			log.Printf("ERROR: Backup to target '%s' failed: %v", target.Name, err)
+			run.Error = err.Error()
+			failed = append(failed, run)
+		} else {
+			log.Printf("Successfully created backup snapshot %s on target '%s': %d files (%d bytes), %d new objects (%d bytes).",
+				snapshot.ID, target.Name, len(snapshot.Files), snapshot.Size, snapshot.AddedFiles, snapshot.AddedSize)
+			run.Snapshot = snapshot.ID
+			run.Files, run.Size = len(snapshot.Files), snapshot.Size
+			run.AddedFiles, run.AddedSize = snapshot.AddedFiles, snapshot.AddedSize
 		}
+		recordBackupRun(run)
+	}
+	if len(failed) > 0 {
+		notifyBackupFailure(failed)
 	}
+}
 
-	userPrefix := user + string(filepath.Separator)
-	for path, doc := range store.docs {
-		if !strings.HasPrefix(path, userPrefix) {
-			continue
-		}
+// BackupRun records a backup run to one target.
+type BackupRun struct {
+	Target     string    `json:"target"`
+	Start      time.Time `json:"start"`
+	DurationMS int64     `json:"duration_ms"`
+	Snapshot   string    `json:"snapshot,omitempty"`
+	Files      int       `json:"files"`
+	Size       int64     `json:"size"`
+	AddedFiles int       `json:"added_files"`
+	AddedSize  int64     `json:"added_size"`
+	Error      string    `json:"error,omitempty"`
+	// Cleanup marks a failed retention cleanup, which is only reported to
+	// backup.notify.
+	Cleanup bool `json:"cleanup,omitempty"`
+}
 
-		contentLower := strings.ToLower(doc.Content)
-		matched := false
-		if useRegex {
-			if re.MatchString(doc.Content) {
-				matched = true
+// backupHistorySize is the number of runs kept for the status API.
+const backupHistorySize = 100
+
+// backupState tracks the scheduler and the backup runs since the server
+// started. The last run to each target is also stored in the backup state
+// directory, so that it is still reported after a restart.
+var backupState struct {
+	sync.Mutex
+	running   bool
+	history   []BackupRun // newest first
+	scheduler *cron.Cron
+	entry     cron.EntryID
+}
+
+// beginBackupRun marks a backup as running. It returns false if one already
+// is, so that manual and scheduled runs never overlap.
+func beginBackupRun() bool {
+	backupState.Lock()
+	defer backupState.Unlock()
+	if backupState.running {
+		return false
+	}
+	backupState.running = true
+	return true
+}
+
+func endBackupRun() {
+	backupState.Lock()
+	backupState.running = false
+	backupState.Unlock()
+}
+
+func recordBackupRun(run BackupRun) {
+	backupState.Lock()
+	defer backupState.Unlock()
+	backupState.history = append([]BackupRun{run}, backupState.history...)
+	if len(backupState.history) > backupHistorySize {
+		backupState.history = backupState.history[:backupHistorySize]
+	}
+
+	data, _ := json.Marshal(run)
+	path := lastBackupRunPath(run.Target)
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err == nil {
+		err = writeFileAtomic(path, data, 0600)
+	}
+	if err != nil {
+		log.Printf("ERROR: Could not store the last backup run to target '%s': %v", run.Target, err)
+	}
+}
+
+func lastBackupRunPath(target string) string {
+	return filepath.Join(backupStateDir(), url.PathEscape(target)+".last-run.json")
+}
+
+// loadLastBackupRun returns the stored last run to target, or nil if there
+// is none.
+func loadLastBackupRun(target string) *BackupRun {
+	data, err := os.ReadFile(lastBackupRunPath(target))
+	if err != nil {
+		return nil
+	}
+	var run BackupRun
+	if err := json.Unmarshal(data, &run); err != nil {
+		log.Printf("WARNING: Could not parse the last backup run to target '%s': %v", target, err)
+		return nil
+	}
+	return &run
+}
+
+// BackupTargetStatus describes a target with its last run and the snapshots
+// it holds.
+type BackupTargetStatus struct {
+	Name    string          `json:"name"`
+	Type    string          `json:"type"`
+	LastRun *BackupRun      `json:"last_run,omitempty"`
+	Backups []BackupSummary `json:"backups"`
+	Error   string          `json:"error,omitempty"`
+}
+
+type BackupStatus struct {
+	Enabled bool                 `json:"enabled"`
+	Cron    string               `json:"cron"`
+	Running bool                 `json:"running"`
+	NextRun *time.Time           `json:"next_run,omitempty"`
+	LastRun *BackupRun           `json:"last_run,omitempty"`
+	History []BackupRun          `json:"history"`
+	Targets []BackupTargetStatus `json:"targets"`
+}
+
+// getBackupStatus reports the scheduler state, the recent runs and the
+// snapshots of every target. A target that cannot be listed reports its
+// error instead of its snapshots.
+func getBackupStatus() BackupStatus {
+	status := BackupStatus{Enabled: AppConfig.Backup.Enabled, Cron: AppConfig.Backup.Cron}
+	backupState.Lock()
+	status.Running = backupState.running
+	status.History = append([]BackupRun{}, backupState.history...)
+	if backupState.scheduler != nil {
+		next := backupState.scheduler.Entry(backupState.entry).Next
+		status.NextRun = &next
+	}
+	backupState.Unlock()
+	if len(status.History) > 0 {
+		status.LastRun = &status.History[0]
+	}
+
+	for _, target := range backupTargets() {
+		targetStatus := BackupTargetStatus{Name: target.Name, Type: target.Type, Backups: []BackupSummary{}}
+		if targetStatus.Type == "" {
+			targetStatus.Type = "local"
+		}
+		for i, run := range status.History {
+			if run.Target == target.Name {
+				targetStatus.LastRun = &status.History[i]
+				break
 			}
+		}
+		if targetStatus.LastRun == nil {
+			// No run since the server started.
+			targetStatus.LastRun = loadLastBackupRun(target.Name)
+		}
+		if run := targetStatus.LastRun; run != nil && (status.LastRun == nil || run.Start.After(status.LastRun.Start)) {
+			status.LastRun = run
+		}
+		if backups, err := listBackups(target.Name); err != nil {
+			targetStatus.Error = err.Error()
 		} else {
-			allKeywordsFound := true
-			for _, keyword := range keywords {
-				if !strings.Contains(contentLower, keyword) {
-					allKeywordsFound = false
-					break
-				}
-			}
-			if allKeywordsFound {
-				matched = true
+			targetStatus.Backups = backups
+		}
+		status.Targets = append(status.Targets, targetStatus)
+	}
+	return status
+}
+
+// notifyBackupFailure reports failed runs to the webhook and the email
+// recipients of backup.notify. Failures to notify are only logged.
+func notifyBackupFailure(runs []BackupRun) {
+	cfg := AppConfig.Backup.Notify
+	host, _ := os.Hostname()
+
+	if cfg.Webhook != "" {
+		data, _ := json.Marshal(map[string]interface{}{
+			"event": "backup_failed",
+			"host":  host,
+			"runs":  runs,
+		})
+		client := &http.Client{Timeout: 30 * time.Second}
+		resp, err := client.Post(cfg.Webhook, "application/json", bytes.NewReader(data))
+		if err != nil {
+			log.Printf("ERROR: Could not send backup failure webhook: %v", err)
+		} else {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				log.Printf("ERROR: Backup failure webhook returned %s", resp.Status)
 			}
 		}
+	}
 
-		if matched {
-			context := getMatchContext(doc.Content, useRegex, re, keywords)
-			results = append(results, SearchResult{
-				Path:    strings.ReplaceAll(strings.TrimPrefix(doc.Path, userPrefix), string(filepath.Separator), "/"),
-				Context: context,
-			})
+	if cfg.SMTPHost != "" && len(cfg.EmailTo) > 0 {
+		var msg strings.Builder
+		fmt.Fprintf(&msg, "From: %s\r\n", cfg.EmailFrom)
+		fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(cfg.EmailTo, ", "))
+		fmt.Fprintf(&msg, "Subject: GoNote backup failed on %s\r\n", host)
+		fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+		msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+		for _, run := range runs {
+			task := "Backup to"
+			if run.Cleanup {
+				task = "Cleanup of"
+			}
+			fmt.Fprintf(&msg, "%s target '%s' started at %s failed: %s\r\n", task, run.Target, run.Start.Format(time.RFC3339), run.Error)
+		}
+		var auth smtp.Auth
+		if cfg.SMTPUsername != "" {
+			smtpHost, _, _ := net.SplitHostPort(cfg.SMTPHost)
+			auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, smtpHost)
+		}
+		if err := smtp.SendMail(cfg.SMTPHost, auth, cfg.EmailFrom, cfg.EmailTo, []byte(msg.String())); err != nil {
+			log.Printf("ERROR: Could not send backup failure email: %v", err)
 		}
 	}
-	return results
 }
 
-func getMatchContext(content string, useRegex bool, re *regexp.Regexp, keywords []string) []string {
-	lines := strings.Split(content, "\n")
-	var contextLines []string
+// snapshotsToKeep applies grandfather-father-son retention to snapshot
+// times sorted newest first: the newest snapshot of each of the last
+// KeepHourly hours, KeepDaily days, KeepWeekly weeks, KeepMonthly months and
+// KeepYearly years is kept, as is every snapshot younger than RetentionDays
+// and the newest snapshot.
+func snapshotsToKeep(times []time.Time, cfg BackupConfig, now time.Time) []bool {
+	keep := make([]bool, len(times))
+	if len(times) > 0 {
+		keep[0] = true
+	}
+	if cfg.RetentionDays > 0 {
+		cutoff := now.AddDate(0, 0, -cfg.RetentionDays)
+		for i, t := range times {
+			if t.After(cutoff) {
+				keep[i] = true
+			}
+		}
+	}
 
-	for i, line := range lines {
-		lineLower := strings.ToLower(line)
-		isMatch := false
-		if useRegex {
-			if re.MatchString(line) {
-				isMatch = true
+	periods := []struct {
+		count int
+		key   func(time.Time) string
+	}{
+		{cfg.KeepHourly, func(t time.Time) string { return t.Format("2006-01-02T15") }},
+		{cfg.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{cfg.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{cfg.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{cfg.KeepYearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+	for _, period := range periods {
+		lastKey := ""
+		kept := 0
+		for i, t := range times {
+			if kept >= period.count {
+				break
 			}
-		} else {
-			for _, keyword := range keywords {
-				if strings.Contains(lineLower, keyword) {
-					isMatch = true
-					break
-				}
+			if key := period.key(t); key != lastKey {
+				keep[i] = true
+				lastKey = key
+				kept++
 			}
 		}
+	}
+	return keep
+}
 
-		if isMatch {
-			contextLines = append(contextLines, fmt.Sprintf("%d: %s", i+1, line))
+func performBackupCleanup() {
+	log.Println("Starting backup cleanup task...")
+
+	backupMutex.Lock()
+	defer backupMutex.Unlock()
+
+	deletedCount, removedObjects := 0, 0
+	var failed []BackupRun
+	for _, target := range backupTargets() {
+		start := time.Now()
+		deleted, removed, err := cleanupBackupTarget(target)
+		deletedCount += deleted
+		removedObjects += removed
+		if err != nil {
+			failed = append(failed, BackupRun{Target: target.Name, Start: start, DurationMS: time.Since(start).Milliseconds(), Error: err.Error(), Cleanup: true})
 		}
-		if len(contextLines) >= 5 {
-			break
+	}
+
+	deletedCount += cleanupLegacyBackups()
+	log.Printf("Backup cleanup task finished. Deleted %d old backup(s) and %d unreferenced object(s).", deletedCount, removedObjects)
+	if len(failed) > 0 {
+		notifyBackupFailure(failed)
+	}
+}
+
+// cleanupBackupTarget applies the retention policy to the snapshots of
+// target and removes the objects no remaining snapshot references. Errors
+// are logged as they occur and returned together.
+func cleanupBackupTarget(target BackupTarget) (deletedCount, removedObjects int, err error) {
+	repo, err := openBackupRepository(target)
+	if err != nil {
+		log.Printf("ERROR: Backup target '%s': %v", target.Name, err)
+		return 0, 0, err
+	}
+	defer repo.Close()
+	ids, err := repo.snapshotIDs()
+	if err != nil {
+		log.Printf("ERROR: Could not list backup snapshots on target '%s': %v", target.Name, err)
+		return 0, 0, fmt.Errorf("could not list snapshots: %w", err)
+	}
+
+	// Newest first, as expected by snapshotsToKeep.
+	var times []time.Time
+	var candidates []string
+	for i := len(ids) - 1; i >= 0; i-- {
+		t, err := snapshotTime(ids[i])
+		if err != nil {
+			log.Printf("WARNING: Could not parse timestamp from backup snapshot '%s', skipping.", ids[i])
+			continue
 		}
+		times = append(times, t)
+		candidates = append(candidates, ids[i])
 	}
-	return contextLines
+
+	keep := snapshotsToKeep(times, AppConfig.Backup, time.Now())
+	var remaining []string
+	var errs []error
+	for i, id := range candidates {
+		if keep[i] {
+			remaining = append(remaining, id)
+			continue
+		}
+		log.Printf("Deleting old backup snapshot %s on target '%s'", id, target.Name)
+		if err := repo.deleteSnapshot(id); err != nil {
+			log.Printf("ERROR: Failed to delete old backup snapshot '%s': %v", id, err)
+			errs = append(errs, fmt.Errorf("could not delete snapshot %s: %w", id, err))
+			remaining = append(remaining, id)
+		} else {
+			deletedCount++
+		}
+	}
+
+	removedObjects, err = repo.collectGarbage(remaining)
+	if errors.Is(err, errNoBackupIdentity) {
+		log.Printf("WARNING: Unreferenced backup objects on target '%s' are kept: %v", target.Name, err)
+	} else if err != nil {
+		log.Printf("ERROR: Failed to remove unreferenced backup objects on target '%s': %v", target.Name, err)
+		errs = append(errs, fmt.Errorf("could not remove unreferenced objects: %w", err))
+	}
+	return deletedCount, removedObjects, errors.Join(errs...)
 }
 
-// --- handlers.go ---
+// legacyRetentionDays is how long legacy zip backups are kept when
+// RetentionDays is 0, which was the default RetentionDays of earlier
+// versions.
+const legacyRetentionDays = 180
 
-type TreeItem struct {
-	Name        string      `json:"name"`
-	IsDir       bool        `json:"is_dir"`
-	Size        int64       `json:"size"`
-	ModTime     time.Time   `json:"mod_time"`
-	AttachCount int         `json:"attach_count,omitempty"`
-	Children    []*TreeItem `json:"children,omitempty"`
+// cleanupLegacyBackups deletes the full zip backups of earlier versions once
+// they are older than RetentionDays.
+func cleanupLegacyBackups() int {
+	backupDir := AppConfig.Backup.Dir
+	retentionDays := AppConfig.Backup.RetentionDays
+	if retentionDays <= 0 {
+		retentionDays = legacyRetentionDays
+	}
+
+	cutoffTime := time.Now().Add(-time.Duration(retentionDays) * 24 * time.Hour)
+
+	entries, err := os.ReadDir(backupDir)
+	if err != nil {
+		log.Printf("ERROR: Could not read backup directory '%s' for cleanup: %v", backupDir, err)
+		return 0
+	}
+
+	deletedCount := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".zip") || !strings.HasPrefix(entry.Name(), "markdown-") {
+			continue
+		}
+
+		// Extract timestamp from filename: markdown-YYYY-MM-DDTHH-MM-SS.zip
+		timestampStr := strings.TrimSuffix(strings.TrimPrefix(entry.Name(), "markdown-"), ".zip")
+		backupTime, err := time.Parse(backupTimeFormat, timestampStr)
+		if err != nil {
+			log.Printf("WARNING: Could not parse timestamp from backup file '%s', skipping.", entry.Name())
+			continue
+		}
+
+		if backupTime.Before(cutoffTime) {
+			filePath := filepath.Join(backupDir, entry.Name())
+			log.Printf("Deleting old backup: %s", filePath)
+			if err := os.Remove(filePath); err != nil {
+				log.Printf("ERROR: Failed to delete old backup '%s': %v", filePath, err)
+			} else {
+				deletedCount++
+			}
+		}
+	}
+	return deletedCount
 }
 
-type AttachmentInfo struct {
-	Name       string    `json:"name"`
-	AttachPath string    `json:"attachPath"`
+// BackupSummary describes a snapshot without its file list.
+type BackupSummary struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	Files      int       `json:"files"`
 	Size       int64     `json:"size"`
-	ModTime    time.Time `json:"mod_time"`
+	AddedFiles int       `json:"added_files"`
+	AddedSize  int64     `json:"added_size"`
 }
 
-func respondJSON(w http.ResponseWriter, status int, payload interface{}) {
-	response, err := json.Marshal(payload)
+// listBackups returns the summaries of all snapshots on the named target,
+// or on the first target if name is empty, newest first.
+func listBackups(name string) ([]BackupSummary, error) {
+	target, err := findBackupTarget(name)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(err.Error()))
-		return
+		return nil, err
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	w.Write(response)
+	repo, err := openBackupRepository(target)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Close()
+	ids, err := repo.snapshotIDs()
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]BackupSummary, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		snapshot, err := repo.loadSnapshot(ids[i])
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, BackupSummary{
+			ID:         snapshot.ID,
+			Time:       snapshot.Time,
+			Files:      len(snapshot.Files),
+			Size:       snapshot.Size,
+			AddedFiles: snapshot.AddedFiles,
+			AddedSize:  snapshot.AddedSize,
+		})
+	}
+	return summaries, nil
 }
 
-func respondError(w http.ResponseWriter, code int, message string) {
-	respondJSON(w, code, map[string]string{"error": message})
+// BackupVerifyResult reports the files of a snapshot whose object is missing
+// or does not match the SHA1 and size recorded in the manifest.
+type BackupVerifyResult struct {
+	ID       string   `json:"id"`
+	Files    int      `json:"files"`
+	Size     int64    `json:"size"`
+	Problems []string `json:"problems"`
 }
 
-func getUserPath(r *http.Request, subPath string) (basePath, fullPath, relPath string, err error) {
-	user := r.Context().Value(userContextKey).(string)
-	basePath = filepath.Join(AppConfig.MarkdownDir, user)
+// verifyBackup reads every object of a snapshot, the newest if id is empty,
+// on the named target and checks it against the manifest.
+func verifyBackup(name, id string) (*BackupVerifyResult, error) {
+	backupMutex.Lock()
+	defer backupMutex.Unlock()
 
-	cleanedSubPath := filepath.Clean(subPath)
-	if strings.HasPrefix(cleanedSubPath, "..") || strings.Contains(cleanedSubPath, string(filepath.Separator)+"..") {
-		return "", "", "", fmt.Errorf("invalid path: contains '..'")
+	target, err := findBackupTarget(name)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := openBackupRepository(target)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Close()
+	if err := repo.loadObjects(); err != nil {
+		return nil, err
+	}
+	if id == "" {
+		ids, err := repo.snapshotIDs()
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			return nil, fmt.Errorf("%w: target '%s' holds no snapshots", errBackupNotFound, target.Name)
+		}
+		id = ids[len(ids)-1]
+	}
+	snapshot, err := repo.loadSnapshot(id)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %q", errBackupNotFound, id)
+	} else if err != nil {
+		return nil, err
 	}
 
-	fullPath = filepath.Join(basePath, cleanedSubPath)
-	relPath = filepath.Join(user, cleanedSubPath)
-
-	if !strings.HasPrefix(fullPath, basePath) {
-		return "", "", "", fmt.Errorf("invalid path: outside of user directory")
+	result := &BackupVerifyResult{ID: snapshot.ID, Files: len(snapshot.Files), Problems: []string{}}
+	for _, file := range snapshot.Files {
+		result.Size += file.Size
+		if err := repo.verifyFile(file); errors.Is(err, errNoBackupIdentity) {
+			return nil, err
+		} else if err != nil {
+			result.Problems = append(result.Problems, fmt.Sprintf("%s: %v", file.Path, err))
+		}
 	}
-	return
+	return result, nil
 }
 
-func getSafeAttachmentPath(r *http.Request, mdPath, attachPath string) (string, error) {
-	userBasePath, _, _, err := getUserPath(r, "")
+func (repo *backupRepository) verifyFile(file BackupFile) error {
+	r, err := repo.openObject(file)
 	if err != nil {
-		return "", err
+		return err
 	}
-
-	_, mdFileAbsPath, _, err := getUserPath(r, mdPath)
+	defer r.Close()
+	hasher := sha1.New()
+	size, err := io.Copy(hasher, r)
 	if err != nil {
-		return "", err
+		return err
 	}
-	mdDirAbsPath := filepath.Dir(mdFileAbsPath)
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != file.SHA1 {
+		return fmt.Errorf("content has SHA1 %s, expected %s", sum, file.SHA1)
+	}
+	if size != file.Size {
+		return fmt.Errorf("content has %d bytes, expected %d", size, file.Size)
+	}
+	return nil
+}
 
-	resolvedPath := filepath.Join(mdDirAbsPath, attachPath)
-	cleanedPath := filepath.Clean(resolvedPath)
+// BackupRestoreOptions selects what restoreBackup restores. Path is relative
+// to the root of User, or to the markdown directory if User is empty. With To
+// set, the files are extracted below that directory, keeping their paths
+// relative to the markdown directory, instead of replacing the live files.
+// From names the backup target to restore from, the first one if empty.
+type BackupRestoreOptions struct {
+	ID   string `json:"id"`
+	User string `json:"user,omitempty"`
+	Path string `json:"path,omitempty"`
+	To   string `json:"to,omitempty"`
+	From string `json:"from,omitempty"`
+}
 
-	if !strings.HasPrefix(cleanedPath, userBasePath) {
-		return "", fmt.Errorf("invalid attachment path: access denied, path escapes user root")
+// BackupRestoreResult describes a restore. Replaced is the directory that
+// holds the files the restore replaced, if there were any.
+type BackupRestoreResult struct {
+	ID       string `json:"id"`
+	Target   string `json:"target"`
+	Files    int    `json:"files"`
+	Size     int64  `json:"size"`
+	Replaced string `json:"replaced,omitempty"`
+}
+
+var (
+	errBackupNotFound = errors.New("backup not found")
+	errServerRunning  = errors.New("a server is running on the markdown directory")
+)
+
+// serverLock is held by a running server for as long as it runs.
+var serverLock *bbolt.DB
+
+// lockServer locks the file that tells command line runs that a server uses
+// the markdown directory. The file lies next to the markdown directory,
+// which a full restore replaces, and is locked the way bbolt locks its
+// databases. It fails with errServerRunning if a server holds the lock.
+func lockServer() (*bbolt.DB, error) {
+	markdownDir := filepath.Clean(AppConfig.MarkdownDir)
+	lockPath := filepath.Join(filepath.Dir(markdownDir), "."+filepath.Base(markdownDir)+".lock")
+	db, err := bbolt.Open(lockPath, 0600, &bbolt.Options{Timeout: time.Second})
+	if errors.Is(err, bbolt.ErrTimeout) {
+		return nil, errServerRunning
 	}
+	return db, err
+}
 
-	return cleanedPath, nil
+// lockForCommand takes the server's lock for a command that writes to the
+// markdown directory, as the cache, indexes and repositories of a running
+// server would not learn about its changes. If that fails, it prints the
+// error, followed by hint if a server is running, and returns nil.
+func lockForCommand(hint string) *bbolt.DB {
+	lock, err := lockServer()
+	if errors.Is(err, errServerRunning) {
+		fmt.Fprintf(os.Stderr, "%v; %s\n", err, hint)
+		return nil
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil
+	}
+	return lock
 }
 
-func handleDirOp(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Action  string `json:"action"`
-		Path    string `json:"path"`
-		NewPath string `json:"new_path,omitempty"`
+// restoreBackup restores the files of a snapshot selected by opts. All
+// objects are checked before anything is written, the files are extracted
+// to a staging directory next to the markdown directory and verified against
+// their SHA1s, and only then swapped into place. The files they replace are
+// kept in a .replaced-<time>-* directory next to the markdown directory. The
+// cache is rescanned afterwards.
+func restoreBackup(opts BackupRestoreOptions) (*BackupRestoreResult, error) {
+	backupMutex.Lock()
+	defer backupMutex.Unlock()
+
+	if opts.ID == "" || filepath.Base(opts.ID) != opts.ID || strings.HasPrefix(opts.ID, ".") {
+		return nil, fmt.Errorf("%w: %q", errBackupNotFound, opts.ID)
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "Invalid request body")
-		return
+	if strings.ContainsAny(opts.User, `/\`) || opts.User == "." || opts.User == ".." {
+		return nil, fmt.Errorf("%w: invalid user", errInvalidPath)
+	}
+	// Rooting the path before cleaning it keeps it inside the markdown
+	// directory.
+	scope := path.Clean("/" + path.Join(opts.User, filepath.ToSlash(opts.Path)))[1:]
+	if opts.User != "" && !isWithin(scope, opts.User) {
+		return nil, fmt.Errorf("%w: outside of user directory", errInvalidPath)
 	}
 
-	_, fullPath, _, err := getUserPath(r, req.Path)
+	target, err := findBackupTarget(opts.From)
 	if err != nil {
-		respondError(w, http.StatusBadRequest, err.Error())
-		return
+		return nil, err
+	}
+	repo, err := openBackupRepository(target)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Close()
+	if err := repo.loadObjects(); err != nil {
+		return nil, err
+	}
+	snapshot, err := repo.loadSnapshot(opts.ID)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %q", errBackupNotFound, opts.ID)
+	} else if err != nil {
+		return nil, err
 	}
 
-	switch req.Action {
-	case "create":
-		if err := os.MkdirAll(fullPath, 0755); err != nil {
-			respondError(w, http.StatusInternalServerError, "Failed to create directory: "+err.Error())
-			return
+	var files []BackupFile
+	for _, file := range snapshot.Files {
+		if scope == "" || file.Path == scope || strings.HasPrefix(file.Path, scope+"/") {
+			files = append(files, file)
 		}
-	case "delete":
-		if err := os.RemoveAll(fullPath); err != nil {
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%w: snapshot %s contains nothing under '%s'", errBackupNotFound, opts.ID, scope)
+	}
+	for _, file := range files {
+		if _, ok := repo.findObject(file); !ok {
+			return nil, fmt.Errorf("backup %s is incomplete: object %s of '%s' is missing", opts.ID, file.SHA1, file.Path)
+		}
+	}
+
+	result := &BackupRestoreResult{ID: opts.ID, Files: len(files)}
+	for _, file := range files {
+		result.Size += file.Size
+	}
+
+	if opts.To != "" {
+		result.Target = opts.To
+		for _, file := range files {
+			if err := repo.extractFile(file, filepath.Join(opts.To, filepath.FromSlash(file.Path))); err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	}
+
+	markdownDir := filepath.Clean(AppConfig.MarkdownDir)
+	staging, err := os.MkdirTemp(filepath.Dir(markdownDir), ".restore-*")
+	if err != nil {
+		return nil, fmt.Errorf("could not create staging directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	stageRoot := filepath.Join(staging, "data")
+	for _, file := range files {
+		rel := strings.TrimPrefix(strings.TrimPrefix(file.Path, scope), "/")
+		if err := repo.extractFile(file, filepath.Join(stageRoot, filepath.FromSlash(rel))); err != nil {
+			return nil, err
+		}
+	}
+
+	live := filepath.Join(markdownDir, filepath.FromSlash(scope))
+	result.Target = live
+
+	// The embeddings databases of the affected users are closed while their
+	// directories are replaced.
+	var users []string
+	if opts.User != "" {
+		users = []string{opts.User}
+	} else if scope != "" {
+		user, _, _ := strings.Cut(scope, "/")
+		users = []string{user}
+	}
+	old := filepath.Join(staging, "old")
+	err = semanticIndex.Release(users, func() error {
+		return changeJournal.Release(users, func() error {
+			// Writers of the server are paused while the files are swapped.
+			writeGate.Lock()
+			defer writeGate.Unlock()
+			if scope == "" {
+				// The markdown directory itself stays in place, so that the
+				// file watcher keeps watching it; its entries are swapped one
+				// by one.
+				return swapDirEntries(stageRoot, markdownDir, old)
+			}
+			return swapPath(stageRoot, live, old)
+		})
+	})
+	// The replaced files are kept even if the swap failed and could not be
+	// undone completely.
+	if info, statErr := os.Lstat(old); statErr == nil && !(info.IsDir() && isEmptyDir(old)) {
+		keepDir, keepErr := os.MkdirTemp(filepath.Dir(markdownDir), ".replaced-"+time.Now().Format(backupTimeFormat)+"-*")
+		replaced := filepath.Join(keepDir, filepath.Base(live))
+		if keepErr == nil {
+			keepErr = os.Rename(old, replaced)
+		}
+		if keepErr != nil {
+			return nil, errors.Join(err, fmt.Errorf("could not keep the replaced files: %w", keepErr))
+		}
+		log.Printf("Files replaced by the restore of backup %s were moved to %s", opts.ID, replaced)
+		result.Replaced = replaced
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	store.Scan()
+	changeJournal.CatchUp(users)
+	semanticIndex.EnqueueUsers(users)
+	return result, nil
+}
+
+// extractFile writes the content of file to dst and verifies its SHA1.
+func (repo *backupRepository) extractFile(file BackupFile, dst string) error {
+	src, err := repo.openObject(file)
+	if err != nil {
+		return fmt.Errorf("could not read '%s' from backup: %w", file.Path, err)
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	hasher := sha1.New()
+	_, err = io.Copy(io.MultiWriter(out, hasher), src)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not restore '%s': %w", file.Path, err)
+	}
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != file.SHA1 {
+		return fmt.Errorf("backup object of '%s' is corrupt: SHA1 %s, expected %s", file.Path, sum, file.SHA1)
+	}
+	return os.Chtimes(dst, file.ModTime, file.ModTime)
+}
+
+// swapPath replaces live with staged, moving the current content to old. If
+// the second rename fails, the current content is moved back.
+func swapPath(staged, live, old string) error {
+	if err := os.MkdirAll(filepath.Dir(live), 0755); err != nil {
+		return err
+	}
+	hadLive := true
+	if err := os.Rename(live, old); errors.Is(err, fs.ErrNotExist) {
+		hadLive = false
+	} else if err != nil {
+		return fmt.Errorf("could not move '%s' aside: %w", live, err)
+	}
+	if err := os.Rename(staged, live); err != nil {
+		if hadLive {
+			os.Rename(old, live)
+		}
+		return fmt.Errorf("could not move restored files into '%s': %w", live, err)
+	}
+	return nil
+}
+
+func isEmptyDir(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	return err == nil && len(entries) == 0
+}
+
+// swapDirEntries replaces the entries of dir with those of staged, moving
+// the current entries to old. On failure, the entries moved so far are moved
+// back.
+func swapDirEntries(staged, dir, old string) (err error) {
+	if err := os.MkdirAll(old, 0755); err != nil {
+		return err
+	}
+	var movedAside, placed []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, name := range placed {
+			os.Rename(filepath.Join(dir, name), filepath.Join(staged, name))
+		}
+		for _, name := range movedAside {
+			os.Rename(filepath.Join(old, name), filepath.Join(dir, name))
+		}
+	}()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.Rename(filepath.Join(dir, entry.Name()), filepath.Join(old, entry.Name())); err != nil {
+			return fmt.Errorf("could not move '%s' aside: %w", entry.Name(), err)
+		}
+		movedAside = append(movedAside, entry.Name())
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	stagedEntries, err := os.ReadDir(staged)
+	if err != nil {
+		return err
+	}
+	for _, entry := range stagedEntries {
+		if err := os.Rename(filepath.Join(staged, entry.Name()), filepath.Join(dir, entry.Name())); err != nil {
+			return fmt.Errorf("could not move restored '%s' into place: %w", entry.Name(), err)
+		}
+		placed = append(placed, entry.Name())
+	}
+	return nil
+}
+
+// --- backup_targets.go ---
+
+// BackupDestination stores the files of a backup repository. Names are
+// slash-separated paths relative to the root of the repository. Get and
+// Delete return an error wrapping fs.ErrNotExist for missing files, and List
+// returns the names of all files below a directory, recursively.
+type BackupDestination interface {
+	Put(name string, r io.Reader, size int64) error
+	Get(name string) (io.ReadCloser, error)
+	List(dir string) ([]string, error)
+	Delete(name string) error
+	Close() error
+}
+
+func openBackupDestination(target BackupTarget) (BackupDestination, error) {
+	switch target.Type {
+	case "", "local":
+		if target.Path == "" {
+			return nil, errors.New("local backup target needs a path")
+		}
+		return &localDestination{dir: target.Path}, nil
+	case "s3":
+		return openS3Destination(target)
+	case "webdav":
+		return openWebDAVDestination(target)
+	case "sftp":
+		return openSFTPDestination(target)
+	}
+	return nil, fmt.Errorf("unknown backup target type %q", target.Type)
+}
+
+// readBackupFile reads a small file of the repository, such as a manifest,
+// completely.
+func readBackupFile(dest BackupDestination, name string) ([]byte, error) {
+	r, err := dest.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// backupTempName returns the name a file is uploaded under before it is
+// renamed into place, so that an interrupted upload never leaves a truncated
+// file under its final name.
+func backupTempName(name string) string {
+	return path.Join(path.Dir(name), "."+path.Base(name)+".tmp")
+}
+
+func isBackupTempName(name string) bool {
+	base := path.Base(name)
+	return strings.HasPrefix(base, ".") && strings.HasSuffix(base, ".tmp")
+}
+
+// localDestination stores the repository in a local directory.
+type localDestination struct {
+	dir string
+}
+
+func (d *localDestination) Put(name string, r io.Reader, size int64) error {
+	target := filepath.Join(d.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	tmpPath, err := stageFile(target, r, 0644)
+	if err != nil {
+		return err
+	}
+	return replaceFile(tmpPath, target)
+}
+
+func (d *localDestination) Get(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(d.dir, filepath.FromSlash(name)))
+}
+
+func (d *localDestination) List(dir string) ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(filepath.Join(d.dir, filepath.FromSlash(dir)), func(p string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || isBackupTempName(entry.Name()) {
+			return err
+		}
+		rel, err := filepath.Rel(d.dir, p)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return names, err
+}
+
+func (d *localDestination) Delete(name string) error {
+	return os.Remove(filepath.Join(d.dir, filepath.FromSlash(name)))
+}
+
+func (d *localDestination) Close() error {
+	return nil
+}
+
+// s3Destination stores the repository below a key prefix in a bucket of an
+// S3-compatible object store. Large objects are uploaded in parts as they
+// are read.
+type s3Destination struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func openS3Destination(target BackupTarget) (BackupDestination, error) {
+	endpoint, err := url.Parse(target.URL)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", target.URL)
+	}
+	if target.Bucket == "" {
+		return nil, errors.New("S3 backup target needs a bucket")
+	}
+	client, err := minio.New(endpoint.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4(target.AccessKey, target.SecretKey, ""),
+		Secure: endpoint.Scheme == "https",
+		Region: target.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, target.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("could not access bucket '%s': %w", target.Bucket, err)
+	}
+	if !exists {
+		if err := client.MakeBucket(ctx, target.Bucket, minio.MakeBucketOptions{Region: target.Region}); err != nil {
+			return nil, fmt.Errorf("could not create bucket '%s': %w", target.Bucket, err)
+		}
+	}
+	return &s3Destination{client: client, bucket: target.Bucket, prefix: strings.Trim(target.Path, "/")}, nil
+}
+
+func (d *s3Destination) key(name string) string {
+	return path.Join(d.prefix, name)
+}
+
+// notFound maps the "no such key" error of the object store to
+// fs.ErrNotExist.
+func (d *s3Destination) notFound(name string, err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	return err
+}
+
+func (d *s3Destination) Put(name string, r io.Reader, size int64) error {
+	_, err := d.client.PutObject(context.Background(), d.bucket, d.key(name), r, size,
+		minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	return err
+}
+
+func (d *s3Destination) Get(name string) (io.ReadCloser, error) {
+	object, err := d.client.GetObject(context.Background(), d.bucket, d.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, d.notFound(name, err)
+	}
+	// GetObject is lazy; Stat reports a missing key.
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		return nil, d.notFound(name, err)
+	}
+	return object, nil
+}
+
+func (d *s3Destination) List(dir string) ([]string, error) {
+	var names []string
+	for info := range d.client.ListObjects(context.Background(), d.bucket, minio.ListObjectsOptions{
+		Prefix:    d.key(dir) + "/",
+		Recursive: true,
+	}) {
+		if info.Err != nil {
+			return nil, info.Err
+		}
+		name := info.Key
+		if d.prefix != "" {
+			name = strings.TrimPrefix(name, d.prefix+"/")
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (d *s3Destination) Delete(name string) error {
+	// Removing a missing key succeeds, so it is looked up first.
+	ctx := context.Background()
+	if _, err := d.client.StatObject(ctx, d.bucket, d.key(name), minio.StatObjectOptions{}); err != nil {
+		return d.notFound(name, err)
+	}
+	return d.client.RemoveObject(ctx, d.bucket, d.key(name), minio.RemoveObjectOptions{})
+}
+
+func (d *s3Destination) Close() error {
+	return nil
+}
+
+// webdavDestination stores the repository below an existing collection of a
+// WebDAV server. Files are uploaded under a temporary name and moved into
+// place.
+type webdavDestination struct {
+	client   *http.Client
+	base     url.URL
+	prefix   string
+	username string
+	password string
+
+	mu          sync.Mutex
+	collections map[string]bool
+}
+
+func openWebDAVDestination(target BackupTarget) (BackupDestination, error) {
+	base, err := url.Parse(target.URL)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("invalid WebDAV URL %q", target.URL)
+	}
+	base.Path = strings.TrimSuffix(path.Join("/", base.Path), "/") + "/"
+	base.RawPath = ""
+	d := &webdavDestination{
+		client:      &http.Client{},
+		base:        *base,
+		prefix:      strings.Trim(target.Path, "/"),
+		username:    target.Username,
+		password:    target.Password,
+		collections: make(map[string]bool),
+	}
+	// Creating the root collection checks the URL and the credentials.
+	if err := d.mkcol(d.prefix); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *webdavDestination) url(name string) string {
+	u := d.base
+	u.Path += strings.TrimPrefix(path.Join(d.prefix, name), "/")
+	if strings.HasSuffix(name, "/") {
+		u.Path += "/"
+	}
+	return u.String()
+}
+
+func (d *webdavDestination) do(method, name string, body io.Reader, size int64, header map[string]string) (*http.Response, error) {
+	if body == nil || size == 0 {
+		body = http.NoBody
+	}
+	req, err := http.NewRequest(method, d.url(name), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	if d.username != "" {
+		req.SetBasicAuth(d.username, d.password)
+	}
+	return d.client.Do(req)
+}
+
+// request performs a request without a response body and checks its
+// status. A 404 is reported as fs.ErrNotExist.
+func (d *webdavDestination) request(method, name string, body io.Reader, size int64, header map[string]string, ok ...int) error {
+	resp, err := d.do(method, name, body, size, header)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if slices.Contains(ok, resp.StatusCode) {
+		return nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	return fmt.Errorf("WebDAV %s %s: %s", method, name, resp.Status)
+}
+
+// mkcol creates the collection dir, relative to the base URL, and its
+// parents, remembering which collections exist.
+func (d *webdavDestination) mkcol(dir string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	collection := ""
+	for _, part := range append([]string{""}, strings.Split(dir, "/")...) {
+		if part != "" {
+			collection += part + "/"
+		}
+		if d.collections[collection] {
+			continue
+		}
+		u := d.base
+		u.Path += collection
+		req, err := http.NewRequest("MKCOL", u.String(), http.NoBody)
+		if err != nil {
+			return err
+		}
+		if d.username != "" {
+			req.SetBasicAuth(d.username, d.password)
+		}
+		resp, err := d.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		// 405 Method Not Allowed means that the collection exists.
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+			return fmt.Errorf("WebDAV MKCOL %s: %s", u.Path, resp.Status)
+		}
+		d.collections[collection] = true
+	}
+	return nil
+}
+
+func (d *webdavDestination) Put(name string, r io.Reader, size int64) error {
+	if err := d.mkcol(path.Join(d.prefix, path.Dir(name))); err != nil {
+		return err
+	}
+	tmp := backupTempName(name)
+	if err := d.request(http.MethodPut, tmp, r, size, nil, http.StatusOK, http.StatusCreated, http.StatusNoContent); err != nil {
+		return err
+	}
+	err := d.request("MOVE", tmp, nil, 0, map[string]string{"Destination": d.url(name), "Overwrite": "T"},
+		http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		d.request(http.MethodDelete, tmp, nil, 0, nil, http.StatusOK, http.StatusNoContent)
+	}
+	return err
+}
+
+func (d *webdavDestination) Get(name string) (io.ReadCloser, error) {
+	resp, err := d.do(http.MethodGet, name, nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+		}
+		return nil, fmt.Errorf("WebDAV GET %s: %s", name, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+const webdavPropfind = `<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><resourcetype/></prop></propfind>`
+
+type webdavMultistatus struct {
+	Responses []struct {
+		Href       string    `xml:"href"`
+		Collection *struct{} `xml:"propstat>prop>resourcetype>collection"`
+	} `xml:"response"`
+}
+
+func (d *webdavDestination) List(dir string) ([]string, error) {
+	resp, err := d.do("PROPFIND", dir+"/", strings.NewReader(webdavPropfind), int64(len(webdavPropfind)),
+		map[string]string{"Depth": "1", "Content-Type": "application/xml"})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("WebDAV PROPFIND %s: %s", dir, resp.Status)
+	}
+	var multistatus webdavMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&multistatus); err != nil {
+		return nil, fmt.Errorf("WebDAV PROPFIND %s: %w", dir, err)
+	}
+
+	var names []string
+	for _, response := range multistatus.Responses {
+		href, err := url.Parse(response.Href)
+		if err != nil {
+			return nil, err
+		}
+		name, ok := strings.CutPrefix(href.Path, d.base.Path)
+		if d.prefix != "" {
+			name, ok = strings.CutPrefix(name, d.prefix+"/")
+		}
+		name = strings.TrimSuffix(name, "/")
+		if !ok || name == dir {
+			continue
+		}
+		if response.Collection != nil {
+			children, err := d.List(name)
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, children...)
+		} else if !isBackupTempName(name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (d *webdavDestination) Delete(name string) error {
+	return d.request(http.MethodDelete, name, nil, 0, nil, http.StatusOK, http.StatusNoContent)
+}
+
+func (d *webdavDestination) Close() error {
+	d.client.CloseIdleConnections()
+	return nil
+}
+
+// sftpDestination stores the repository in a directory of an SSH server.
+// The server is authenticated by its configured host key.
+type sftpDestination struct {
+	conn   *ssh.Client
+	client *sftp.Client
+	dir    string
+}
+
+func openSFTPDestination(target BackupTarget) (BackupDestination, error) {
+	if target.HostKey == "" {
+		return nil, errors.New("SFTP backup target needs the host key of the server")
+	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(target.HostKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SFTP host key: %w", err)
+	}
+	var auth []ssh.AuthMethod
+	if target.PrivateKey != "" {
+		data, err := os.ReadFile(target.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not read SFTP private key: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SFTP private key '%s': %w", target.PrivateKey, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if target.Password != "" {
+		auth = append(auth, ssh.Password(target.Password))
+	}
+
+	addr := strings.TrimPrefix(target.URL, "sftp://")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            target.Username,
+		Auth:            auth,
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to SFTP server '%s': %w", addr, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	dir := target.Path
+	if dir == "" {
+		dir = "."
+	}
+	return &sftpDestination{conn: conn, client: client, dir: dir}, nil
+}
+
+func (d *sftpDestination) Put(name string, r io.Reader, size int64) error {
+	target := path.Join(d.dir, name)
+	if err := d.client.MkdirAll(path.Dir(target)); err != nil {
+		return err
+	}
+	tmp := path.Join(d.dir, backupTempName(name))
+	f, err := d.client.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = d.client.PosixRename(tmp, target)
+	}
+	if err != nil {
+		d.client.Remove(tmp)
+	}
+	return err
+}
+
+func (d *sftpDestination) Get(name string) (io.ReadCloser, error) {
+	f, err := d.client.Open(path.Join(d.dir, name))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return f, nil
+}
+
+func (d *sftpDestination) List(dir string) ([]string, error) {
+	root := path.Join(d.dir, dir)
+	var names []string
+	walker := d.client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if walker.Path() == root && errors.Is(err, fs.ErrNotExist) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if walker.Stat().IsDir() || isBackupTempName(walker.Path()) {
+			continue
+		}
+		name, err := filepath.Rel(d.dir, walker.Path())
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, filepath.ToSlash(name))
+	}
+	return names, nil
+}
+
+func (d *sftpDestination) Delete(name string) error {
+	if err := d.client.Remove(path.Join(d.dir, name)); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+func (d *sftpDestination) Close() error {
+	d.client.Close()
+	return d.conn.Close()
+}
+
+// --- store.go ---
+// ... (rest of the file is unchanged, so I will omit it for brevity and just show the main function)
+// ... all store.go, file_monitor.go, versioning.go, search.go, handlers.go, utils.go code remains the same ...
+
+// --- store.go ---
+
+type Document struct {
+	Path    string
+	SHA1    string
+	Content string
+	ModTime time.Time
+	Size    int64
+	Meta    map[string]interface{} `json:",omitempty"`
+	Tags    []string               `json:",omitempty"`
+	Links   []NoteLink             `json:"-"`
+}
+
+// newDocument builds the cache entry for a note, deriving everything that is
+// indexed from its content.
+func newDocument(relPath string, content []byte, modTime time.Time) Document {
+	meta := parseFrontMatter(string(content))
+	return Document{
+		Path:    relPath,
+		Content: string(content),
+		SHA1:    calculateSHA1(content),
+		ModTime: modTime,
+		Size:    int64(len(content)),
+		Meta:    meta,
+		Tags:    extractTags(string(content), meta),
+		Links:   parseLinks(relPath, string(content)),
+	}
+}
+
+// AttachmentText holds the text extracted from an attachment so that it can
+// be searched together with the note that owns it.
+type AttachmentText struct {
+	Path    string
+	Parent  string
+	Content string
+	ModTime time.Time
+	Size    int64
+}
+
+type InMemoryStore struct {
+	sync.RWMutex
+	docs        DocumentBackend
+	attachments AttachmentBackend
+	tags        map[string]map[string]map[string]bool // user -> tag -> relPath set
+	links       map[string]map[string]map[string]bool // user -> link key -> source relPath set
+	names       map[string]map[string]map[string]bool // user -> lower-case note name -> relPath set
+
+	// unextractable remembers the attachments whose text could not be
+	// extracted, so they are only tried again once their size or mtime
+	// changes.
+	unextractable map[string]AttachmentText
+
+	scanMu  sync.Mutex      // serializes scans
+	scanned bool            // whether the configured backends are set up
+	touched map[string]bool // paths changed while a scan runs
+}
+
+var store = InMemoryStore{
+	docs:          memoryBackend{},
+	attachments:   memoryAttachments{},
+	tags:          make(map[string]map[string]map[string]bool),
+	links:         make(map[string]map[string]map[string]bool),
+	names:         make(map[string]map[string]map[string]bool),
+	unextractable: make(map[string]AttachmentText),
+}
+
+func isSpecialPath(path string) bool {
+	return strings.Contains(path, ".extra") || strings.HasSuffix(path, ".attach") || inGitDir(path)
+}
+
+// attachmentParent returns the note that owns the attachment at relPath, i.e.
+// "u/a.md" for "u/a.md.attach/img/x.png". ok is false for paths that are not
+// inside a ".md.attach" directory.
+func attachmentParent(relPath string) (parent string, ok bool) {
+	parts := strings.Split(relPath, string(filepath.Separator))
+	for i, part := range parts[:len(parts)-1] {
+		if strings.HasSuffix(strings.ToLower(part), ".md.attach") {
+			parts[i] = part[:len(part)-len(".attach")]
+			return filepath.Join(parts[:i+1]...), true
+		}
+	}
+	return "", false
+}
+
+// Scan brings the cache in line with the disk. Users are scanned in
+// parallel and every note and attachment is updated on its own, so the cache
+// stays usable meanwhile. Paths that other writers change while the scan
+// runs are left alone, as the scan may have read them before the change.
+// The cached files of a user whose walk hit an error are only updated, never
+// removed, as the walk may have missed files that still exist.
+func (s *InMemoryStore) Scan() {
+	s.scanMu.Lock()
+	defer s.scanMu.Unlock()
+	log.Println("Scanning markdown directory for initial cache...")
+
+	s.Lock()
+	if !s.scanned {
+		// The first scan sets up the configured backends.
+		s.docs, s.attachments = newDocumentBackend(), newAttachmentBackend()
+		s.scanned = true
+	}
+	s.touched = make(map[string]bool)
+	s.Unlock()
+
+	users, err := os.ReadDir(AppConfig.MarkdownDir)
+	if err != nil {
+		log.Printf("Could not read markdown dir: %v. It may be created later.", err)
+	}
+
+	seen := make(map[string]bool)       // guarded by the store's lock
+	incomplete := make(map[string]bool) // users whose walk failed, likewise
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, runtime.NumCPU())
+	for _, userEntry := range users {
+		if !userEntry.IsDir() {
+			continue
+		}
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+			if !s.scanUser(user, seen) {
+				s.Lock()
+				incomplete[user] = true
+				s.Unlock()
+			}
+		}(userEntry.Name())
+	}
+	wg.Wait()
+
+	s.Lock()
+	isStale := func(relPath string) bool {
+		user, _ := splitUserPath(relPath)
+		return !seen[relPath] && !incomplete[user] && !s.wasTouched(relPath)
+	}
+	var stale []string
+	for relPath := range s.docs.Documents("", false) {
+		if isStale(relPath) {
+			stale = append(stale, relPath)
+		}
+	}
+	for _, relPath := range stale {
+		s.removeDoc(relPath)
+	}
+	stale = stale[:0]
+	for relPath := range s.attachments.Attachments("", false) {
+		if isStale(relPath) {
+			stale = append(stale, relPath)
+		}
+	}
+	for _, relPath := range stale {
+		s.attachments.Delete(relPath)
+	}
+	for relPath := range s.unextractable {
+		if isStale(relPath) {
+			delete(s.unextractable, relPath)
+		}
+	}
+	s.touched = nil
+	docs, attachments := s.docs.Len(), s.attachments.Len()
+	s.Unlock()
+	log.Printf("Initial cache populated with %d documents and %d attachments.", docs, attachments)
+}
+
+// touch records that relPath, a file or a folder, changed while a scan is
+// running. The caller must hold the write lock.
+func (s *InMemoryStore) touch(relPath string) {
+	if s.touched != nil {
+		s.touched[relPath] = true
+	}
+}
+
+// wasTouched reports whether relPath or a folder above it changed since the
+// running scan started. The caller must hold the lock.
+func (s *InMemoryStore) wasTouched(relPath string) bool {
+	for p := relPath; s.touched != nil; {
+		if s.touched[p] {
+			return true
+		}
+		parent := filepath.Dir(p)
+		if parent == p || parent == "." {
+			break
+		}
+		p = parent
+	}
+	return false
+}
+
+// scanUser updates the cached notes and attachments of user that differ
+// from the disk and adds their paths to seen. Entries that cannot be read
+// are logged and skipped; it returns false if there were any.
+func (s *InMemoryStore) scanUser(user string, seen map[string]bool) bool {
+	complete := true
+	userPath := filepath.Join(AppConfig.MarkdownDir, user)
+	filepath.WalkDir(userPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("Error scanning %s: %v", path, err)
+			complete = false
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() && isInternalDir(d.Name()) {
+			return filepath.SkipDir
+		}
+		if d.IsDir() && strings.HasSuffix(strings.ToLower(d.Name()), ".md.attach") {
+			if !s.scanAttachments(path, seen) {
+				complete = false
+			}
+			return filepath.SkipDir
+		}
+		if isSpecialPath(path) {
+			return nil
+		}
+		if d.IsDir() || !strings.HasSuffix(strings.ToLower(d.Name()), ".md") {
+			return nil
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("Error reading file for cache %s: %v", path, err)
+			complete = false
+			return nil
+		}
+
+		relPath, _ := filepath.Rel(AppConfig.MarkdownDir, path)
+
+		var modTime time.Time
+		if info, err := d.Info(); err == nil {
+			modTime = info.ModTime()
+		}
+		doc := newDocument(relPath, content, modTime)
+		s.Lock()
+		seen[relPath] = true
+		old, cached := s.docs.Stat(relPath)
+		if !s.wasTouched(relPath) && (!cached || old.SHA1 != doc.SHA1 || !old.ModTime.Equal(doc.ModTime)) {
+			s.putDoc(doc)
+		}
+		s.Unlock()
+
+		return nil
+	})
+	return complete
+}
+
+// scanAttachments updates the cached attachments below attachDir and adds
+// their paths to seen. Only attachments whose size or modification time
+// changed are extracted again. It returns false if an entry could not be
+// read.
+func (s *InMemoryStore) scanAttachments(attachDir string, seen map[string]bool) bool {
+	complete := true
+	filepath.WalkDir(attachDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("Error scanning %s: %v", path, err)
+			complete = false
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			log.Printf("Error scanning %s: %v", path, err)
+			complete = false
+			return nil
+		}
+		relPath, _ := filepath.Rel(AppConfig.MarkdownDir, path)
+
+		s.Lock()
+		seen[relPath] = true
+		unchanged := s.attachmentUnchanged(relPath, info)
+		s.Unlock()
+		if unchanged {
+			return nil
+		}
+
+		parent, _ := attachmentParent(relPath)
+		text, supported := extractAttachmentText(path)
+		attachment := AttachmentText{Path: relPath, Parent: parent, Content: text, ModTime: info.ModTime(), Size: info.Size()}
+		s.Lock()
+		if !s.wasTouched(relPath) {
+			s.storeAttachment(attachment, supported)
+		}
+		s.Unlock()
+		return nil
+	})
+	return complete
+}
+
+// collectAttachments extracts the text of the supported attachments below
+// attachDir.
+func collectAttachments(attachDir string) []AttachmentText {
+	var attachments []AttachmentText
+	filepath.WalkDir(attachDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		relPath, _ := filepath.Rel(AppConfig.MarkdownDir, path)
+		parent, _ := attachmentParent(relPath)
+		if text, ok := extractAttachmentText(path); ok {
+			attachment := AttachmentText{Path: relPath, Parent: parent, Content: text}
+			if info, err := d.Info(); err == nil {
+				attachment.ModTime = info.ModTime()
+				attachment.Size = info.Size()
+			}
+			attachments = append(attachments, attachment)
+		}
+		return nil
+	})
+	return attachments
+}
+
+func (s *InMemoryStore) UpdateDoc(relPath string, content []byte) {
+	s.Lock()
+	defer s.Unlock()
+
+	modTime := time.Now()
+	if info, err := os.Stat(filepath.Join(AppConfig.MarkdownDir, relPath)); err == nil {
+		modTime = info.ModTime()
+	}
+	s.touch(relPath)
+	old, existed := s.docs.Stat(relPath)
+	doc := newDocument(relPath, content, modTime)
+	s.putDoc(doc)
+	log.Printf("Cache updated for: %s", relPath)
+	semanticIndex.Enqueue(relPath)
+
+	if !existed {
+		fileEvents.Publish("created", relPath, "", doc.SHA1)
+	} else if old.SHA1 != doc.SHA1 {
+		fileEvents.Publish("updated", relPath, "", doc.SHA1)
+	}
+}
+
+func (s *InMemoryStore) DeleteDoc(relPath string) {
+	s.Lock()
+	defer s.Unlock()
+	s.touch(relPath)
+	_, existed := s.docs.Stat(relPath)
+	s.removeDoc(relPath)
+	log.Printf("Cache deleted for: %s", relPath)
+	semanticIndex.Enqueue(relPath)
+
+	if existed {
+		fileEvents.Publish("deleted", relPath, "", "")
+	}
+}
+
+// RenameDoc moves the cached note at oldRelPath to newRelPath, whose file
+// now holds content.
+func (s *InMemoryStore) RenameDoc(oldRelPath, newRelPath string, content []byte) {
+	s.Lock()
+	defer s.Unlock()
+
+	modTime := time.Now()
+	if info, err := os.Stat(filepath.Join(AppConfig.MarkdownDir, newRelPath)); err == nil {
+		modTime = info.ModTime()
+	}
+	s.touch(oldRelPath)
+	s.touch(newRelPath)
+	s.removeDoc(oldRelPath)
+	doc := newDocument(newRelPath, content, modTime)
+	s.putDoc(doc)
+	log.Printf("Cache renamed from %s to %s", oldRelPath, newRelPath)
+	semanticIndex.Enqueue(oldRelPath)
+	semanticIndex.Enqueue(newRelPath)
+
+	fileEvents.Publish("renamed", newRelPath, oldRelPath, doc.SHA1)
+}
+
+// putDoc stores doc and updates the derived indexes. The caller must hold
+// the write lock.
+func (s *InMemoryStore) putDoc(doc Document) {
+	s.removeDoc(doc.Path)
+	s.docs.Put(doc)
+
+	user, subPath := splitUserPath(doc.Path)
+	for _, tag := range doc.Tags {
+		addIndexEntry(s.tags, user, tag, doc.Path)
+	}
+	for _, link := range doc.Links {
+		addIndexEntry(s.links, user, link.Key, doc.Path)
+	}
+	addIndexEntry(s.names, user, noteName(subPath), doc.Path)
+}
+
+// removeDoc deletes relPath and its entries in the derived indexes. The
+// caller must hold the write lock.
+func (s *InMemoryStore) removeDoc(relPath string) {
+	old, ok := s.docs.Stat(relPath)
+	if !ok {
+		return
+	}
+	s.docs.Delete(relPath)
+
+	user, subPath := splitUserPath(relPath)
+	for _, tag := range old.Tags {
+		removeIndexEntry(s.tags, user, tag, relPath)
+	}
+	for _, link := range old.Links {
+		removeIndexEntry(s.links, user, link.Key, relPath)
+	}
+	removeIndexEntry(s.names, user, noteName(subPath), relPath)
+}
+
+func addIndexEntry(index map[string]map[string]map[string]bool, user, key, relPath string) {
+	if index[user] == nil {
+		index[user] = make(map[string]map[string]bool)
+	}
+	if index[user][key] == nil {
+		index[user][key] = make(map[string]bool)
+	}
+	index[user][key][relPath] = true
+}
+
+func removeIndexEntry(index map[string]map[string]map[string]bool, user, key, relPath string) {
+	delete(index[user][key], relPath)
+	if len(index[user][key]) == 0 {
+		delete(index[user], key)
+	}
+}
+
+// UpdateAttachment re-extracts the text of the attachment at relPath. Files
+// whose type is not supported are dropped from the index.
+func (s *InMemoryStore) UpdateAttachment(relPath string) {
+	parent, ok := attachmentParent(relPath)
+	if !ok {
+		return
+	}
+	fullPath := filepath.Join(AppConfig.MarkdownDir, relPath)
+	text, ok := extractAttachmentText(fullPath)
+	attachment := AttachmentText{Path: relPath, Parent: parent, Content: text}
+	if info, err := os.Stat(fullPath); err == nil {
+		attachment.ModTime = info.ModTime()
+		attachment.Size = info.Size()
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.touch(relPath)
+	s.storeAttachment(attachment, ok)
+	if ok {
+		log.Printf("Attachment index updated for: %s", relPath)
+	}
+}
+
+// storeAttachment indexes attachment, or drops it from the index if its
+// text could not be extracted. The caller must hold the write lock.
+func (s *InMemoryStore) storeAttachment(attachment AttachmentText, extracted bool) {
+	delete(s.unextractable, attachment.Path)
+	if extracted {
+		s.attachments.Put(attachment)
+		return
+	}
+	s.attachments.Delete(attachment.Path)
+	if isExtractableAttachment(attachment.Path) && !attachment.ModTime.IsZero() {
+		s.unextractable[attachment.Path] = AttachmentText{Path: attachment.Path, ModTime: attachment.ModTime, Size: attachment.Size}
+	}
+}
+
+// attachmentUnchanged reports whether the attachment at relPath was already
+// indexed, or failed to extract, with the mtime and size in info. The caller
+// must hold the lock.
+func (s *InMemoryStore) attachmentUnchanged(relPath string, info fs.FileInfo) bool {
+	cached, ok := s.attachments.Stat(relPath)
+	if !ok {
+		cached, ok = s.unextractable[relPath]
+	}
+	return ok && cached.ModTime.Equal(info.ModTime()) && cached.Size == info.Size()
+}
+
+// ReindexAttachments drops everything indexed below the attachment directory
+// attachRelPath and extracts it again from disk.
+func (s *InMemoryStore) ReindexAttachments(attachRelPath string) {
+	attachments := collectAttachments(filepath.Join(AppConfig.MarkdownDir, attachRelPath))
+
+	s.Lock()
+	defer s.Unlock()
+	s.touch(attachRelPath)
+	s.deleteAttachments(attachRelPath)
+	for _, attachment := range attachments {
+		s.attachments.Put(attachment)
+	}
+}
+
+// RemoveTree removes the notes and attachments at or below relPath from the
+// cache.
+func (s *InMemoryStore) RemoveTree(relPath string) {
+	s.RLock()
+	var removed []string
+	for docPath := range s.docs.Documents(relPath, false) {
+		removed = append(removed, docPath)
+	}
+	s.RUnlock()
+
+	for _, docPath := range removed {
+		s.DeleteDoc(docPath)
+	}
+	s.DeleteAttachments(relPath)
+}
+
+// RenameDir moves the cached notes and attachments below oldRelPath to
+// newRelPath after the folder has been renamed on disk.
+func (s *InMemoryStore) RenameDir(oldRelPath, newRelPath string) {
+	s.RLock()
+	var moved []string
+	for docPath := range s.docs.Documents(oldRelPath, false) {
+		moved = append(moved, docPath)
+	}
+	s.RUnlock()
+
+	for _, docPath := range moved {
+		newDocPath := newRelPath + strings.TrimPrefix(docPath, oldRelPath)
+		if content, err := os.ReadFile(filepath.Join(AppConfig.MarkdownDir, newDocPath)); err == nil {
+			s.RenameDoc(docPath, newDocPath, content)
+		} else {
+			s.DeleteDoc(docPath)
+		}
+	}
+	s.DeleteAttachments(oldRelPath)
+
+	filepath.WalkDir(filepath.Join(AppConfig.MarkdownDir, newRelPath), func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		relPath, _ := filepath.Rel(AppConfig.MarkdownDir, fullPath)
+		if d.IsDir() && strings.HasSuffix(strings.ToLower(d.Name()), ".md.attach") {
+			s.ReindexAttachments(relPath)
+			return filepath.SkipDir
+		}
+		if d.IsDir() || isSpecialPath(fullPath) || !strings.HasSuffix(strings.ToLower(d.Name()), ".md") {
+			return nil
+		}
+		if content, err := os.ReadFile(fullPath); err == nil {
+			s.UpdateDoc(relPath, content)
+		}
+		return nil
+	})
+}
+
+// DeleteAttachments removes relPath and every attachment below it from the
+// index, so it works for single files as well as whole ".attach" directories.
+func (s *InMemoryStore) DeleteAttachments(relPath string) {
+	s.Lock()
+	defer s.Unlock()
+	s.touch(relPath)
+	s.deleteAttachments(relPath)
+}
+
+// deleteAttachments removes the attachments at or below relPath. The caller
+// must hold the write lock.
+func (s *InMemoryStore) deleteAttachments(relPath string) {
+	for path := range s.unextractable {
+		if isWithin(path, relPath) {
+			delete(s.unextractable, path)
+		}
+	}
+	var paths []string
+	for path := range s.attachments.Attachments(relPath, false) {
+		paths = append(paths, path)
+	}
+	for _, path := range paths {
+		s.attachments.Delete(path)
+	}
+}
+
+// --- store_backend.go ---
+
+// DocumentBackend holds the cached notes of InMemoryStore. The store's lock
+// guards it; implementations only need to synchronize internal state that
+// changes on reads, such as a cache.
+type DocumentBackend interface {
+	// Get returns the document at relPath including its content.
+	Get(relPath string) (Document, bool)
+	// Stat returns the document at relPath. Its content may be empty.
+	Stat(relPath string) (Document, bool)
+	Put(doc Document)
+	Delete(relPath string)
+	// Documents iterates over the documents at or below the relative path
+	// scope, or over all documents when scope is empty. Content is only
+	// loaded with withContent.
+	Documents(scope string, withContent bool) iter.Seq2[string, Document]
+	Len() int
+}
+
+// newDocumentBackend creates the backend selected by the store configuration.
+func newDocumentBackend() DocumentBackend {
+	if AppConfig.Store.Backend == "disk" {
+		return newDiskBackend(int64(AppConfig.Store.CacheSizeMB) << 20)
+	}
+	return memoryBackend{}
+}
+
+// memoryBackend keeps every document with its content in a map.
+type memoryBackend map[string]Document
+
+func (b memoryBackend) Get(relPath string) (Document, bool) {
+	doc, ok := b[relPath]
+	return doc, ok
+}
+
+func (b memoryBackend) Stat(relPath string) (Document, bool) {
+	return b.Get(relPath)
+}
+
+func (b memoryBackend) Put(doc Document) {
+	b[doc.Path] = doc
+}
+
+func (b memoryBackend) Delete(relPath string) {
+	delete(b, relPath)
+}
+
+func (b memoryBackend) Documents(scope string, _ bool) iter.Seq2[string, Document] {
+	return func(yield func(string, Document) bool) {
+		for relPath, doc := range b {
+			if (scope == "" || isWithin(relPath, scope)) && !yield(relPath, doc) {
+				return
+			}
+		}
+	}
+}
+
+func (b memoryBackend) Len() int {
+	return len(b)
+}
+
+// diskBackend keeps only the metadata and derived fields of documents in
+// memory and reads their content from disk on demand, keeping recently used
+// content in an LRU cache of limited size.
+type diskBackend struct {
+	docs  map[string]Document
+	cache *contentCache
+}
+
+func newDiskBackend(cacheSize int64) *diskBackend {
+	return &diskBackend{docs: make(map[string]Document), cache: newContentCache(cacheSize)}
+}
+
+func (b *diskBackend) Get(relPath string) (Document, bool) {
+	doc, ok := b.docs[relPath]
+	if !ok {
+		return doc, false
+	}
+	if content, ok := b.cache.Get(relPath); ok {
+		doc.Content = content
+		return doc, true
+	}
+	content, err := os.ReadFile(filepath.Join(AppConfig.MarkdownDir, relPath))
+	if err != nil {
+		log.Printf("Error loading content of %s: %v", relPath, err)
+		return doc, true
+	}
+	doc.Content = string(content)
+	b.cache.Put(relPath, doc.Content)
+	return doc, true
+}
+
+func (b *diskBackend) Stat(relPath string) (Document, bool) {
+	doc, ok := b.docs[relPath]
+	return doc, ok
+}
+
+func (b *diskBackend) Put(doc Document) {
+	b.cache.Put(doc.Path, doc.Content)
+	doc.Content = ""
+	b.docs[doc.Path] = doc
+}
+
+func (b *diskBackend) Delete(relPath string) {
+	delete(b.docs, relPath)
+	b.cache.Remove(relPath)
+}
+
+func (b *diskBackend) Documents(scope string, withContent bool) iter.Seq2[string, Document] {
+	return func(yield func(string, Document) bool) {
+		for relPath, doc := range b.docs {
+			if scope != "" && !isWithin(relPath, scope) {
+				continue
+			}
+			if withContent {
+				doc, _ = b.Get(relPath)
+			}
+			if !yield(relPath, doc) {
+				return
+			}
+		}
+	}
+}
+
+func (b *diskBackend) Len() int {
+	return len(b.docs)
+}
+
+// contentCache is a least-recently-used cache of document contents whose
+// total size is limited to maxBytes.
+type contentCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	order    *list.List
+	items    map[string]*list.Element
+}
+
+type contentCacheEntry struct {
+	relPath string
+	content string
+}
+
+func newContentCache(maxBytes int64) *contentCache {
+	return &contentCache{maxBytes: maxBytes, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *contentCache) Get(relPath string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[relPath]; ok {
+		c.order.MoveToFront(elem)
+		return elem.Value.(*contentCacheEntry).content, true
+	}
+	return "", false
+}
+
+func (c *contentCache) Put(relPath, content string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(relPath)
+	if int64(len(content)) > c.maxBytes {
+		return
+	}
+	c.items[relPath] = c.order.PushFront(&contentCacheEntry{relPath: relPath, content: content})
+	c.size += int64(len(content))
+	for c.size > c.maxBytes {
+		c.remove(c.order.Back().Value.(*contentCacheEntry).relPath)
+	}
+}
+
+func (c *contentCache) Remove(relPath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(relPath)
+}
+
+func (c *contentCache) remove(relPath string) {
+	if elem, ok := c.items[relPath]; ok {
+		c.order.Remove(elem)
+		delete(c.items, relPath)
+		c.size -= int64(len(elem.Value.(*contentCacheEntry).content))
+	}
+}
+
+// AttachmentBackend holds the extracted text of the cached attachments. Like
+// DocumentBackend, it is guarded by the store's lock.
+type AttachmentBackend interface {
+	// Get returns the attachment at relPath including its text.
+	Get(relPath string) (AttachmentText, bool)
+	// Stat returns the attachment at relPath. Its text may be empty.
+	Stat(relPath string) (AttachmentText, bool)
+	Put(attachment AttachmentText)
+	Delete(relPath string)
+	// Attachments iterates over the attachments at or below the relative
+	// path scope, or over all attachments when scope is empty. Text is only
+	// loaded with withContent.
+	Attachments(scope string, withContent bool) iter.Seq2[string, AttachmentText]
+	Len() int
+}
+
+// newAttachmentBackend creates the attachment backend matching the document
+// backend selected by the store configuration.
+func newAttachmentBackend() AttachmentBackend {
+	if AppConfig.Store.Backend == "disk" {
+		return newDiskAttachments(int64(AppConfig.Store.CacheSizeMB) << 20)
+	}
+	return memoryAttachments{}
+}
+
+// memoryAttachments keeps every attachment with its text in a map.
+type memoryAttachments map[string]AttachmentText
+
+func (b memoryAttachments) Get(relPath string) (AttachmentText, bool) {
+	attachment, ok := b[relPath]
+	return attachment, ok
+}
+
+func (b memoryAttachments) Stat(relPath string) (AttachmentText, bool) {
+	return b.Get(relPath)
+}
+
+func (b memoryAttachments) Put(attachment AttachmentText) {
+	b[attachment.Path] = attachment
+}
+
+func (b memoryAttachments) Delete(relPath string) {
+	delete(b, relPath)
+}
+
+func (b memoryAttachments) Attachments(scope string, _ bool) iter.Seq2[string, AttachmentText] {
+	return func(yield func(string, AttachmentText) bool) {
+		for relPath, attachment := range b {
+			if (scope == "" || isWithin(relPath, scope)) && !yield(relPath, attachment) {
+				return
+			}
+		}
+	}
+}
+
+func (b memoryAttachments) Len() int {
+	return len(b)
+}
+
+// attachmentTextDir is the directory below a user's .extra directory where
+// diskAttachments keeps the extracted text of the user's attachments.
+const attachmentTextDir = "attachment_text"
+
+// diskAttachments keeps only the metadata of attachments in memory. Their
+// extracted text, which is expensive to extract again, is written to
+// .extra/attachment_text and read back on demand through an LRU cache.
+type diskAttachments struct {
+	items map[string]AttachmentText
+	cache *contentCache
+}
+
+func newDiskAttachments(cacheSize int64) *diskAttachments {
+	return &diskAttachments{items: make(map[string]AttachmentText), cache: newContentCache(cacheSize)}
+}
+
+// textPath returns the file that holds the text of the attachment at relPath.
+func (b *diskAttachments) textPath(relPath string) string {
+	user, subPath := splitUserPath(relPath)
+	name := calculateSHA1([]byte(filepath.ToSlash(subPath))) + ".txt"
+	return filepath.Join(AppConfig.MarkdownDir, user, ".extra", attachmentTextDir, name)
+}
+
+func (b *diskAttachments) Get(relPath string) (AttachmentText, bool) {
+	attachment, ok := b.items[relPath]
+	if !ok {
+		return attachment, false
+	}
+	if text, ok := b.cache.Get(relPath); ok {
+		attachment.Content = text
+		return attachment, true
+	}
+	textPath := b.textPath(relPath)
+	text, err := os.ReadFile(textPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Backups leave out the text files, so extract the text again
+		// after a restore.
+		if extracted, ok := extractAttachmentText(filepath.Join(AppConfig.MarkdownDir, relPath)); ok {
+			text, err = []byte(extracted), os.WriteFile(textPath, []byte(extracted), 0644)
+		}
+	}
+	if err != nil {
+		log.Printf("Error loading the text of %s: %v", relPath, err)
+	}
+	if len(text) == 0 {
+		return attachment, true
+	}
+	attachment.Content = string(text)
+	b.cache.Put(relPath, attachment.Content)
+	return attachment, true
+}
+
+func (b *diskAttachments) Stat(relPath string) (AttachmentText, bool) {
+	attachment, ok := b.items[relPath]
+	return attachment, ok
+}
+
+func (b *diskAttachments) Put(attachment AttachmentText) {
+	textPath := b.textPath(attachment.Path)
+	err := os.MkdirAll(filepath.Dir(textPath), 0755)
+	if err == nil {
+		err = os.WriteFile(textPath, []byte(attachment.Content), 0644)
+	}
+	if err != nil {
+		log.Printf("Error storing the text of %s: %v", attachment.Path, err)
+		return
+	}
+	b.cache.Put(attachment.Path, attachment.Content)
+	attachment.Content = ""
+	b.items[attachment.Path] = attachment
+}
+
+func (b *diskAttachments) Delete(relPath string) {
+	if _, ok := b.items[relPath]; !ok {
+		return
+	}
+	delete(b.items, relPath)
+	b.cache.Remove(relPath)
+	os.Remove(b.textPath(relPath))
+}
+
+func (b *diskAttachments) Attachments(scope string, withContent bool) iter.Seq2[string, AttachmentText] {
+	return func(yield func(string, AttachmentText) bool) {
+		for relPath, attachment := range b.items {
+			if scope != "" && !isWithin(relPath, scope) {
+				continue
+			}
+			if withContent {
+				attachment, _ = b.Get(relPath)
+			}
+			if !yield(relPath, attachment) {
+				return
+			}
+		}
+	}
+}
+
+func (b *diskAttachments) Len() int {
+	return len(b.items)
+}
+
+// --- file_monitor.go ---
+
+const (
+	watchDebounce    = 300 * time.Millisecond
+	watchMaxDebounce = 2 * time.Second
+)
+
+// WatchMarkdownDir keeps the cache in line with changes made outside the
+// API. Events are debounced and each changed path is then synchronized with
+// its current state on disk, so bursts and renames collapse into a few
+// updates. New directories are watched as they appear, and a periodic
+// reconciliation scan repairs anything the events missed.
+func WatchMarkdownDir() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Fatalf("Failed to create file watcher: %v", err)
+	}
+
+	var reconcile <-chan time.Time
+	if AppConfig.Store.ReconcileMinutes > 0 {
+		reconcile = time.NewTicker(time.Duration(AppConfig.Store.ReconcileMinutes) * time.Minute).C
+	}
+
+	go func() {
+		defer watcher.Close()
+		pending := make(map[string]bool)
+		var firstPending time.Time
+		debounce := time.NewTimer(watchDebounce)
+		debounce.Stop()
+
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				relPath, err := filepath.Rel(AppConfig.MarkdownDir, event.Name)
+				if err != nil || strings.Contains(relPath, ".extra") || inGitDir(relPath) || event.Op == fsnotify.Chmod {
+					continue
+				}
+				if len(pending) == 0 {
+					firstPending = time.Now()
+				}
+				pending[relPath] = true
+				if time.Since(firstPending) < watchMaxDebounce {
+					debounce.Reset(watchDebounce)
+				}
+
+			case <-debounce.C:
+				// Paths that vanished go first: a moved directory keeps its
+				// inotify watch, which must not be removed after the new
+				// path has been added.
+				var existing []string
+				for relPath := range pending {
+					if _, err := os.Stat(filepath.Join(AppConfig.MarkdownDir, relPath)); err == nil {
+						existing = append(existing, relPath)
+					} else {
+						syncPath(watcher, relPath)
+					}
+				}
+				for _, relPath := range existing {
+					syncPath(watcher, relPath)
+				}
+				pending = make(map[string]bool)
+
+			case <-reconcile:
+				reconcileTree(watcher, "")
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Watcher error: %v", err)
+			}
+		}
+	}()
+
+	filepath.WalkDir(AppConfig.MarkdownDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && isInternalDir(d.Name()) {
+			return filepath.SkipDir
+		}
+		if d.IsDir() {
+			watcher.Add(path)
+		}
+		return nil
+	})
+	log.Println("File watcher started.")
+}
+
+// syncPath updates the cache for relPath from the disk after it changed.
+func syncPath(watcher *fsnotify.Watcher, relPath string) {
+	fullPath := filepath.Join(AppConfig.MarkdownDir, relPath)
+	info, err := os.Stat(fullPath)
+	switch {
+	case err != nil:
+		for _, watched := range watcher.WatchList() {
+			if isWithin(watched, fullPath) {
+				watcher.Remove(watched)
+			}
+		}
+		store.RemoveTree(relPath)
+	case info.IsDir():
+		reconcileTree(watcher, relPath)
+	default:
+		syncFile(relPath, info)
+	}
+}
+
+// syncFile updates the cached note or attachment at relPath if it differs
+// from info.
+func syncFile(relPath string, info fs.FileInfo) {
+	if _, ok := attachmentParent(relPath); ok {
+		store.RLock()
+		_, cached := store.attachments.Stat(relPath)
+		unchanged := store.attachmentUnchanged(relPath, info)
+		store.RUnlock()
+		if unchanged {
+			return
+		}
+		if cached || isExtractableAttachment(relPath) {
+			store.UpdateAttachment(relPath)
+		}
+		return
+	}
+	if isSpecialPath(relPath) || !strings.HasSuffix(strings.ToLower(relPath), ".md") || !strings.Contains(relPath, string(filepath.Separator)) {
+		return
+	}
+
+	store.RLock()
+	doc, cached := store.docs.Stat(relPath)
+	store.RUnlock()
+	if cached && doc.ModTime.Equal(info.ModTime()) && doc.Size == info.Size() {
+		return
+	}
+	content, err := os.ReadFile(filepath.Join(AppConfig.MarkdownDir, relPath))
+	if err != nil {
+		return
+	}
+	if cached && doc.SHA1 == calculateSHA1(content) {
+		return
+	}
+	log.Printf("Watcher detected change in %s, updating cache.", relPath)
+	store.UpdateDoc(relPath, content)
+}
+
+// reconcileTree brings the cache for everything at or below relPath (the
+// whole markdown directory if empty) in line with the disk, and makes sure
+// every directory in it is watched.
+func reconcileTree(watcher *fsnotify.Watcher, relPath string) {
+	onDisk := make(map[string]bool)
+	filepath.WalkDir(filepath.Join(AppConfig.MarkdownDir, relPath), func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if isInternalDir(d.Name()) {
+				return filepath.SkipDir
+			}
+			watcher.Add(fullPath)
+			return nil
+		}
+		rel, _ := filepath.Rel(AppConfig.MarkdownDir, fullPath)
+		if info, err := d.Info(); err == nil {
+			onDisk[rel] = true
+			syncFile(rel, info)
+		}
+		return nil
+	})
+
+	var stale []string
+	store.RLock()
+	for docPath := range store.docs.Documents(relPath, false) {
+		if !onDisk[docPath] {
+			stale = append(stale, docPath)
+		}
+	}
+	for attachmentPath := range store.attachments.Attachments(relPath, false) {
+		if !onDisk[attachmentPath] {
+			stale = append(stale, attachmentPath)
+		}
+	}
+	store.RUnlock()
+
+	for _, stalePath := range stale {
+		log.Printf("Reconciliation removed %s from cache.", stalePath)
+		store.RemoveTree(stalePath)
+	}
+}
+
+// --- events.go ---
+
+// FileEvent describes a change to a note of a user. Path and OldPath are
+// relative to the user root.
+type FileEvent struct {
+	ID      uint64 `json:"id"`
+	Type    string `json:"type"` // "created", "updated", "deleted" or "renamed"
+	Path    string `json:"path"`
+	OldPath string `json:"old_path,omitempty"`
+	SHA1    string `json:"sha1,omitempty"`
+	// Seq is the sequence number of the change in the change journal.
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+const eventBufferSize = 64
+
+// EventHub journals file events and fans them out to the subscribers of
+// each user. Events are queued and delivered in order by one goroutine, so
+// that the store, which publishes them under its lock, does not wait for
+// the journal's disk writes. Slow subscribers miss events rather than
+// blocking the delivery.
+type EventHub struct {
+	mu          sync.Mutex
+	delivered   *sync.Cond
+	nextID      uint64
+	subscribers map[string]map[chan FileEvent]bool
+	queue       []queuedEvent
+	delivering  bool
+	queued      uint64 // number of events published
+	done        uint64 // number of events delivered
+}
+
+type queuedEvent struct {
+	user  string
+	event FileEvent
+}
+
+var fileEvents = newEventHub()
+
+func newEventHub() *EventHub {
+	h := &EventHub{subscribers: make(map[string]map[chan FileEvent]bool)}
+	h.delivered = sync.NewCond(&h.mu)
+	return h
+}
+
+func (h *EventHub) Subscribe(user string) chan FileEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan FileEvent, eventBufferSize)
+	if h.subscribers[user] == nil {
+		h.subscribers[user] = make(map[chan FileEvent]bool)
+	}
+	h.subscribers[user][ch] = true
+	return ch
+}
+
+func (h *EventHub) Unsubscribe(user string, ch chan FileEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers[user], ch)
+	if len(h.subscribers[user]) == 0 {
+		delete(h.subscribers, user)
+	}
+}
+
+// Publish queues an event for the note at relPath (and oldRelPath for
+// renames), to be journaled and sent to the subscribers of its user.
+func (h *EventHub) Publish(eventType, relPath, oldRelPath, sha1 string) {
+	user, subPath := splitUserPath(relPath)
+	event := FileEvent{Type: eventType, Path: filepath.ToSlash(subPath), SHA1: sha1}
+	if oldRelPath != "" {
+		_, oldSubPath := splitUserPath(oldRelPath)
+		event.OldPath = filepath.ToSlash(oldSubPath)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.queue = append(h.queue, queuedEvent{user: user, event: event})
+	h.queued++
+	if !h.delivering {
+		h.delivering = true
+		go h.deliver()
+	}
+}
+
+// deliver journals and sends the queued events until the queue is empty.
+func (h *EventHub) deliver() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for len(h.queue) > 0 {
+		next := h.queue[0]
+		h.queue = h.queue[1:]
+		h.mu.Unlock()
+		event := next.event
+		event.Seq = changeJournal.Append(next.user, event)
+		h.mu.Lock()
+
+		h.nextID++
+		event.ID = h.nextID
+		for ch := range h.subscribers[next.user] {
+			select {
+			case ch <- event:
+			default:
+			}
+		}
+		h.done++
+		h.delivered.Broadcast()
+	}
+	h.queue = nil
+	h.delivering = false
+}
+
+// Wait returns once the events published before the call are delivered.
+func (h *EventHub) Wait() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for target := h.queued; h.done < target; {
+		h.delivered.Wait()
+	}
+}
+
+// --- journal.go ---
+
+// journalMaxEntries is the number of changes kept per user. Clients that
+// fall further behind start over from a full listing.
+const journalMaxEntries = 10000
+
+// JournalEntry is a change to a note in the change journal of a user. Seq
+// numbers increase by one with every change. Content is only filled in
+// responses that ask for it.
+type JournalEntry struct {
+	Seq     uint64    `json:"seq"`
+	Type    string    `json:"type"` // "created", "updated", "deleted" or "renamed"
+	Path    string    `json:"path"`
+	OldPath string    `json:"old_path,omitempty"`
+	SHA1    string    `json:"sha1,omitempty"`
+	Time    time.Time `json:"time"`
+	Content *string   `json:"content,omitempty"`
+}
+
+// ChangeJournal records every change to the notes of each user in
+// .extra/journal.db, so that offline clients can fetch what happened since
+// they last synced. Besides the changes, the database holds the SHA1 of
+// every note as of the last change, which lets the server journal the
+// changes made while it was not running. Each database has a random ID;
+// a client that synced against another database, e.g. one lost with its
+// .extra directory, starts over.
+type ChangeJournal struct {
+	mu  sync.Mutex
+	dbs map[string]*bbolt.DB
+}
+
+var (
+	journalChangesBucket = []byte("changes")
+	journalStateBucket   = []byte("state")
+	journalMetaBucket    = []byte("meta")
+	journalIDKey         = []byte("id")
+)
+
+// changeJournal is nil in command line runs, which must not hold the
+// databases of a running server.
+var changeJournal *ChangeJournal
+
+// StartChangeJournal opens the change journals and records the changes the
+// scan of the store found since the server last ran.
+func StartChangeJournal() {
+	changeJournal = &ChangeJournal{dbs: make(map[string]*bbolt.DB)}
+	changeJournal.CatchUp(nil)
+}
+
+// CatchUp journals the changes a scan of the store found for users (all
+// users if nil). Every store.Scan of the server is followed by it, as the
+// scan publishes no events.
+func (j *ChangeJournal) CatchUp(users []string) {
+	if j == nil {
+		return
+	}
+	if users == nil {
+		entries, err := os.ReadDir(AppConfig.MarkdownDir)
+		if err != nil {
+			return
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				users = append(users, entry.Name())
+			}
+		}
+	}
+	for _, user := range users {
+		if err := j.catchUp(user); err != nil {
+			log.Printf("Could not update the change journal of %s: %v", user, err)
+		}
+	}
+}
+
+// Release closes the journals of users (all users if nil) and runs fn, which
+// may replace their files, before the journals are opened again.
+func (j *ChangeJournal) Release(users []string, fn func() error) error {
+	if j == nil {
+		return fn()
+	}
+	released := make(map[string]bool)
+	for _, user := range users {
+		released[user] = true
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for user, db := range j.dbs {
+		if users == nil || released[user] {
+			db.Close()
+			delete(j.dbs, user)
+		}
+	}
+	return fn()
+}
+
+func (j *ChangeJournal) open(user string) (*bbolt.DB, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if db, ok := j.dbs[user]; ok {
+		return db, nil
+	}
+	dbPath := filepath.Join(AppConfig.MarkdownDir, user, ".extra", "journal.db")
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+		return nil, err
+	}
+	db, err := bbolt.Open(dbPath, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{journalChangesBucket, journalStateBucket, journalMetaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		meta := tx.Bucket(journalMetaBucket)
+		if meta.Get(journalIDKey) == nil {
+			id := make([]byte, 8)
+			rand.Read(id)
+			return meta.Put(journalIDKey, []byte(hex.EncodeToString(id)))
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	j.dbs[user] = db
+	return db, nil
+}
+
+// Append records a change of user and returns its sequence number, or 0 if
+// it could not be recorded.
+func (j *ChangeJournal) Append(user string, event FileEvent) uint64 {
+	if j == nil {
+		return 0
+	}
+	db, err := j.open(user)
+	if err != nil {
+		log.Printf("Could not open the change journal of %s: %v", user, err)
+		return 0
+	}
+	var seq uint64
+	err = db.Update(func(tx *bbolt.Tx) error {
+		var err error
+		seq, err = appendJournalEntry(tx, JournalEntry{Type: event.Type, Path: event.Path, OldPath: event.OldPath, SHA1: event.SHA1, Time: time.Now()})
+		return err
+	})
+	if err != nil {
+		log.Printf("Could not journal the change of %s: %v", event.Path, err)
+		return 0
+	}
+	return seq
+}
+
+// appendJournalEntry adds entry to the changes, updates the state and drops
+// the entries beyond journalMaxEntries.
+func appendJournalEntry(tx *bbolt.Tx, entry JournalEntry) (uint64, error) {
+	changes, state := tx.Bucket(journalChangesBucket), tx.Bucket(journalStateBucket)
+	seq, err := changes.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	entry.Seq = seq
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+	if err := changes.Put(itob(seq), data); err != nil {
+		return 0, err
+	}
+
+	switch entry.Type {
+	case "deleted":
+		err = state.Delete([]byte(entry.Path))
+	case "renamed":
+		if err = state.Delete([]byte(entry.OldPath)); err == nil {
+			err = state.Put([]byte(entry.Path), []byte(entry.SHA1))
+		}
+	default:
+		err = state.Put([]byte(entry.Path), []byte(entry.SHA1))
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	c := changes.Cursor()
+	for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k)+journalMaxEntries <= seq; k, _ = c.Next() {
+		if err := c.Delete(); err != nil {
+			return 0, err
+		}
+	}
+	return seq, nil
+}
+
+// catchUp journals the differences between the cached notes of user and
+// the state of the journal. Events published before are delivered first,
+// so that they are not journaled twice.
+func (j *ChangeJournal) catchUp(user string) error {
+	fileEvents.Wait()
+	current := make(map[string]string)
+	store.RLock()
+	for relPath, doc := range store.docs.Documents(user, false) {
+		_, subPath := splitUserPath(relPath)
+		current[filepath.ToSlash(subPath)] = doc.SHA1
+	}
+	store.RUnlock()
+
+	db, err := j.open(user)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bbolt.Tx) error {
+		state := tx.Bucket(journalStateBucket)
+		var entries []JournalEntry
+		state.ForEach(func(k, v []byte) error {
+			if _, ok := current[string(k)]; !ok {
+				entries = append(entries, JournalEntry{Type: "deleted", Path: string(k)})
+			}
+			return nil
+		})
+		paths := make([]string, 0, len(current))
+		for p := range current {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		for _, p := range paths {
+			if known := state.Get([]byte(p)); known == nil {
+				entries = append(entries, JournalEntry{Type: "created", Path: p, SHA1: current[p]})
+			} else if string(known) != current[p] {
+				entries = append(entries, JournalEntry{Type: "updated", Path: p, SHA1: current[p]})
+			}
+		}
+		for _, entry := range entries {
+			entry.Time = time.Now()
+			if _, err := appendJournalEntry(tx, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SyncFile is a note in the full listing of a sync reset.
+type SyncFile struct {
+	Path    string    `json:"path"`
+	SHA1    string    `json:"sha1"`
+	ModTime time.Time `json:"mod_time"`
+	Content *string   `json:"content,omitempty"`
+}
+
+// SyncChanges answers a request for the changes since a sequence number.
+// Seq is the sequence number to ask from next time. With Reset, the client
+// must replace its state with Files, the current notes; otherwise Changes
+// lists the changes in order, and More tells that there are more.
+type SyncChanges struct {
+	Journal string         `json:"journal"`
+	Seq     uint64         `json:"seq"`
+	Reset   bool           `json:"reset"`
+	More    bool           `json:"more"`
+	Changes []JournalEntry `json:"changes"`
+	Files   []SyncFile     `json:"files,omitempty"`
+}
+
+// Changes returns at most limit changes of user after since. A since of 0,
+// a missing journal ID or one other than the current one, or a since that
+// is no longer (or not yet) in the journal returns a reset, as the sequence
+// numbers of another journal mean nothing in this one. With withContent, the current
+// content of the notes is included where it matches the change.
+func (j *ChangeJournal) Changes(user, journalID string, since uint64, limit int, withContent bool) (*SyncChanges, error) {
+	db, err := j.open(user)
+	if err != nil {
+		return nil, err
+	}
+	result := &SyncChanges{Changes: []JournalEntry{}}
+	err = db.View(func(tx *bbolt.Tx) error {
+		result.Journal = string(tx.Bucket(journalMetaBucket).Get(journalIDKey))
+		changes := tx.Bucket(journalChangesBucket)
+		result.Seq = changes.Sequence()
+
+		first, _ := changes.Cursor().First()
+		if since == 0 || journalID != result.Journal || since > result.Seq ||
+			(since < result.Seq && (first == nil || binary.BigEndian.Uint64(first) > since+1)) {
+			result.Reset = true
+			return nil
+		}
+
+		c := changes.Cursor()
+		for k, v := c.Seek(itob(since + 1)); k != nil; k, v = c.Next() {
+			if len(result.Changes) == limit {
+				result.More = true
+				break
+			}
+			var entry JournalEntry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			result.Changes = append(result.Changes, entry)
+		}
+		if n := len(result.Changes); n > 0 {
+			result.Seq = result.Changes[n-1].Seq
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The listing is taken after reading Seq, so a change made meanwhile is
+	// both in the listing and in the next changes; clients recognize it by
+	// its SHA1.
+	if result.Reset {
+		result.Files = []SyncFile{}
+		store.RLock()
+		for relPath, doc := range store.docs.Documents(user, withContent) {
+			_, subPath := splitUserPath(relPath)
+			file := SyncFile{Path: filepath.ToSlash(subPath), SHA1: doc.SHA1, ModTime: doc.ModTime}
+			if withContent {
+				content := doc.Content
+				file.Content = &content
+			}
+			result.Files = append(result.Files, file)
+		}
+		store.RUnlock()
+		sort.Slice(result.Files, func(a, b int) bool { return result.Files[a].Path < result.Files[b].Path })
+	} else if withContent {
+		store.RLock()
+		for i, entry := range result.Changes {
+			if entry.Type == "deleted" {
+				continue
+			}
+			if doc, ok := store.docs.Get(filepath.Join(user, filepath.FromSlash(entry.Path))); ok && doc.SHA1 == entry.SHA1 {
+				content := doc.Content
+				result.Changes[i].Content = &content
+			}
+		}
+		store.RUnlock()
+	}
+	return result, nil
+}
+
+// SyncChange is a change a client made offline. BaseSHA1 is the SHA1 of the
+// note the change was made to, empty for a note the client created. Action
+// is "put" (write Content), "delete" or "rename" (to NewPath).
+type SyncChange struct {
+	Action   string `json:"action"`
+	Path     string `json:"path"`
+	NewPath  string `json:"new_path,omitempty"`
+	BaseSHA1 string `json:"base_sha1"`
+	Content  string `json:"content,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// SyncResult is the outcome of a SyncChange. Status is "applied",
+// "unchanged" (the server already had the result), "conflict" (the note
+// changed on the server; SHA1 and Content are the server's version, empty
+// if it was deleted) or "error". SHA1 is the note's SHA1 after the change.
+type SyncResult struct {
+	Path    string  `json:"path"`
+	Status  string  `json:"status"`
+	SHA1    string  `json:"sha1,omitempty"`
+	Content *string `json:"content,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// currentNote returns the SHA1 and content of the note at subPath of user,
+// or empty strings if there is none.
+func currentNote(user, subPath string) (sha1, content string, err error) {
+	_, fullPath, relPath, err := resolveUserPath(user, subPath)
+	if err != nil {
+		return "", "", err
+	}
+	store.RLock()
+	doc, ok := store.docs.Get(relPath)
+	store.RUnlock()
+	if ok {
+		return doc.SHA1, doc.Content, nil
+	}
+	data, err := os.ReadFile(fullPath)
+	if os.IsNotExist(err) {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+	return calculateSHA1(data), string(data), nil
+}
+
+// applySyncChange applies change for user unless the note has changed on
+// the server since the client's version. The checks here answer the common
+// cases; the writes repeat them under the note's lock, so that a concurrent
+// write is never overwritten.
+func applySyncChange(user string, change SyncChange) SyncResult {
+	result := SyncResult{Path: change.Path}
+	fail := func(err error) SyncResult {
+		result.Status, result.Error = "error", err.Error()
+		return result
+	}
+	if !isNotePath(change.Path) || (change.Action == "rename" && !isNotePath(change.NewPath)) {
+		return fail(fmt.Errorf("%w: not a .md file", errInvalidPath))
+	}
+	current, content, err := currentNote(user, change.Path)
+	if err != nil {
+		return fail(err)
+	}
+	conflict := func() SyncResult {
+		result.Status, result.SHA1 = "conflict", current
+		if current != "" {
+			result.Content = &content
+		}
+		return result
+	}
+	// failOrConflict reports a conflict found by the write with the note's
+	// version after it.
+	failOrConflict := func(err error) SyncResult {
+		if !errors.Is(err, errNoteChanged) {
+			return fail(err)
+		}
+		if current, content, err = currentNote(user, change.Path); err != nil {
+			return fail(err)
+		}
+		return conflict()
+	}
+
+	switch change.Action {
+	case "put":
+		if sha1 := calculateSHA1([]byte(change.Content)); sha1 == current {
+			result.Status, result.SHA1 = "unchanged", current
+			return result
+		}
+		if current != change.BaseSHA1 {
+			return conflict()
+		}
+		sha1, _, err := saveDocumentIf(user, change.Path, change.Content, change.Comment, &change.BaseSHA1)
+		if err != nil {
+			return failOrConflict(err)
+		}
+		result.Status, result.SHA1 = "applied", sha1
+	case "delete":
+		if current == "" {
+			result.Status = "unchanged"
+			return result
+		}
+		if current != change.BaseSHA1 {
+			return conflict()
+		}
+		if err := deleteDocumentIf(user, change.Path, true, &change.BaseSHA1); errors.Is(err, fs.ErrNotExist) {
+			result.Status = "unchanged"
+			return result
+		} else if err != nil {
+			return failOrConflict(err)
+		}
+		result.Status = "applied"
+	case "rename":
+		target, _, err := currentNote(user, change.NewPath)
+		if err != nil {
+			return fail(err)
+		}
+		if current == "" && target == change.BaseSHA1 {
+			result.Status, result.SHA1 = "unchanged", target
+			return result
+		}
+		if current != change.BaseSHA1 || current == "" {
+			return conflict()
+		}
+		if target != "" {
+			result.Status, result.Error = "conflict", "the new path already exists"
+			return result
+		}
+		if err := renameDocumentIf(user, change.Path, change.NewPath, &change.BaseSHA1); errors.Is(err, fs.ErrExist) {
+			result.Status, result.Error = "conflict", "the new path already exists"
+			return result
+		} else if err != nil {
+			return failOrConflict(err)
+		}
+		result.Status, result.SHA1 = "applied", current
+	default:
+		return fail(fmt.Errorf("unknown action %q", change.Action))
+	}
+	return result
+}
+
+// --- versioning.go ---
+
+const backupBucket = "versions"
+const maxPatchChain = 50
+
+type VersionRecord struct {
+	ID        uint64    `json:"id"`
+	OldSHA1   string    `json:"old_sha1"`
+	NewSHA1   string    `json:"new_sha1"`
+	Patch     string    `json:"patch"`
+	Type      string    `json:"type"`
+	Comment   string    `json:"comment"`
+	Timestamp time.Time `json:"timestamp"`
+	// Commit and Author are set for versions served from git.
+	Commit string `json:"commit,omitempty"`
+	Author string `json:"author,omitempty"`
+}
+
+type VersionManager struct {
+	db *bbolt.DB
+}
+
+func NewVersionManager(user string) (*VersionManager, error) {
+	dbPath := filepath.Join(AppConfig.MarkdownDir, user, ".extra", "versions.db")
+	os.MkdirAll(filepath.Dir(dbPath), 0755)
+
+	db, err := bbolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(backupBucket))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &VersionManager{db: db}, nil
+}
+
+func (vm *VersionManager) Close() {
+	vm.db.Close()
+}
+
+func (vm *VersionManager) CreateBackup(filePath, oldSHA1, newSHA1, oldContent, newContent, comment string) error {
+	return vm.CreateBackupWith(filePath, oldSHA1, newSHA1, oldContent, newContent, comment, nil)
+}
+
+// CreateBackupWith records a version like CreateBackup and calls apply
+// before committing it, so that the record is discarded if apply fails.
+func (vm *VersionManager) CreateBackupWith(filePath, oldSHA1, newSHA1, oldContent, newContent, comment string, apply func() error) error {
+	return vm.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(backupBucket))
+		fileBucket, err := b.CreateBucketIfNotExists([]byte(filePath))
+		if err != nil {
+			return err
+		}
+
+		stats := fileBucket.Stats()
+		backupType := "patch"
+		if stats.KeyN%maxPatchChain == 0 {
+			backupType = "full"
+		}
+
+		patchContent := newContent
+		if backupType == "patch" {
+			dmp := diffmatchpatch.New()
+			patches := dmp.PatchMake(oldContent, newContent)
+			patchContent = dmp.PatchToText(patches)
+		}
+
+		id, _ := fileBucket.NextSequence()
+		record := VersionRecord{
+			ID:        id,
+			OldSHA1:   oldSHA1,
+			NewSHA1:   newSHA1,
+			Patch:     patchContent,
+			Type:      backupType,
+			Comment:   comment,
+			Timestamp: time.Now(),
+		}
+
+		buf, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if err := fileBucket.Put(itob(id), buf); err != nil {
+			return err
+		}
+		if apply != nil {
+			return apply()
+		}
+		return nil
+	})
+}
+
+// Files returns the paths of the notes that have a history.
+func (vm *VersionManager) Files() ([]string, error) {
+	var files []string
+	err := vm.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(backupBucket)).ForEach(func(k, v []byte) error {
+			if v == nil {
+				files = append(files, string(k))
+			}
+			return nil
+		})
+	})
+	return files, err
+}
+
+func (vm *VersionManager) GetHistory(filePath string) ([]VersionRecord, error) {
+	var history []VersionRecord
+	err := vm.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(backupBucket))
+		fileBucket := b.Bucket([]byte(filePath))
+		if fileBucket == nil {
+			return nil
+		}
+
+		c := fileBucket.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var record VersionRecord
+			if err := json.Unmarshal(v, &record); err == nil {
+				history = append(history, record)
+			}
+		}
+		return nil
+	})
+	return history, err
+}
+
+func (vm *VersionManager) GetVersionContent(filePath string, targetVersionID uint64) (string, error) {
+	var recordsToApply []VersionRecord
+	var baseContent string
+
+	err := vm.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(backupBucket))
+		fileBucket := b.Bucket([]byte(filePath))
+		if fileBucket == nil {
+			return fmt.Errorf("no history for file: %s", filePath)
+		}
+
+		c := fileBucket.Cursor()
+		for k, v := c.Seek(itob(targetVersionID)); k != nil; k, v = c.Prev() {
+			var record VersionRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				continue
+			}
+			recordsToApply = append(recordsToApply, record)
+			if record.Type == "full" {
+				baseContent = record.Patch
+				break
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+	if baseContent == "" {
+		return "", fmt.Errorf("could not find a full backup base for version %d", targetVersionID)
+	}
+
+	dmp := diffmatchpatch.New()
+	currentContent := baseContent
+	for i := len(recordsToApply) - 2; i >= 0; i-- {
+		record := recordsToApply[i]
+		if record.Type == "patch" {
+			patches, err := dmp.PatchFromText(record.Patch)
+			if err != nil {
+				return "", fmt.Errorf("error parsing patch for version %d: %v", record.ID, err)
+			}
+			newContent, _ := dmp.PatchApply(patches, currentContent)
+			currentContent = newContent
+		}
+	}
+
+	return currentContent, nil
+}
+
+// --- git.go ---
+
+// gitDirName is the repository directory of users with git-backed storage.
+// Like .extra, it is hidden from listings, the cache and the file watcher.
+const gitDirName = ".git"
+
+// gitTimeout bounds every git command, including fetches and pushes to a
+// remote that does not answer.
+const gitTimeout = 5 * time.Minute
+
+// isInternalDir reports whether name is a directory of a user root that holds
+// server data rather than notes.
+func isInternalDir(name string) bool {
+	return name == ".extra" || name == gitDirName
+}
+
+// inInternalDir reports whether subPath, relative to a user root, lies in
+// one of its internal directories. Names are compared case-insensitively,
+// as they name the same directory on case-insensitive file systems.
+func inInternalDir(subPath string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(subPath), "/") {
+		if isInternalDir(strings.ToLower(part)) {
+			return true
+		}
+	}
+	return false
+}
+
+// inGitDir reports whether path lies in the repository directory of a user
+// with git-backed storage.
+func inGitDir(path string) bool {
+	return slices.Contains(strings.Split(filepath.ToSlash(path), "/"), gitDirName)
+}
+
+// versionHistory serves the past versions of a user's notes, from
+// versions.db or, with git-backed storage, from the user's repository.
+type versionHistory interface {
+	Files() ([]string, error)
+	GetHistory(filePath string) ([]VersionRecord, error)
+	GetVersionContent(filePath string, targetVersionID uint64) (string, error)
+	Close()
+}
+
+func openVersionHistory(user string) (versionHistory, error) {
+	repo, err := gitRepoFor(user)
+	if err != nil {
+		return nil, err
+	}
+	if repo != nil {
+		return repo, nil
+	}
+	vm, err := NewVersionManager(user)
+	if err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
+
+// gitRepo is the repository rooted at the directory of a user with
+// git-backed storage. Every change the server makes to the user's files is
+// committed with the user as author; mu serializes the commits with the
+// merges of the scheduled sync.
+type gitRepo struct {
+	mu     sync.Mutex
+	dir    string
+	branch string
+	remote string
+}
+
+var gitRepos = struct {
+	sync.Mutex
+	repos map[string]*gitRepo
+}{repos: make(map[string]*gitRepo)}
+
+// gitRepoFor returns the repository of user, initializing it on first use,
+// or nil if user does not use git-backed storage.
+func gitRepoFor(user string) (*gitRepo, error) {
+	cfg, ok := AppConfig.Git.Users[user]
+	if !ok {
+		return nil, nil
+	}
+	gitRepos.Lock()
+	defer gitRepos.Unlock()
+	if repo, ok := gitRepos.repos[user]; ok {
+		return repo, nil
+	}
+	repo := &gitRepo{dir: filepath.Join(AppConfig.MarkdownDir, user), branch: cfg.Branch, remote: cfg.Remote}
+	if repo.branch == "" {
+		repo.branch = "main"
+	}
+	if err := repo.init(); err != nil {
+		return nil, fmt.Errorf("git repository of %s: %w", user, err)
+	}
+	gitRepos.repos[user] = repo
+	return repo, nil
+}
+
+// run runs git in the repository and returns its standard output. Commits
+// are made by GoNote unless they name another author.
+func (g *gitRepo) run(args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = g.dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=GoNote", "GIT_AUTHOR_EMAIL=",
+		"GIT_COMMITTER_NAME=GoNote", "GIT_COMMITTER_EMAIL=",
+		"GIT_TERMINAL_PROMPT=0", "GIT_LITERAL_PATHSPECS=1", "LC_ALL=C")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return stdout.String(), fmt.Errorf("git %s: %w: %s", args[0], err, msg)
+		}
+		return stdout.String(), fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return stdout.String(), nil
+}
+
+// init creates the repository if needed, keeps .extra and files being
+// written out of it, points origin at the configured remote and commits the
+// files changed while the server was not running.
+func (g *gitRepo) init() error {
+	if err := os.MkdirAll(g.dir, 0755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(g.dir, gitDirName)); os.IsNotExist(err) {
+		if _, err := g.run("init", "-q", "-b", g.branch); err != nil {
+			return err
+		}
+	}
+	exclude := filepath.Join(g.dir, gitDirName, "info", "exclude")
+	if err := os.MkdirAll(filepath.Dir(exclude), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(exclude, []byte("/.extra/\n.*.tmp\n"), 0644); err != nil {
+		return err
+	}
+
+	if g.remote != "" {
+		if url, err := g.run("remote", "get-url", "origin"); err != nil {
+			if _, err := g.run("remote", "add", "origin", g.remote); err != nil {
+				return err
+			}
+		} else if strings.TrimSpace(url) != g.remote {
+			if _, err := g.run("remote", "set-url", "origin", g.remote); err != nil {
+				return err
+			}
+		}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.commitAll(); err != nil {
+		return err
+	}
+	if _, err := g.run("rev-parse", "-q", "--verify", "HEAD"); err != nil {
+		_, err = g.run("commit", "-q", "--no-verify", "--allow-empty", "-m", "Initialize notes repository")
+		return err
+	}
+	return nil
+}
+
+// commitWith calls apply, which changes the files at paths (relative to the
+// repository, slash separated), and commits the changes with author and
+// comment. If the commit fails, nothing is staged and the error is
+// returned; the changes stay in the files for the next sync to commit.
+func (g *gitRepo) commitWith(author, comment string, paths []string, apply func() error) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if apply != nil {
+		if err := apply(); err != nil {
+			return err
+		}
+	}
+	err := g.stage(paths)
+	if err == nil {
+		err = g.commitStaged(author, comment)
+	}
+	if err != nil {
+		g.run(append([]string{"reset", "-q", "--"}, paths...)...)
+	}
+	return err
+}
+
+// stage adds the changes below paths to the index. Paths that neither exist
+// nor are tracked, such as the missing .attach folder of a deleted note, are
+// left out, as git refuses them.
+func (g *gitRepo) stage(paths []string) error {
+	out, err := g.run(append([]string{"ls-files", "-z", "--"}, paths...)...)
+	if err != nil {
+		return err
+	}
+	tracked := strings.Split(out, "\x00")
+	args := []string{"add", "-A", "--"}
+	for _, p := range paths {
+		if _, err := os.Lstat(filepath.Join(g.dir, filepath.FromSlash(p))); err == nil ||
+			slices.ContainsFunc(tracked, func(t string) bool { return t == p || strings.HasPrefix(t, p+"/") }) {
+			args = append(args, p)
+		}
+	}
+	if len(args) == 3 {
+		return nil
+	}
+	_, err = g.run(args...)
+	return err
+}
+
+// commitStaged commits the index unless it has no changes.
+func (g *gitRepo) commitStaged(author, comment string) error {
+	if _, err := g.run("diff", "--cached", "--quiet"); err == nil {
+		return nil
+	} else if exitErr := (*exec.ExitError)(nil); !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		return err
+	}
+	args := []string{"commit", "-q", "--no-verify", "-m", comment}
+	if author != "" {
+		args = append(args, "--author", author+" <>")
+	}
+	_, err := g.run(args...)
+	return err
+}
+
+// commitAll commits every change in the repository, made outside the server
+// or left uncommitted by a failed commit. The caller holds mu.
+func (g *gitRepo) commitAll() error {
+	if _, err := g.run("add", "-A"); err != nil {
+		return err
+	}
+	return g.commitStaged("", "Commit changes made outside GoNote")
+}
+
+// sync commits pending changes, merges the branch of the remote and pushes
+// the result. Only the commit and the merge, which change the files, hold
+// the write gate and mu; the fetch and the push, which may wait for a slow
+// remote, do not hold up writes.
+func (g *gitRepo) sync() error {
+	err := withWriteGate(func() error {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return g.commitAll()
+	})
+	if err != nil || g.remote == "" {
+		return err
+	}
+	if _, err := g.run("fetch", "-q", "origin"); err != nil {
+		return err
+	}
+
+	push := []string{"push", "-q", "origin", "HEAD:refs/heads/" + g.branch}
+	remoteRef := "refs/remotes/origin/" + g.branch
+	if _, err := g.run("rev-parse", "-q", "--verify", remoteRef); err == nil {
+		var conflictBranch string
+		err := withWriteGate(func() error {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			if err := g.commitAll(); err != nil {
+				return err
+			}
+			var err error
+			conflictBranch, err = g.merge(remoteRef)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if conflictBranch != "" {
+			push = append(push, "refs/heads/"+conflictBranch)
+		}
+	}
+	_, err = g.run(push...)
+	return err
+}
+
+// merge merges remoteRef into the branch. Where both sides changed the same
+// note in ways git cannot combine, including a note one side deleted or
+// renamed and the other changed, the local version wins, and the remote side is kept on a new
+// branch, which is returned so that it is pushed as well. The merge commit
+// names the conflicting files and that branch. A merge that still fails is
+// aborted and retried on the next sync. The caller holds mu.
+func (g *gitRepo) merge(remoteRef string) (string, error) {
+	// merge-tree finds the conflicts without touching the files.
+	out, err := g.run("-c", "core.quotePath=false", "merge-tree", "--write-tree", "--name-only", "--no-messages",
+		"--allow-unrelated-histories", "HEAD", remoteRef)
+	if exitErr := (*exec.ExitError)(nil); err != nil && (!errors.As(err, &exitErr) || exitErr.ExitCode() != 1) {
+		return "", err
+	}
+	var conflicts []string
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n")[1:] {
+		conflicts = append(conflicts, unquoteGitPath(line))
+	}
+
+	if len(conflicts) == 0 {
+		if _, err := g.run("merge", "-q", "--no-edit", "--allow-unrelated-histories", remoteRef); err != nil {
+			g.run("merge", "--abort")
+			return "", err
+		}
+		return "", nil
+	}
+
+	branch := g.branch + "-conflict-" + time.Now().UTC().Format("20060102-150405")
+	if _, err := g.run("branch", branch, remoteRef); err != nil {
+		return "", err
+	}
+	message := fmt.Sprintf("Merge %s\n\nBoth sides changed %s. The local version was kept; the remote version is on branch %s.",
+		strings.TrimPrefix(remoteRef, "refs/remotes/"), strings.Join(conflicts, ", "), branch)
+	if err := g.mergeOurs(remoteRef, message); err != nil {
+		g.run("merge", "--abort")
+		g.run("branch", "-D", branch)
+		return "", err
+	}
+	log.Printf("WARNING: Git sync of %s: both sides changed %s. The local version was kept; the remote version is on branch %s.",
+		g.dir, strings.Join(conflicts, ", "), branch)
+	return branch, nil
+}
+
+// mergeOurs merges remoteRef and commits the merge with message, resolving
+// every conflict to the local side. -X ours settles files whose lines both
+// sides changed; what it leaves unmerged, such as a note one side deleted
+// and the other changed, gets the local version checked out, or is removed
+// where the local side has none.
+func (g *gitRepo) mergeOurs(remoteRef, message string) error {
+	// The merge stops with an error while conflicts remain; they are
+	// resolved below, so only a merge that did not start is a failure.
+	g.run("merge", "-q", "--no-commit", "--allow-unrelated-histories", "-X", "ours", remoteRef)
+	if _, err := g.run("rev-parse", "-q", "--verify", "MERGE_HEAD"); err != nil {
+		return fmt.Errorf("merge of %s did not start: %w", remoteRef, err)
+	}
+	out, err := g.run("diff", "--name-only", "-z", "--diff-filter=U")
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Split(out, "\x00") {
+		if name == "" {
+			continue
+		}
+		if _, err := g.run("cat-file", "-e", "HEAD:"+name); err == nil {
+			_, err = g.run("checkout", "--ours", "--", name)
+			if err == nil {
+				_, err = g.run("add", "--", name)
+			}
+			if err != nil {
+				return err
+			}
+		} else if _, err := g.run("rm", "-q", "-f", "--", name); err != nil {
+			return err
+		}
+	}
+	_, err = g.run("commit", "-q", "--no-verify", "-m", message)
+	return err
+}
+
+func (g *gitRepo) Close() {}
+
+// Files returns the notes that appear in the history of the repository.
+func (g *gitRepo) Files() ([]string, error) {
+	out, err := g.run("-c", "core.quotePath=false", "log", "--format=", "--name-only")
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var files []string
+	for _, line := range strings.Split(out, "\n") {
+		name := unquoteGitPath(line)
+		if isNotePath(name) && !seen[name] {
+			seen[name] = true
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// gitVersion is a commit that changed a note, with the note's path in it.
+type gitVersion struct {
+	VersionRecord
+	path string
+}
+
+// versions lists the commits that changed the note at filePath, newest
+// first, following it across renames. IDs count the commits from the oldest,
+// so they stay the same as the history grows.
+func (g *gitRepo) versions(filePath string) ([]gitVersion, error) {
+	filePath = path.Clean("/" + filepath.ToSlash(filePath))[1:]
+	out, err := g.run("-c", "core.quotePath=false", "log", "--follow", "--name-status",
+		"--format=%x1e%H%x1f%at%x1f%an%x1f%B%x1f", "--", filePath)
+	if err != nil {
+		return nil, err
+	}
+	var versions []gitVersion
+	for _, entry := range strings.Split(out, "\x1e")[1:] {
+		fields := strings.SplitN(entry, "\x1f", 5)
+		if len(fields) < 5 {
+			continue
+		}
+		status := strings.Split(strings.TrimSpace(fields[4]), "\t")
+		if len(status) < 2 || strings.HasPrefix(status[0], "D") {
+			continue
+		}
+		seconds, _ := strconv.ParseInt(fields[1], 10, 64)
+		versions = append(versions, gitVersion{
+			VersionRecord: VersionRecord{
+				Type:      "git",
+				Commit:    fields[0],
+				Author:    fields[2],
+				Comment:   strings.TrimSpace(fields[3]),
+				Timestamp: time.Unix(seconds, 0),
+			},
+			path: unquoteGitPath(status[len(status)-1]),
+		})
+	}
+	for i := range versions {
+		versions[i].ID = uint64(len(versions) - i)
+	}
+	return versions, nil
+}
+
+func (g *gitRepo) GetHistory(filePath string) ([]VersionRecord, error) {
+	versions, err := g.versions(filePath)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]VersionRecord, len(versions))
+	for i, version := range versions {
+		history[i] = version.VersionRecord
+	}
+	return history, nil
+}
+
+func (g *gitRepo) GetVersionContent(filePath string, targetVersionID uint64) (string, error) {
+	versions, err := g.versions(filePath)
+	if err != nil {
+		return "", err
+	}
+	for _, version := range versions {
+		if version.ID == targetVersionID {
+			return g.run("show", version.Commit+":"+version.path)
+		}
+	}
+	return "", fmt.Errorf("version %d not found", targetVersionID)
+}
+
+// unquoteGitPath undoes the quoting git applies to paths with unusual
+// characters even with core.quotePath off.
+func unquoteGitPath(name string) string {
+	if strings.HasPrefix(name, `"`) {
+		if unquoted, err := strconv.Unquote(name); err == nil {
+			return unquoted
+		}
+	}
+	return name
+}
+
+// withGitCommit runs fn, which changes the files of user at paths (relative
+// to the user's root), and commits the changes for users with git-backed
+// storage. A failed commit is only logged: the change has been made, and
+// the next sync commits it.
+func withGitCommit(user, comment string, paths []string, fn func() error) error {
+	repo, err := gitRepoFor(user)
+	if err != nil || repo == nil {
+		if err != nil {
+			log.Printf("Not committing '%s': %v", comment, err)
+		}
+		return fn()
+	}
+	for i, p := range paths {
+		paths[i] = path.Clean("/" + filepath.ToSlash(p))[1:]
+	}
+	var fnErr error
+	err = repo.commitWith(user, comment, paths, func() error {
+		fnErr = fn()
+		return fnErr
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		log.Printf("Could not commit '%s' for %s: %v", comment, user, err)
+	}
+	return nil
+}
+
+// StartGitSync commits the changes made to the repositories of users with
+// git-backed storage while the server was down, and schedules the sync with
+// their remotes.
+func StartGitSync() {
+	if len(AppConfig.Git.Users) == 0 {
+		return
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		log.Fatalf("FATAL: Git-backed storage needs the git command: %v", err)
+	}
+	for user := range AppConfig.Git.Users {
+		if _, err := gitRepoFor(user); err != nil {
+			log.Fatalf("FATAL: %v", err)
+		}
+	}
+
+	log.Printf("Starting git sync for %d user(s). Cron: '%s'", len(AppConfig.Git.Users), AppConfig.Git.Cron)
+	c := cron.New()
+	if _, err := c.AddFunc(AppConfig.Git.Cron, syncGitRepos); err != nil {
+		log.Fatalf("FATAL: Invalid git sync cron expression: %v", err)
+	}
+	go syncGitRepos()
+	go c.Start()
+}
+
+var gitSyncMutex sync.Mutex
+
+func syncGitRepos() {
+	if !gitSyncMutex.TryLock() {
+		log.Println("Git sync is still running, skipping this run.")
+		return
+	}
+	defer gitSyncMutex.Unlock()
+	for user := range AppConfig.Git.Users {
+		repo, err := gitRepoFor(user)
+		if err == nil {
+			err = repo.sync()
+		}
+		if err != nil {
+			log.Printf("Git sync for %s failed: %v", user, err)
+		}
+	}
+}
+
+// --- search.go ---
+
+type SearchResult struct {
+	Path       string    `json:"path"`
+	Attachment string    `json:"attachment,omitempty"`
+	Score      float64   `json:"score,omitempty"`
+	ModTime    time.Time `json:"mod_time"`
+	Size       int64     `json:"size"`
+	Context    []string  `json:"context"`
+}
+
+// SearchOptions narrows and orders a search. Scope is a path relative to the
+// user's root (a folder or a single note), Sort is "relevance" (default),
+// "modified" (newest first) or "path". Zero times disable the date filters.
+type SearchOptions struct {
+	Query          string
+	Regex          bool
+	Scope          string
+	Sort           string
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+}
+
+// searchSorts are the values SearchOptions.Sort accepts; "" is "relevance".
+var searchSorts = []string{"", "relevance", "modified", "path"}
+
+func checkSearchSort(order string) error {
+	if !slices.Contains(searchSorts, order) {
+		return fmt.Errorf("invalid sort %q", order)
+	}
+	return nil
+}
+
+// parseTimeFilter accepts a date (2006-01-02), an RFC3339 timestamp or a
+// duration relative to now such as "7d", "12h" or "2w". A date stands for
+// its start, or for its end if endOfDay is set, so that a date used as the
+// upper bound includes the whole day.
+func parseTimeFilter(value string, now time.Time, endOfDay bool) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		if endOfDay {
+			t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		return t, nil
+	}
+	trimmed := strings.TrimPrefix(value, "-")
+	if len(trimmed) > 1 {
+		if n, err := strconv.Atoi(trimmed[:len(trimmed)-1]); err == nil {
+			switch trimmed[len(trimmed)-1] {
+			case 'd':
+				return now.AddDate(0, 0, -n), nil
+			case 'w':
+				return now.AddDate(0, 0, -7*n), nil
+			}
+		}
+	}
+	if d, err := time.ParseDuration(trimmed); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", value)
+}
+
+func SearchInMemory(user string, opts SearchOptions) []SearchResult {
+	store.RLock()
+	defer store.RUnlock()
+
+	var results []SearchResult
+	var re *regexp.Regexp
+	var err error
+
+	keywords := []string{}
+	if opts.Regex {
+		re, err = regexp.Compile(opts.Query)
+		if err != nil {
+			return results
+		}
+	} else {
+		keywords = strings.Fields(strings.ToLower(opts.Query))
+		if len(keywords) == 0 {
+			return results
+		}
+	}
+
+	// score returns the number of matches in content, or 0 if content does
+	// not match the query.
+	score := func(content string) int {
+		if opts.Regex {
+			return len(re.FindAllStringIndex(content, -1))
+		}
+		contentLower := strings.ToLower(content)
+		total := 0
+		for _, keyword := range keywords {
+			n := strings.Count(contentLower, keyword)
+			if n == 0 {
+				return 0
+			}
+			total += n
+		}
+		return total
+	}
+
+	userPrefix := user + string(filepath.Separator)
+	scope := filepath.Join(user, filepath.Clean(opts.Scope))
+	toUserPath := func(relPath string) string {
+		return strings.ReplaceAll(strings.TrimPrefix(relPath, userPrefix), string(filepath.Separator), "/")
+	}
+	inRange := func(modTime time.Time) bool {
+		if !opts.ModifiedAfter.IsZero() && modTime.Before(opts.ModifiedAfter) {
+			return false
+		}
+		if !opts.ModifiedBefore.IsZero() && modTime.After(opts.ModifiedBefore) {
+			return false
+		}
+		return true
+	}
+
+	for path, doc := range store.docs.Documents(scope, true) {
+		if !strings.HasPrefix(path, userPrefix) || !inRange(doc.ModTime) {
+			continue
+		}
+		if n := score(doc.Content); n > 0 {
+			context := getMatchContext(doc.Content, opts.Regex, re, keywords)
+			results = append(results, SearchResult{
+				Path:    toUserPath(doc.Path),
+				Score:   float64(n),
+				ModTime: doc.ModTime,
+				Size:    doc.Size,
+				Context: context,
+			})
+		}
+	}
+
+	for path, attachment := range store.attachments.Attachments(user, false) {
+		if !isWithin(attachment.Parent, scope) || !inRange(attachment.ModTime) {
+			continue
+		}
+		attachment, _ = store.attachments.Get(path)
+		if n := score(attachment.Content); n > 0 {
+			context := getMatchContext(attachment.Content, opts.Regex, re, keywords)
+			results = append(results, SearchResult{
+				Path:       toUserPath(attachment.Parent),
+				Attachment: toUserPath(attachment.Path),
+				Score:      float64(n),
+				ModTime:    attachment.ModTime,
+				Size:       attachment.Size,
+				Context:    context,
+			})
+		}
+	}
+
+	sortSearchResults(results, opts.Sort)
+	return results
+}
+
+func sortSearchResults(results []SearchResult, order string) {
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		switch order {
+		case "modified":
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.After(b.ModTime)
+			}
+		case "path":
+		default:
+			if a.Score != b.Score {
+				return a.Score > b.Score
+			}
+		}
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Attachment < b.Attachment
+	})
+}
+
+func getMatchContext(content string, useRegex bool, re *regexp.Regexp, keywords []string) []string {
+	lines := strings.Split(content, "\n")
+	var contextLines []string
+
+	for i, line := range lines {
+		lineLower := strings.ToLower(line)
+		isMatch := false
+		if useRegex {
+			if re.MatchString(line) {
+				isMatch = true
+			}
+		} else {
+			for _, keyword := range keywords {
+				if strings.Contains(lineLower, keyword) {
+					isMatch = true
+					break
+				}
+			}
+		}
+
+		if isMatch {
+			contextLines = append(contextLines, fmt.Sprintf("%d: %s", i+1, line))
+		}
+		if len(contextLines) >= 5 {
+			break
+		}
+	}
+	return contextLines
+}
+
+// --- metadata.go ---
+
+// parseFrontMatter extracts the YAML front matter at the top of a note. It
+// returns nil when the note has none or when it is not valid YAML.
+func parseFrontMatter(content string) map[string]interface{} {
+	block, _, ok := splitFrontMatter(content)
+	if !ok {
+		return nil
+	}
+	var meta map[string]interface{}
+	if err := yaml.Unmarshal([]byte(block), &meta); err != nil || len(meta) == 0 {
+		return nil
+	}
+	for k, v := range meta {
+		meta[k] = normalizeMetaValue(v)
+	}
+	return meta
+}
+
+// splitFrontMatter splits content into the front matter block (without the
+// "---" fences) and the remaining body.
+func splitFrontMatter(content string) (block, body string, ok bool) {
+	rest, found := strings.CutPrefix(content, "---\n")
+	if !found {
+		if rest, found = strings.CutPrefix(content, "---\r\n"); !found {
+			return "", content, false
+		}
+	}
+	offset := 0
+	for offset <= len(rest) {
+		end := strings.IndexByte(rest[offset:], '\n')
+		line := rest[offset:]
+		if end >= 0 {
+			line = rest[offset : offset+end]
+		}
+		if trimmed := strings.TrimRight(line, "\r"); trimmed == "---" || trimmed == "..." {
+			if end < 0 {
+				return rest[:offset], "", true
+			}
+			return rest[:offset], rest[offset+end+1:], true
+		}
+		if end < 0 {
+			break
+		}
+		offset += end + 1
+	}
+	return "", content, false
+}
+
+// normalizeMetaValue turns YAML timestamps back into the strings the user
+// wrote, so that dates round-trip through JSON unchanged.
+func normalizeMetaValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case time.Time:
+		if t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 && t.Nanosecond() == 0 {
+			return t.Format("2006-01-02")
+		}
+		return t.Format(time.RFC3339)
+	case map[string]interface{}:
+		for k, item := range t {
+			t[k] = normalizeMetaValue(item)
+		}
+	case map[interface{}]interface{}:
+		// YAML allows keys such as numbers or booleans, which JSON does not.
+		m := make(map[string]interface{}, len(t))
+		for k, item := range t {
+			m[metaString(k)] = normalizeMetaValue(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range t {
+			t[i] = normalizeMetaValue(item)
+		}
+	}
+	return v
+}
+
+func metaString(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+// metaMatches reports whether value satisfies a filter. The filter "*" only
+// requires the field to be present; otherwise it is a comma separated list of
+// accepted values, compared case-insensitively. List values match if any of
+// their items match.
+func metaMatches(value interface{}, present bool, filter string) bool {
+	if filter == "*" {
+		return present
+	}
+	if !present {
+		return false
+	}
+	if list, ok := value.([]interface{}); ok {
+		for _, item := range list {
+			if metaMatches(item, true, filter) {
+				return true
+			}
+		}
+		return false
+	}
+	s := metaString(value)
+	for _, want := range strings.Split(filter, ",") {
+		if strings.EqualFold(strings.TrimSpace(want), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// compareMetaValues orders two front-matter values: numbers numerically,
+// dates chronologically and everything else as text.
+func compareMetaValues(a, b interface{}) int {
+	af, aNum := metaNumber(a)
+	bf, bNum := metaNumber(b)
+	if aNum && bNum {
+		switch {
+		case af < bf:
+			return -1
+		case af > bf:
+			return 1
+		}
+		return 0
+	}
+	as, bs := metaString(a), metaString(b)
+	at, aTime := metaTime(as)
+	bt, bTime := metaTime(bs)
+	if aTime && bTime {
+		return at.Compare(bt)
+	}
+	return strings.Compare(strings.ToLower(as), strings.ToLower(bs))
+}
+
+func metaNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func metaTime(s string) (time.Time, bool) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, true
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+type MetaQueryResult struct {
+	Path    string                 `json:"path"`
+	Meta    map[string]interface{} `json:"meta"`
+	ModTime time.Time              `json:"mod_time"`
+}
+
+// QueryMetadata returns the user's notes below scope whose front matter
+// matches every filter, sorted by the sortField front-matter field. Notes
+// without that field are listed last.
+func QueryMetadata(user, scope string, filters map[string]string, sortField string, descending bool) []MetaQueryResult {
+	userPrefix := user + string(filepath.Separator)
+	scopeRelPath := filepath.Join(user, filepath.Clean(scope))
+
+	store.RLock()
+	results := make([]MetaQueryResult, 0)
+	for relPath, doc := range store.docs.Documents(scopeRelPath, false) {
+		if !strings.HasPrefix(relPath, userPrefix) || doc.Meta == nil {
+			continue
+		}
+		matched := true
+		for field, filter := range filters {
+			value, present := doc.Meta[field]
+			if !metaMatches(value, present, filter) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			results = append(results, MetaQueryResult{
+				Path:    filepath.ToSlash(strings.TrimPrefix(relPath, userPrefix)),
+				Meta:    doc.Meta,
+				ModTime: doc.ModTime,
+			})
+		}
+	}
+	store.RUnlock()
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if sortField != "" {
+			a, aOK := results[i].Meta[sortField]
+			b, bOK := results[j].Meta[sortField]
+			if aOK != bOK {
+				return aOK
+			}
+			if aOK {
+				if c := compareMetaValues(a, b); c != 0 {
+					if descending {
+						return c > 0
+					}
+					return c < 0
+				}
+			}
+		}
+		return results[i].Path < results[j].Path
+	})
+	return results
+}
+
+// --- tags.go ---
+
+// inlineTagRe matches "#tag" and "#nested/tag". The tag must not follow a
+// word character, "&" or "/", so URL fragments and HTML entities are skipped.
+var inlineTagRe = regexp.MustCompile(`(^|[^\p{L}\p{N}_&/#])#([\p{L}\p{N}_\-]+(?:/[\p{L}\p{N}_\-]+)*)`)
+
+var frontMatterTagTokenRe = regexp.MustCompile(`#?[^\s\[\],'"#]+`)
+
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(tag), "#")), "/"))
+}
+
+// isValidTag rejects tags made of digits only, which are usually issue
+// numbers or headings such as "#1".
+func isValidTag(tag string) bool {
+	return tag != "" && strings.IndexFunc(tag, func(r rune) bool { return !unicode.IsDigit(r) }) >= 0
+}
+
+// extractTags returns the sorted, de-duplicated tags of a note, taken from
+// the "tags" front-matter field and from inline #tags outside code.
+func extractTags(content string, meta map[string]interface{}) []string {
+	set := make(map[string]bool)
+	switch v := meta["tags"].(type) {
+	case []interface{}:
+		for _, item := range v {
+			if tag := normalizeTag(metaString(item)); isValidTag(tag) {
+				set[tag] = true
+			}
+		}
+	case string:
+		for _, item := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+			if tag := normalizeTag(item); isValidTag(tag) {
+				set[tag] = true
+			}
+		}
+	}
+
+	_, body, _ := splitFrontMatter(content)
+	mapProse(body, func(text string) string {
+		return mapOutsideLinks(text, func(text string) string {
+			for _, m := range inlineTagRe.FindAllStringSubmatch(text, -1) {
+				if tag := normalizeTag(m[2]); isValidTag(tag) {
+					set[tag] = true
+				}
+			}
+			return text
+		})
+	})
+
+	if len(set) == 0 {
+		return nil
+	}
+	tags := make([]string, 0, len(set))
+	for tag := range set {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// mapProse applies fn to every part of a markdown body that is outside fenced
+// code blocks and inline code spans, and returns the rewritten body.
+func mapProse(body string, fn func(string) string) string {
+	return mapLines(body, func(_ int, line string) string {
+		return mapProseLine(line, fn)
+	})
+}
+
+// mapLines applies fn to every line of body that is outside fenced code
+// blocks. fn receives the zero-based line number and the line including its
+// trailing newline.
+func mapLines(body string, fn func(int, string) string) string {
+	var sb strings.Builder
+	fence := ""
+	for i, line := range strings.SplitAfter(body, "\n") {
+		trimmed := strings.TrimLeft(line, " \t")
+		if fence != "" {
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+			sb.WriteString(line)
+			continue
+		}
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			fence = trimmed[:3]
+			sb.WriteString(line)
+			continue
+		}
+		sb.WriteString(fn(i, line))
+	}
+	return sb.String()
+}
+
+func mapProseLine(line string, fn func(string) string) string {
+	var sb strings.Builder
+	for {
+		start := strings.IndexByte(line, '`')
+		if start < 0 {
+			sb.WriteString(fn(line))
+			return sb.String()
+		}
+		n := start
+		for n < len(line) && line[n] == '`' {
+			n++
+		}
+		ticks := line[start:n]
+		end := strings.Index(line[n:], ticks)
+		if end < 0 {
+			sb.WriteString(fn(line))
+			return sb.String()
+		}
+		end += n + len(ticks)
+		sb.WriteString(fn(line[:start]))
+		sb.WriteString(line[start:end])
+		line = line[end:]
+	}
+}
+
+// renameTagValue maps tag to its new name when it is from or nested below
+// from. ok is false for unrelated tags.
+func renameTagValue(tag, from, to string) (string, bool) {
+	lower := strings.ToLower(tag)
+	if lower == from {
+		return to, true
+	}
+	if strings.HasPrefix(lower, from+"/") {
+		return to + tag[len(from):], true
+	}
+	return tag, false
+}
+
+// renameTagInContent rewrites every occurrence of the tag from (and tags
+// nested below it) to to, both inline and in the "tags" front-matter field.
+// It also returns the number of tags it renamed.
+func renameTagInContent(content, from, to string) (string, int) {
+	block, body, hasFrontMatter := splitFrontMatter(content)
+	count := 0
+
+	body = mapProse(body, func(text string) string {
+		return mapOutsideLinks(text, func(text string) string {
+			return inlineTagRe.ReplaceAllStringFunc(text, func(m string) string {
+				sub := inlineTagRe.FindStringSubmatch(m)
+				if renamed, ok := renameTagValue(sub[2], from, to); ok {
+					count++
+					return sub[1] + "#" + renamed
+				}
+				return m
+			})
+		})
+	})
+	if !hasFrontMatter {
+		return body, count
+	}
+
+	lines := strings.SplitAfter(block, "\n")
+	inTags := false
+	for i, line := range lines {
+		key := line
+		rest := ""
+		if !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t") && !strings.HasPrefix(line, "-") {
+			inTags = false
+			if k, v, found := strings.Cut(line, ":"); found && strings.TrimSpace(k) == "tags" {
+				inTags = true
+				key, rest = k+":", v
+			} else {
+				continue
+			}
+		} else {
+			if !inTags {
+				continue
+			}
+			key, rest = "", line
+		}
+		lines[i] = key + frontMatterTagTokenRe.ReplaceAllStringFunc(rest, func(token string) string {
+			hash := ""
+			if strings.HasPrefix(token, "#") {
+				hash, token = "#", token[1:]
+			}
+			if renamed, ok := renameTagValue(token, from, to); ok {
+				count++
+				return hash + renamed
+			}
+			return hash + token
+		})
+	}
+
+	delimiter := "---\n"
+	if strings.HasPrefix(content, "---\r\n") {
+		delimiter = "---\r\n"
+	}
+	return delimiter + strings.Join(lines, "") + delimiter + body, count
+}
+
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+func ListTags(user string) []TagCount {
+	store.RLock()
+	defer store.RUnlock()
+
+	tags := make([]TagCount, 0, len(store.tags[user]))
+	for tag, docs := range store.tags[user] {
+		tags = append(tags, TagCount{Tag: tag, Count: len(docs)})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Tag < tags[j].Tag })
+	return tags
+}
+
+type TaggedNote struct {
+	Path    string    `json:"path"`
+	Tags    []string  `json:"tags"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// NotesForTag returns the notes tagged with tag or with any tag nested below
+// it, sorted by path.
+func NotesForTag(user, tag string) []TaggedNote {
+	tag = normalizeTag(tag)
+	userPrefix := user + string(filepath.Separator)
+
+	store.RLock()
+	defer store.RUnlock()
+
+	seen := make(map[string]bool)
+	notes := make([]TaggedNote, 0)
+	for t, docs := range store.tags[user] {
+		if _, ok := renameTagValue(t, tag, tag); !ok {
+			continue
+		}
+		for relPath := range docs {
+			if seen[relPath] {
+				continue
+			}
+			seen[relPath] = true
+			doc, _ := store.docs.Stat(relPath)
+			notes = append(notes, TaggedNote{
+				Path:    filepath.ToSlash(strings.TrimPrefix(relPath, userPrefix)),
+				Tags:    doc.Tags,
+				ModTime: doc.ModTime,
+			})
+		}
+	}
+	sort.Slice(notes, func(i, j int) bool { return notes[i].Path < notes[j].Path })
+	return notes
+}
+
+// RenameTag renames the tag from to to in every note of user that uses it.
+// Renaming onto an existing tag merges the two. Files are written through
+// saveDocument so that each rewrite is versioned.
+func RenameTag(user, from, to string, dryRun bool, comment string) ReplaceSummary {
+	from, to = normalizeTag(from), normalizeTag(to)
+
+	summary := ReplaceSummary{DryRun: dryRun, Comment: comment, Files: []ReplaceFileResult{}}
+	for _, note := range NotesForTag(user, from) {
+		_, _, relPath, err := resolveUserPath(user, note.Path)
+		if err != nil {
+			continue
+		}
+		store.RLock()
+		doc, _ := store.docs.Get(relPath)
+		content := doc.Content
+		store.RUnlock()
+
+		newContent, matches := renameTagInContent(content, from, to)
+		if newContent == content {
+			continue
+		}
+
+		result := ReplaceFileResult{Path: note.Path, Matches: matches}
+		summary.FilesMatched++
+		summary.TotalMatches += matches
+		if dryRun {
+			result.Diff = lineDiff(content, newContent)
+		} else {
+			sha1, changed, err := saveDocument(user, note.Path, newContent, comment)
+			if err != nil {
+				result.Error = err.Error()
+			} else if changed {
+				result.SHA1 = sha1
+				summary.FilesChanged++
+			}
+		}
+		summary.Files = append(summary.Files, result)
+	}
+	return summary
+}
+
+// --- links.go ---
+
+var (
+	wikiLinkRe     = regexp.MustCompile(`!?\[\[([^\[\]|\n]+)(\|[^\[\]\n]*)?\]\]`)
+	markdownLinkRe = regexp.MustCompile(`(!?\[[^\]\n]*\]\(\s*)(<[^>\n]+>|[^)\s]+)((?:\s+"[^"\n]*")?\s*\))`)
+	htmlImageRe    = regexp.MustCompile(`(?i)<img\b[^>]*?\ssrc\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+	fileExtRe      = regexp.MustCompile(`^\.[a-z][a-z0-9]{0,4}$`)
+)
+
+const linkContextLength = 200
+
+// NoteLink is a link from one note to another. Key identifies the target in
+// the reverse index: the user-relative path for markdown links and "[[" plus
+// the lower-case note name for wiki links, whose target depends on which
+// notes exist.
+type NoteLink struct {
+	Kind    string `json:"kind"`
+	Target  string `json:"target"`
+	Key     string `json:"-"`
+	Line    int    `json:"line"`
+	Context string `json:"context"`
+}
+
+// noteName returns the lower-case name a wiki link uses for the note at
+// subPath, i.e. "meeting" for "work/Meeting.md".
+func noteName(subPath string) string {
+	name := path.Base(filepath.ToSlash(subPath))
+	if strings.HasSuffix(strings.ToLower(name), ".md") {
+		name = name[:len(name)-len(".md")]
+	}
+	return strings.ToLower(name)
+}
+
+// wikiLinkName returns the note a [[...]] link refers to without heading
+// and ".md" suffix. ok is false for links to headings of the same note and
+// for embedded files such as [[image.png]].
+func wikiLinkName(target string) (name string, ok bool) {
+	name, _, _ = strings.Cut(target, "#")
+	name = strings.Trim(strings.TrimSpace(name), "/")
+	if name == "" {
+		return "", false
+	}
+	ext := strings.ToLower(path.Ext(name))
+	if ext == ".md" {
+		return name[:len(name)-len(ext)], true
+	}
+	if fileExtRe.MatchString(ext) {
+		return "", false
+	}
+	return name, true
+}
+
+// markdownLinkPath resolves the target of a markdown link in a note located
+// in dir (slash separated, relative to the user root). ok is false for
+// external URLs, anchors and links leaving the user directory.
+func markdownLinkPath(dir, target string) (linkPath string, ok bool) {
+	target = strings.TrimSuffix(strings.TrimPrefix(target, "<"), ">")
+	if i := strings.IndexAny(target, ":/"); i >= 0 && target[i] == ':' {
+		return "", false
+	}
+	if i := strings.IndexAny(target, "#?"); i >= 0 {
+		target = target[:i]
+	}
+	if unescaped, err := url.PathUnescape(target); err == nil {
+		target = unescaped
+	}
+	if target == "" {
+		return "", false
+	}
+	if strings.HasPrefix(target, "/") {
+		linkPath = path.Clean(target[1:])
+	} else {
+		linkPath = path.Join(dir, target)
+	}
+	if linkPath == "." || linkPath == ".." || strings.HasPrefix(linkPath, "../") {
+		return "", false
+	}
+	return linkPath, true
+}
+
+// mapOutsideLinks applies fn to the parts of text that are not wiki or
+// markdown links, so that "[[#heading]]" and "(#anchor)" are not read as tags.
+func mapOutsideLinks(text string, fn func(string) string) string {
+	spans := append(wikiLinkRe.FindAllStringIndex(text, -1), markdownLinkRe.FindAllStringIndex(text, -1)...)
+	if len(spans) == 0 {
+		return fn(text)
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+
+	var sb strings.Builder
+	pos := 0
+	for _, span := range spans {
+		if span[0] < pos {
+			continue
+		}
+		sb.WriteString(fn(text[pos:span[0]]))
+		sb.WriteString(text[span[0]:span[1]])
+		pos = span[1]
+	}
+	sb.WriteString(fn(text[pos:]))
+	return sb.String()
+}
+
+func linkContext(line string) string {
+	line = strings.TrimSpace(line)
+	if utf8.RuneCountInString(line) > linkContextLength {
+		line = string([]rune(line)[:linkContextLength]) + "..."
+	}
+	return line
+}
+
+// parseLinks returns the outgoing note links of the note at relPath. Links
+// inside code and front matter are ignored, and links to files other than
+// notes are not reported.
+func parseLinks(relPath, content string) []NoteLink {
+	links, _ := parseReferences(relPath, content)
+	return links
+}
+
+// parseReferences returns the note links and the file references of the
+// note at relPath. File references are local images ("image"), markdown
+// links to files other than notes ("file"), both keyed by their resolved
+// path, and wiki embeds such as ![[image.png]] ("embed"), keyed by the file
+// name as written.
+func parseReferences(relPath, content string) (links, files []NoteLink) {
+	_, subPath := splitUserPath(relPath)
+	dir := path.Dir(filepath.ToSlash(subPath))
+	_, body, _ := splitFrontMatter(content)
+	offset := strings.Count(content[:len(content)-len(body)], "\n")
+
+	mapLines(body, func(i int, line string) string {
+		mapProseLine(line, func(text string) string {
+			for _, m := range wikiLinkRe.FindAllStringSubmatch(text, -1) {
+				link := NoteLink{Kind: "wiki", Target: m[1], Line: offset + i + 1, Context: linkContext(line)}
+				if name, ok := wikiLinkName(m[1]); ok {
+					link.Key = "[[" + noteName(name)
+					links = append(links, link)
+				} else if name, _, _ := strings.Cut(m[1], "#"); strings.TrimSpace(name) != "" {
+					link.Kind, link.Key = "embed", strings.TrimSpace(name)
+					files = append(files, link)
+				}
+			}
+			for _, m := range markdownLinkRe.FindAllStringSubmatch(text, -1) {
+				linkPath, ok := markdownLinkPath(dir, m[2])
+				if !ok {
+					continue
+				}
+				link := NoteLink{Kind: "markdown", Target: m[2], Key: linkPath, Line: offset + i + 1, Context: linkContext(line)}
+				switch {
+				case strings.HasPrefix(m[1], "!"):
+					link.Kind = "image"
+					files = append(files, link)
+				case strings.HasSuffix(strings.ToLower(linkPath), ".md"):
+					links = append(links, link)
+				default:
+					link.Kind = "file"
+					files = append(files, link)
+				}
+			}
+			for _, m := range htmlImageRe.FindAllStringSubmatch(text, -1) {
+				target := m[1] + m[2] + m[3]
+				if linkPath, ok := markdownLinkPath(dir, target); ok {
+					files = append(files, NoteLink{Kind: "image", Target: target, Key: linkPath, Line: offset + i + 1, Context: linkContext(line)})
+				}
+			}
+			return text
+		})
+		return line
+	})
+	return links, files
+}
+
+// resolveLink returns the user-relative path of the note link points to, or
+// "" when no such note exists. A wiki link prefers a note in the folder of
+// source, then the note with the shortest path. The caller must hold the
+// read lock.
+func (s *InMemoryStore) resolveLink(user, source string, link NoteLink) string {
+	if link.Kind != "wiki" {
+		if _, ok := s.docs.Stat(filepath.Join(user, filepath.FromSlash(link.Key))); ok {
+			return link.Key
+		}
+		return ""
+	}
+
+	name, _ := wikiLinkName(link.Target)
+	name = strings.ToLower(name)
+	sourceDir := path.Dir(source)
+	best := ""
+	for relPath := range s.names[user][strings.TrimPrefix(link.Key, "[[")] {
+		_, candidate := splitUserPath(relPath)
+		candidate = filepath.ToSlash(candidate)
+		withoutExt := strings.ToLower(candidate[:len(candidate)-len(".md")])
+		if withoutExt != name && !strings.HasSuffix(withoutExt, "/"+name) {
+			continue
+		}
+		if best == "" || betterLinkCandidate(candidate, best, sourceDir) {
+			best = candidate
+		}
+	}
+	return best
+}
+
+func betterLinkCandidate(candidate, best, sourceDir string) bool {
+	candidateLocal, bestLocal := path.Dir(candidate) == sourceDir, path.Dir(best) == sourceDir
+	if candidateLocal != bestLocal {
+		return candidateLocal
+	}
+	if len(candidate) != len(best) {
+		return len(candidate) < len(best)
+	}
+	return candidate < best
+}
+
+// LinkRef is a link as returned by the API. Path is the resolved target for
+// outgoing links and the linking note for backlinks.
+type LinkRef struct {
+	Path string `json:"path,omitempty"`
+	NoteLink
+}
+
+type NoteLinks struct {
+	Path       string    `json:"path"`
+	Outgoing   []LinkRef `json:"outgoing"`
+	Backlinks  []LinkRef `json:"backlinks"`
+	Unresolved []LinkRef `json:"unresolved"`
+}
+
+// GetLinks returns the outgoing links, backlinks and unresolved links of the
+// note at subPath. ok is false if the note is not in the cache.
+func GetLinks(user, subPath string) (links NoteLinks, ok bool) {
+	subPath = filepath.ToSlash(subPath)
+	links = NoteLinks{Path: subPath, Outgoing: []LinkRef{}, Backlinks: []LinkRef{}, Unresolved: []LinkRef{}}
+
+	store.RLock()
+	defer store.RUnlock()
+
+	doc, ok := store.docs.Stat(filepath.Join(user, filepath.FromSlash(subPath)))
+	if !ok {
+		return links, false
+	}
+	for _, link := range doc.Links {
+		if target := store.resolveLink(user, subPath, link); target != "" {
+			links.Outgoing = append(links.Outgoing, LinkRef{Path: target, NoteLink: link})
+		} else {
+			links.Unresolved = append(links.Unresolved, LinkRef{NoteLink: link})
+		}
+	}
+
+	keys := []string{subPath, "[[" + noteName(subPath)}
+	sources := make(map[string]bool)
+	for _, key := range keys {
+		for relPath := range store.links[user][key] {
+			sources[relPath] = true
+		}
+	}
+	for relPath := range sources {
+		_, source := splitUserPath(relPath)
+		source = filepath.ToSlash(source)
+		doc, _ := store.docs.Stat(relPath)
+		for _, link := range doc.Links {
+			if (link.Key == keys[0] || link.Key == keys[1]) && store.resolveLink(user, source, link) == subPath {
+				links.Backlinks = append(links.Backlinks, LinkRef{Path: source, NoteLink: link})
+			}
+		}
+	}
+	sort.Slice(links.Backlinks, func(i, j int) bool {
+		a, b := links.Backlinks[i], links.Backlinks[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Line < b.Line
+	})
+	return links, true
+}
+
+type GraphNode struct {
+	ID         string   `json:"id"`
+	Title      string   `json:"title"`
+	Tags       []string `json:"tags,omitempty"`
+	Unresolved bool     `json:"unresolved,omitempty"`
+}
+
+type GraphEdge struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Count  int    `json:"count"`
+}
+
+type LinkGraph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// BuildLinkGraph exports the link graph of user. Every note is a node; with
+// withUnresolved, missing link targets are added as nodes marked unresolved.
+func BuildLinkGraph(user string, withUnresolved bool) LinkGraph {
+	userPrefix := user + string(filepath.Separator)
+	graph := LinkGraph{Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+	edges := make(map[[2]string]int)
+	unresolved := make(map[string]bool)
+
+	store.RLock()
+	for relPath, doc := range store.docs.Documents(user, false) {
+		if !strings.HasPrefix(relPath, userPrefix) {
+			continue
+		}
+		source := filepath.ToSlash(strings.TrimPrefix(relPath, userPrefix))
+		title := metaString(doc.Meta["title"])
+		if title == "" {
+			title = strings.TrimSuffix(path.Base(source), path.Ext(source))
+		}
+		graph.Nodes = append(graph.Nodes, GraphNode{ID: source, Title: title, Tags: doc.Tags})
+
+		for _, link := range doc.Links {
+			target := store.resolveLink(user, source, link)
+			if target == "" {
+				if !withUnresolved {
+					continue
+				}
+				target = link.Key
+				if link.Kind == "wiki" {
+					target, _ = wikiLinkName(link.Target)
+				}
+				unresolved[target] = true
+			}
+			edges[[2]string{source, target}]++
+		}
+	}
+	store.RUnlock()
+
+	for target := range unresolved {
+		graph.Nodes = append(graph.Nodes, GraphNode{ID: target, Title: path.Base(target), Unresolved: true})
+	}
+	for edge, count := range edges {
+		graph.Edges = append(graph.Edges, GraphEdge{Source: edge[0], Target: edge[1], Count: count})
+	}
+	sort.Slice(graph.Nodes, func(i, j int) bool { return graph.Nodes[i].ID < graph.Nodes[j].ID })
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		if graph.Edges[i].Source != graph.Edges[j].Source {
+			return graph.Edges[i].Source < graph.Edges[j].Source
+		}
+		return graph.Edges[i].Target < graph.Edges[j].Target
+	})
+	return graph
+}
+
+// LinkRename describes a renamed note or folder with slash separated paths
+// relative to the user root.
+type LinkRename struct {
+	From string
+	To   string
+	Dir  bool
+}
+
+// Map returns the new location of p after the rename. For a note this
+// includes the files in its ".attach" folder.
+func (m LinkRename) Map(p string) (string, bool) {
+	if p == m.From {
+		return m.To, true
+	}
+	from, to := m.From, m.To
+	if !m.Dir {
+		from, to = from+".attach", to+".attach"
+		if p == from {
+			return to, true
+		}
+	}
+	if rest, ok := strings.CutPrefix(p, from+"/"); ok {
+		return to + "/" + rest, true
+	}
+	return p, false
+}
+
+type linkRewrite struct {
+	Path       string
+	Content    string
+	NewContent string
+	Count      int
+}
+
+// planLinkRewrites returns the notes of user whose links or attachment
+// references change with rename, keyed by their path after the rename. It
+// must run before the rename, while wiki links still resolve to the old
+// location.
+func planLinkRewrites(user string, rename LinkRename) []linkRewrite {
+	userPrefix := user + string(filepath.Separator)
+
+	store.RLock()
+	defer store.RUnlock()
+
+	var rewrites []linkRewrite
+	for relPath, doc := range store.docs.Documents(user, true) {
+		if !strings.HasPrefix(relPath, userPrefix) {
+			continue
+		}
+		subPath := filepath.ToSlash(strings.TrimPrefix(relPath, userPrefix))
+		newSubPath, _ := rename.Map(subPath)
+		newContent, count := store.rewriteLinks(user, subPath, newSubPath, doc.Content, rename)
+		if count > 0 {
+			rewrites = append(rewrites, linkRewrite{Path: newSubPath, Content: doc.Content, NewContent: newContent, Count: count})
+		}
+	}
+	sort.Slice(rewrites, func(i, j int) bool { return rewrites[i].Path < rewrites[j].Path })
+	return rewrites
+}
+
+// rewriteLinks updates the links in the content of the note moving from
+// oldSubPath to newSubPath (which may be the same) and returns the number of
+// links changed. The caller must hold the read lock.
+func (s *InMemoryStore) rewriteLinks(user, oldSubPath, newSubPath, content string, rename LinkRename) (string, int) {
+	_, body, _ := splitFrontMatter(content)
+	frontMatter := content[:len(content)-len(body)]
+	oldDir, newDir := path.Dir(oldSubPath), path.Dir(newSubPath)
+
+	count := 0
+	body = mapProse(body, func(text string) string {
+		text = markdownLinkRe.ReplaceAllStringFunc(text, func(m string) string {
+			sub := markdownLinkRe.FindStringSubmatch(m)
+			target, ok := markdownLinkPath(oldDir, sub[2])
+			if !ok {
+				return m
+			}
+			newTarget, _ := rename.Map(target)
+			if linked, ok := markdownLinkPath(newDir, sub[2]); ok && linked == newTarget {
+				return m
+			}
+			count++
+			return sub[1] + formatLinkTarget(sub[2], newDir, newTarget) + sub[3]
+		})
+		return wikiLinkRe.ReplaceAllStringFunc(text, func(m string) string {
+			sub := wikiLinkRe.FindStringSubmatch(m)
+			name, ok := wikiLinkName(sub[1])
+			if !ok {
+				return m
+			}
+			resolved := s.resolveLink(user, oldSubPath, NoteLink{Kind: "wiki", Target: sub[1], Key: "[[" + noteName(name)})
+			moved, ok := rename.Map(resolved)
+			if resolved == "" || !ok {
+				return m
+			}
+
+			segments := strings.Split(strings.TrimSuffix(moved, path.Ext(moved)), "/")
+			keep := min(strings.Count(name, "/")+1, len(segments))
+			newName := strings.Join(segments[len(segments)-keep:], "/")
+			if strings.EqualFold(newName, name) {
+				return m
+			}
+
+			target, heading, _ := strings.Cut(sub[1], "#")
+			if strings.HasSuffix(strings.ToLower(strings.TrimSpace(target)), ".md") {
+				newName += ".md"
+			}
+			if heading != "" {
+				newName += "#" + heading
+			}
+			count++
+			if strings.HasPrefix(m, "!") {
+				return "![[" + newName + sub[2] + "]]"
+			}
+			return "[[" + newName + sub[2] + "]]"
+		})
+	})
+	return frontMatter + body, count
+}
+
+// formatLinkTarget writes a link to target from a note in dir, keeping the
+// style of the original link: root-relative or relative, URL-escaped or in
+// angle brackets, and its #fragment or ?query.
+func formatLinkTarget(original, dir, target string) string {
+	bracketed := strings.HasPrefix(original, "<")
+	original = strings.TrimSuffix(strings.TrimPrefix(original, "<"), ">")
+	suffix := ""
+	if i := strings.IndexAny(original, "#?"); i >= 0 {
+		suffix = original[i:]
+	}
+
+	link := "/" + target
+	if !strings.HasPrefix(original, "/") {
+		if rel, err := filepath.Rel(filepath.FromSlash(dir), filepath.FromSlash(target)); err == nil {
+			link = filepath.ToSlash(rel)
+		}
+	}
+	if strings.Contains(original, "%") {
+		link = (&url.URL{Path: link}).EscapedPath()
+	} else if strings.ContainsAny(link, " \t") {
+		bracketed = true
+	}
+
+	link += suffix
+	if bracketed {
+		return "<" + link + ">"
+	}
+	return link
+}
+
+// applyLinkRewrites writes the planned rewrites through saveDocument, so that
+// each one gets a version record. With dryRun it only reports the diffs.
+func applyLinkRewrites(user string, rewrites []linkRewrite, dryRun bool, comment string) []ReplaceFileResult {
+	results := make([]ReplaceFileResult, 0, len(rewrites))
+	for _, rewrite := range rewrites {
+		result := ReplaceFileResult{Path: rewrite.Path, Matches: rewrite.Count}
+		if dryRun {
+			result.Diff = lineDiff(rewrite.Content, rewrite.NewContent)
+		} else if sha1, _, err := saveDocument(user, rewrite.Path, rewrite.NewContent, comment); err != nil {
+			result.Error = err.Error()
+		} else {
+			result.SHA1 = sha1
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// --- check.go ---
+
+// CheckIssue is a link or file reference of the note at Path that points to
+// nothing.
+type CheckIssue struct {
+	Path string `json:"path"`
+	NoteLink
+}
+
+type ConsistencyReport struct {
+	User               string       `json:"user"`
+	BrokenLinks        []CheckIssue `json:"broken_links"`
+	MissingAttachments []CheckIssue `json:"missing_attachments"`
+	OrphanAttachments  []string     `json:"orphan_attachments"`
+	EmptyAttachDirs    []string     `json:"empty_attach_dirs"`
+	Moved              []string     `json:"moved,omitempty"`
+	Kept               []string     `json:"kept,omitempty"`
+	Removed            []string     `json:"removed,omitempty"`
+}
+
+// CheckUser reports the broken links, missing and orphan attachments and
+// empty ".attach" directories of user. An attachment is an orphan when the
+// note whose ".attach" directory holds it does not reference it. With
+// moveOrphans, orphans that no other note references either are moved to the
+// recycle bin, the others are kept, and ".attach" directories left without
+// files are removed.
+func CheckUser(user string, moveOrphans bool) (ConsistencyReport, error) {
+	report := ConsistencyReport{
+		User:               user,
+		BrokenLinks:        []CheckIssue{},
+		MissingAttachments: []CheckIssue{},
+		OrphanAttachments:  []string{},
+		EmptyAttachDirs:    []string{},
+	}
+	userDir := filepath.Join(AppConfig.MarkdownDir, user)
+	if info, err := os.Stat(userDir); err != nil || !info.IsDir() {
+		return report, fmt.Errorf("user directory not found: %s", user)
+	}
+
+	// ".attach" directory -> files below it, as slash separated user paths.
+	attachDirs := make(map[string][]string)
+	attachByName := make(map[string][]string)
+	filepath.WalkDir(userDir, func(fullPath string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if isInternalDir(d.Name()) {
+			return filepath.SkipDir
+		}
+		if !strings.HasSuffix(strings.ToLower(d.Name()), ".md.attach") {
+			return nil
+		}
+		rel, _ := filepath.Rel(userDir, fullPath)
+		dir := filepath.ToSlash(rel)
+		files := []string{}
+		filepath.WalkDir(fullPath, func(filePath string, f fs.DirEntry, err error) error {
+			if err == nil && !f.IsDir() {
+				rel, _ := filepath.Rel(userDir, filePath)
+				files = append(files, filepath.ToSlash(rel))
+				attachByName[f.Name()] = append(attachByName[f.Name()], filepath.ToSlash(rel))
+			}
+			return nil
+		})
+		attachDirs[dir] = files
+		return filepath.SkipDir
+	})
+
+	exists := func(subPath string) bool {
+		_, err := os.Stat(filepath.Join(userDir, filepath.FromSlash(subPath)))
+		return err == nil
+	}
+
+	// attachment -> the notes referencing it
+	referenced := make(map[string]map[string]bool)
+	userPrefix := user + string(filepath.Separator)
+	store.RLock()
+	for relPath, doc := range store.docs.Documents(user, true) {
+		if !strings.HasPrefix(relPath, userPrefix) {
+			continue
+		}
+		subPath := filepath.ToSlash(strings.TrimPrefix(relPath, userPrefix))
+		links, files := parseReferences(relPath, doc.Content)
+		for _, link := range links {
+			if store.resolveLink(user, subPath, link) == "" {
+				report.BrokenLinks = append(report.BrokenLinks, CheckIssue{Path: subPath, NoteLink: link})
+			}
+		}
+		for _, file := range files {
+			candidates := []string{file.Key}
+			if file.Kind == "embed" {
+				// Like Obsidian, an embed falls back to any file of that
+				// name, preferring the note's own attachments.
+				ownAttach := subPath + ".attach/"
+				candidates = []string{ownAttach + file.Key, path.Join(path.Dir(subPath), file.Key), file.Key}
+				byName := attachByName[path.Base(file.Key)]
+				for _, own := range []bool{true, false} {
+					for _, candidate := range byName {
+						if strings.HasPrefix(candidate, ownAttach) == own {
+							candidates = append(candidates, candidate)
+						}
+					}
+				}
+			}
+			found := false
+			for _, candidate := range candidates {
+				if exists(candidate) {
+					if referenced[candidate] == nil {
+						referenced[candidate] = make(map[string]bool)
+					}
+					referenced[candidate][subPath] = true
+					found = true
+					break
+				}
+			}
+			if !found {
+				report.MissingAttachments = append(report.MissingAttachments, CheckIssue{Path: subPath, NoteLink: file})
+			}
+		}
+	}
+	store.RUnlock()
+
+	for dir, files := range attachDirs {
+		if len(files) == 0 {
+			report.EmptyAttachDirs = append(report.EmptyAttachDirs, dir)
+		}
+		owner := strings.TrimSuffix(dir, ".attach")
+		for _, file := range files {
+			if !referenced[file][owner] {
+				report.OrphanAttachments = append(report.OrphanAttachments, file)
+			}
+		}
+	}
+	sortCheckIssues(report.BrokenLinks)
+	sortCheckIssues(report.MissingAttachments)
+	sort.Strings(report.OrphanAttachments)
+	sort.Strings(report.EmptyAttachDirs)
+
+	if moveOrphans {
+		for _, orphan := range report.OrphanAttachments {
+			if len(referenced[orphan]) > 0 {
+				report.Kept = append(report.Kept, orphan)
+				continue
+			}
+			if err := recycleAttachment(user, orphan); err != nil {
+				log.Printf("Failed to move orphan attachment %s of %s: %v", orphan, user, err)
+				continue
+			}
+			report.Moved = append(report.Moved, orphan)
+		}
+		for dir := range attachDirs {
+			fullPath := filepath.Join(userDir, filepath.FromSlash(dir))
+			if withWriteGate(func() error { return removeEmptyDir(fullPath) }) == nil {
+				report.Removed = append(report.Removed, dir)
+			}
+		}
+		sort.Strings(report.Removed)
+	}
+	return report, nil
+}
+
+func sortCheckIssues(issues []CheckIssue) {
+	sort.Slice(issues, func(i, j int) bool {
+		if issues[i].Path != issues[j].Path {
+			return issues[i].Path < issues[j].Path
+		}
+		return issues[i].Line < issues[j].Line
+	})
+}
+
+// recycleAttachment moves an attachment to the recycle bin, using the same
+// layout as deleted notes: .extra/.recycle/<sha1>/<name>.
+func recycleAttachment(user, subPath string) error {
+	_, fullPath, relPath, err := resolveUserPath(user, subPath)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(fullPath)
+	if err != nil {
+		return err
+	}
+	recycleDir := filepath.Join(AppConfig.MarkdownDir, user, ".extra", ".recycle", calculateSHA1(content))
+	if err := os.MkdirAll(recycleDir, 0755); err != nil {
+		return err
+	}
+	writeGate.RLock()
+	defer writeGate.RUnlock()
+	err = withGitCommit(user, "Move orphan attachment "+filepath.ToSlash(subPath)+" to the recycle bin", []string{subPath}, func() error {
+		return os.Rename(fullPath, filepath.Join(recycleDir, filepath.Base(fullPath)))
+	})
+	if err != nil {
+		return err
+	}
+	store.DeleteAttachments(relPath)
+	return nil
+}
+
+// removeEmptyDir removes dir if it holds nothing but empty folders. The
+// folders are removed deepest first with os.Remove, which fails on a folder
+// that is not empty, so a file written meanwhile is never deleted.
+func removeEmptyDir(dir string) error {
+	var dirs []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Remove(dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// --- commands.go ---
+
+// runCommand runs the command line subcommand in args and returns the exit
+// code. Global flags such as -markdown must come before the subcommand.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "check":
+		return runCheckCommand(args[1:])
+	case "backup":
+		return runBackupCommand(args[1:])
+	case "export":
+		return runExportCommand(args[1:])
+	case "import":
+		return runImportCommand(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q. Available commands: check, backup, export, import\n", args[0])
+		return 2
+	}
+}
+
+func runCheckCommand(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	user := flags.String("user", "", "Only check this user (default: all users)")
+	moveOrphans := flags.Bool("move-orphans", false, "Move orphan attachments to the recycle bin and remove empty .attach directories")
+	asJSON := flags.Bool("json", false, "Print the reports as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *moveOrphans {
+		lock := lockForCommand("stop it or use /api/check with move_orphans")
+		if lock == nil {
+			return 1
+		}
+		defer lock.Close()
+	}
+
+	users := []string{*user}
+	if *user == "" {
+		users = nil
+		entries, err := os.ReadDir(AppConfig.MarkdownDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read markdown dir: %v\n", err)
+			return 1
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				users = append(users, entry.Name())
+			}
+		}
+	}
+
+	log.SetOutput(io.Discard)
+	store.Scan()
+	log.SetOutput(os.Stderr)
+
+	reports := make([]ConsistencyReport, 0, len(users))
+	exitCode := 0
+	for _, u := range users {
+		report, err := CheckUser(u, *moveOrphans)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(report.BrokenLinks)+len(report.MissingAttachments)+len(report.OrphanAttachments)+len(report.EmptyAttachDirs) > 0 {
+			exitCode = 1
+		}
+		reports = append(reports, report)
+	}
+
+	if *asJSON {
+		data, _ := json.MarshalIndent(reports, "", "  ")
+		fmt.Println(string(data))
+		return exitCode
+	}
+	for _, report := range reports {
+		fmt.Printf("User %s\n", report.User)
+		for _, issue := range report.BrokenLinks {
+			fmt.Printf("  broken link          %s:%d -> %s\n", issue.Path, issue.Line, issue.Target)
+		}
+		for _, issue := range report.MissingAttachments {
+			fmt.Printf("  missing attachment   %s:%d -> %s\n", issue.Path, issue.Line, issue.Target)
+		}
+		for _, orphan := range report.OrphanAttachments {
+			fmt.Printf("  orphan attachment    %s\n", orphan)
+		}
+		for _, dir := range report.EmptyAttachDirs {
+			fmt.Printf("  empty .attach dir    %s\n", dir)
+		}
+		if *moveOrphans {
+			fmt.Printf("  moved %d orphan attachments to the recycle bin, removed %d empty .attach dirs\n", len(report.Moved), len(report.Removed))
+			for _, kept := range report.Kept {
+				fmt.Printf("  kept %s, which another note references\n", kept)
+			}
+		}
+	}
+	return exitCode
+}
+
+func runBackupCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: gonote backup list [-json] [--target name] | gonote backup restore <id> [--user X] [--path sub/dir] [--to dir] [--target name] [--identity file] | gonote backup verify [id] [--target name] [--identity file] [-json]")
+		return 2
+	}
+	switch args[0] {
+	case "list":
+		flags := flag.NewFlagSet("backup list", flag.ContinueOnError)
+		asJSON := flags.Bool("json", false, "Print the backups as JSON")
+		target := flags.String("target", "", "List the backups of this target instead of the first one")
+		flags.StringVar(&AppConfig.Backup.Identity, "identity", AppConfig.Backup.Identity, "age identity file that decrypts the backups")
+		if err := flags.Parse(args[1:]); err != nil {
+			return 2
+		}
+		backups, err := listBackups(*target)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if *asJSON {
+			data, _ := json.MarshalIndent(backups, "", "  ")
+			fmt.Println(string(data))
+			return 0
+		}
+		for _, backup := range backups {
+			fmt.Printf("%s  %6d files  %12d bytes  %6d new objects  %12d new bytes\n", backup.ID, backup.Files, backup.Size, backup.AddedFiles, backup.AddedSize)
+		}
+		return 0
+	case "restore":
+		flags := flag.NewFlagSet("backup restore", flag.ContinueOnError)
+		var opts BackupRestoreOptions
+		flags.StringVar(&opts.User, "user", "", "Only restore this user")
+		flags.StringVar(&opts.Path, "path", "", "Only restore this file or directory (relative to the user's root with --user)")
+		flags.StringVar(&opts.To, "to", "", "Extract into this directory instead of replacing the live files")
+		flags.StringVar(&opts.From, "target", "", "Restore from this backup target instead of the first one")
+		flags.StringVar(&AppConfig.Backup.Identity, "identity", AppConfig.Backup.Identity, "age identity file that decrypts the backups")
+		// Flags may come before or after the backup ID.
+		if err := flags.Parse(args[1:]); err != nil {
+			return 2
+		}
+		if flags.NArg() > 0 {
+			opts.ID = flags.Arg(0)
+			if err := flags.Parse(flags.Args()[1:]); err != nil {
+				return 2
+			}
+		}
+		if opts.ID == "" || flags.NArg() > 0 {
+			fmt.Fprintln(os.Stderr, "Usage: gonote backup restore <id> [--user X] [--path sub/dir] [--to dir] [--target name] [--identity file]")
+			return 2
+		}
+
+		if opts.To == "" {
+			lock := lockForCommand("stop it or restore through /api/admin/backups/restore, or use --to")
+			if lock == nil {
+				return 1
+			}
+			defer lock.Close()
+		}
+
+		log.SetOutput(io.Discard)
+		result, err := restoreBackup(opts)
+		log.SetOutput(os.Stderr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Restored %d files (%d bytes) from backup %s to %s\n", result.Files, result.Size, result.ID, result.Target)
+		if result.Replaced != "" {
+			fmt.Printf("The replaced files were moved to %s\n", result.Replaced)
+		}
+		return 0
+	case "verify":
+		flags := flag.NewFlagSet("backup verify", flag.ContinueOnError)
+		asJSON := flags.Bool("json", false, "Print the result as JSON")
+		target := flags.String("target", "", "Verify a backup of this target instead of the first one")
+		flags.StringVar(&AppConfig.Backup.Identity, "identity", AppConfig.Backup.Identity, "age identity file that decrypts the backups")
+		// Flags may come before or after the backup ID.
+		if err := flags.Parse(args[1:]); err != nil {
+			return 2
+		}
+		id := ""
+		if flags.NArg() > 0 {
+			id = flags.Arg(0)
+			if err := flags.Parse(flags.Args()[1:]); err != nil {
+				return 2
+			}
+		}
+		if flags.NArg() > 0 {
+			fmt.Fprintln(os.Stderr, "Usage: gonote backup verify [id] [--target name] [--identity file] [-json]")
+			return 2
+		}
+
+		result, err := verifyBackup(*target, id)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if *asJSON {
+			data, _ := json.MarshalIndent(result, "", "  ")
+			fmt.Println(string(data))
+		} else {
+			for _, problem := range result.Problems {
+				fmt.Println(problem)
+			}
+			fmt.Printf("Verified %d files (%d bytes) of backup %s: %d problem(s)\n", result.Files, result.Size, result.ID, len(result.Problems))
+		}
+		if len(result.Problems) > 0 {
+			return 1
+		}
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown backup command %q. Available commands: list, restore, verify\n", args[0])
+		return 2
+	}
+}
+
+func runExportCommand(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	user := flags.String("user", "", "Export the notes of this user")
+	var opts ExportOptions
+	flags.StringVar(&opts.Path, "path", "", "Only export this file or directory (relative to the user's root)")
+	flags.BoolVar(&opts.History, "history", false, "Include the past versions of the notes")
+	output := flags.String("o", "", "Write the zip archive to this file")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *user == "" || *output == "" || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: gonote export --user X [--path sub/dir] [--history] -o out.zip")
+		return 2
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	err = exportNotes(*user, opts, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*output)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("Exported to %s\n", *output)
+	return 0
+}
+
+func runImportCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	user := flags.String("user", "", "Import into the notes of this user")
+	dest := flags.String("path", "", "Import below this directory (relative to the user's root)")
+	format := flags.String("format", "auto", "Format of the source: "+strings.Join(importFormats, ", ")+" or auto")
+	asJSON := flags.Bool("json", false, "Print the result as JSON")
+	// Flags may come before or after the source.
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	source := ""
+	if flags.NArg() > 0 {
+		source = flags.Arg(0)
+		if err := flags.Parse(flags.Args()[1:]); err != nil {
+			return 2
+		}
+	}
+	if *user == "" || source == "" || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: gonote import <zip or directory> --user X [--path sub/dir] [--format name] [-json]")
+		return 2
+	}
+	lock := lockForCommand("stop it or import through /api/import")
+	if lock == nil {
+		return 1
+	}
+	defer lock.Close()
+
+	var src *importSource
+	info, err := os.Stat(source)
+	if err == nil && info.IsDir() {
+		src, err = readImportDir(source)
+	} else if err == nil {
+		var f *os.File
+		if f, err = os.Open(source); err == nil {
+			src, err = readImportZip(f, info.Size(), importMaxSize)
+			f.Close()
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer src.Close()
+
+	log.SetOutput(io.Discard)
+	store.Scan()
+	result, err := importNotes(*user, *dest, src, *format)
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *asJSON {
+		data, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		for _, skipped := range result.Skipped {
+			fmt.Printf("  skipped existing     %s\n", skipped)
+		}
+		for _, e := range result.Errors {
+			fmt.Printf("  error                %s\n", e)
+		}
+		fmt.Printf("Imported %d notes and %d files from %s\n", result.Notes, result.Files, result.Format)
+	}
+	if len(result.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// --- collab.go ---
+
+// textOperation is an operational transformation on a text, exchanged in the
+// JSON format of ot.js: a positive number retains, a negative number deletes
+// and a string inserts characters. Lengths and positions count UTF-16 code
+// units, like JavaScript string indices.
+type textOperation []otComponent
+
+type otComponent struct {
+	Retain int
+	Delete int
+	Insert []uint16
+}
+
+func (op *textOperation) retain(n int) {
+	if n <= 0 {
+		return
+	}
+	if last := len(*op) - 1; last >= 0 && (*op)[last].Retain > 0 {
+		(*op)[last].Retain += n
+		return
+	}
+	*op = append(*op, otComponent{Retain: n})
+}
+
+func (op *textOperation) delete(n int) {
+	if n <= 0 {
+		return
+	}
+	if last := len(*op) - 1; last >= 0 && (*op)[last].Delete > 0 {
+		(*op)[last].Delete += n
+		return
+	}
+	*op = append(*op, otComponent{Delete: n})
+}
+
+// insert adds text, keeping inserts before deletes at the same position so
+// that equal operations have a single representation.
+func (op *textOperation) insert(text []uint16) {
+	if len(text) == 0 {
+		return
+	}
+	last := len(*op) - 1
+	if last >= 0 && (*op)[last].Insert != nil {
+		(*op)[last].Insert = append(append([]uint16{}, (*op)[last].Insert...), text...)
+		return
+	}
+	if last >= 0 && (*op)[last].Delete > 0 {
+		if last > 0 && (*op)[last-1].Insert != nil {
+			(*op)[last-1].Insert = append(append([]uint16{}, (*op)[last-1].Insert...), text...)
+			return
+		}
+		*op = append(*op, (*op)[last])
+		(*op)[last] = otComponent{Insert: text}
+		return
+	}
+	*op = append(*op, otComponent{Insert: text})
+}
+
+func (op textOperation) baseLen() int {
+	n := 0
+	for _, c := range op {
+		n += c.Retain + c.Delete
+	}
+	return n
+}
+
+func (op textOperation) isNoop() bool {
+	for _, c := range op {
+		if c.Delete > 0 || c.Insert != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (op textOperation) MarshalJSON() ([]byte, error) {
+	raw := make([]interface{}, 0, len(op))
+	for _, c := range op {
+		switch {
+		case c.Retain > 0:
+			raw = append(raw, c.Retain)
+		case c.Delete > 0:
+			raw = append(raw, -c.Delete)
+		default:
+			raw = append(raw, string(utf16.Decode(c.Insert)))
+		}
+	}
+	return json.Marshal(raw)
+}
+
+func (op *textOperation) UnmarshalJSON(data []byte) error {
+	var raw []interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*op = nil
+	for _, item := range raw {
+		switch v := item.(type) {
+		case float64:
+			if v != math.Trunc(v) || v == 0 {
+				return fmt.Errorf("invalid operation component %v", v)
+			}
+			if v > 0 {
+				op.retain(int(v))
+			} else {
+				op.delete(int(-v))
+			}
+		case string:
+			op.insert(utf16.Encode([]rune(v)))
+		default:
+			return fmt.Errorf("invalid operation component %v", v)
+		}
+	}
+	return nil
+}
+
+// apply returns the text produced by applying op to text.
+func (op textOperation) apply(text []uint16) ([]uint16, error) {
+	if op.baseLen() != len(text) {
+		return nil, fmt.Errorf("operation length %d does not match document length %d", op.baseLen(), len(text))
+	}
+	result := make([]uint16, 0, len(text))
+	pos := 0
+	for _, c := range op {
+		switch {
+		case c.Retain > 0:
+			result = append(result, text[pos:pos+c.Retain]...)
+			pos += c.Retain
+		case c.Delete > 0:
+			pos += c.Delete
+		default:
+			result = append(result, c.Insert...)
+		}
+	}
+	return result, nil
+}
+
+// transformOps transforms the concurrent operations a and b, which apply to
+// the same text, into a1 and b1 such that applying a then b1 gives the same
+// text as b then a1. Inserts of a go first when both insert at one position.
+func transformOps(a, b textOperation) (a1, b1 textOperation, err error) {
+	if a.baseLen() != b.baseLen() {
+		return nil, nil, errors.New("concurrent operations have different base lengths")
+	}
+	i, j := 0, 0
+	var ca, cb otComponent
+	next := func(op textOperation, k *int) otComponent {
+		if *k < len(op) {
+			*k++
+			return op[*k-1]
+		}
+		return otComponent{}
+	}
+	isEmpty := func(c otComponent) bool { return c.Retain == 0 && c.Delete == 0 && c.Insert == nil }
+	ca, cb = next(a, &i), next(b, &j)
+
+	for !isEmpty(ca) || !isEmpty(cb) {
+		if ca.Insert != nil {
+			a1.insert(ca.Insert)
+			b1.retain(len(ca.Insert))
+			ca = next(a, &i)
+			continue
+		}
+		if cb.Insert != nil {
+			a1.retain(len(cb.Insert))
+			b1.insert(cb.Insert)
+			cb = next(b, &j)
+			continue
+		}
+		if isEmpty(ca) || isEmpty(cb) {
+			return nil, nil, errors.New("operations cannot be transformed")
+		}
+
+		n := min(ca.Retain+ca.Delete, cb.Retain+cb.Delete)
+		switch {
+		case ca.Retain > 0 && cb.Retain > 0:
+			a1.retain(n)
+			b1.retain(n)
+		case ca.Delete > 0 && cb.Retain > 0:
+			a1.delete(n)
+		case ca.Retain > 0 && cb.Delete > 0:
+			b1.delete(n)
+		}
+		ca, cb = shortenComponent(ca, n), shortenComponent(cb, n)
+		if isEmpty(ca) {
+			ca = next(a, &i)
+		}
+		if isEmpty(cb) {
+			cb = next(b, &j)
+		}
+	}
+	return a1, b1, nil
+}
+
+func shortenComponent(c otComponent, n int) otComponent {
+	if c.Retain > 0 {
+		c.Retain -= n
+	} else {
+		c.Delete -= n
+	}
+	return c
+}
+
+// transformPosition moves a cursor position over op. Text inserted at the
+// cursor pushes it forward.
+func (op textOperation) transformPosition(pos int) int {
+	index, newPos := 0, pos
+	for _, c := range op {
+		if index > pos {
+			break
+		}
+		switch {
+		case c.Retain > 0:
+			index += c.Retain
+		case c.Delete > 0:
+			newPos -= min(pos-index, c.Delete)
+			index += c.Delete
+		default:
+			newPos += len(c.Insert)
+		}
+	}
+	return newPos
+}
+
+// diffOperation returns an operation that turns oldText into newText.
+func diffOperation(oldText, newText string) textOperation {
+	dmp := diffmatchpatch.New()
+	var op textOperation
+	for _, d := range dmp.DiffMain(oldText, newText, false) {
+		units := utf16.Encode([]rune(d.Text))
+		switch d.Type {
+		case diffmatchpatch.DiffEqual:
+			op.retain(len(units))
+		case diffmatchpatch.DiffDelete:
+			op.delete(len(units))
+		case diffmatchpatch.DiffInsert:
+			op.insert(units)
+		}
+	}
+	return op
+}
+
+const (
+	collabFlushDelay    = 2 * time.Second
+	collabMaxFlushDelay = 10 * time.Second
+	collabMaxMessage    = 8 << 20
+	collabPingInterval  = 30 * time.Second
+)
+
+type collabCursor struct {
+	Position     int `json:"position"`
+	SelectionEnd int `json:"selection_end"`
+}
+
+type collabPeer struct {
+	ClientID string        `json:"client_id"`
+	User     string        `json:"user"`
+	Cursor   *collabCursor `json:"cursor,omitempty"`
+}
+
+// collabMessage is the union of the messages exchanged over the
+// collaboration WebSocket.
+type collabMessage struct {
+	Type     string        `json:"type"`
+	Rev      int           `json:"rev"`
+	Op       textOperation `json:"op,omitempty"`
+	Cursor   *collabCursor `json:"cursor,omitempty"`
+	ClientID string        `json:"client_id,omitempty"`
+	User     string        `json:"user,omitempty"`
+	Content  *string       `json:"content,omitempty"`
+	SHA1     string        `json:"sha1,omitempty"`
+	Path     string        `json:"path,omitempty"`
+	Peers    []collabPeer  `json:"peers,omitempty"`
+	Message  string        `json:"message,omitempty"`
+}
+
+type collabClient struct {
+	id     string
+	user   string
+	conn   *websocket.Conn
+	send   chan collabMessage
+	cursor *collabCursor
+}
+
+// collabSession holds the authoritative state of a document edited over
+// WebSocket. Client operations are transformed against the history since
+// the revision they were based on, applied and broadcast. The text is
+// flushed through saveDocument once editing pauses, and changes made to the
+// file by others are merged in as operations of the server. user is the
+// owner of the note; clients of other users join the same session.
+type collabSession struct {
+	mu      sync.Mutex
+	user    string
+	subPath string
+	relPath string
+
+	text    []uint16
+	history []textOperation
+	clients map[*collabClient]bool
+	nextID  int
+
+	// savedText and savedRev describe the content last written to disk.
+	savedText []uint16
+	savedRev  int
+	savedSHA1 string
+	editors   map[string]bool
+
+	flushTimer *time.Timer
+	dirtySince time.Time
+	events     chan FileEvent
+	closed     bool
+
+	// flushing is set while a write runs without the session lock, and
+	// mergePending when an external change arrived during that write.
+	flushing     bool
+	mergePending bool
+}
+
+// collabFlush is a write of the session's text started by startFlush.
+type collabFlush struct {
+	subPath      string
+	text         []uint16
+	rev          int
+	sha1         string
+	previousSHA1 string
+	editors      map[string]bool
+}
+
+// canCollab reports whether user may edit the notes of owner in a
+// collaboration session.
+func canCollab(user, owner string) bool {
+	return user == owner || slices.Contains(AppConfig.Collab.Share[owner], user)
+}
+
+var collabSessions = struct {
+	sync.Mutex
+	sessions map[string]*collabSession
+}{sessions: make(map[string]*collabSession)}
+
+// joinCollabSession adds a client of user to the session of the note of
+// owner, creating the session from the cached content if needed.
+func joinCollabSession(owner, user, subPath string, conn *websocket.Conn) (*collabSession, *collabClient) {
+	_, _, relPath, _ := resolveUserPath(owner, subPath)
+
+	collabSessions.Lock()
+	defer collabSessions.Unlock()
+	session := collabSessions.sessions[relPath]
+	if session == nil {
+		store.RLock()
+		doc, _ := store.docs.Get(relPath)
+		store.RUnlock()
+
+		text := utf16.Encode([]rune(doc.Content))
+		session = &collabSession{
+			user:      owner,
+			subPath:   filepath.ToSlash(subPath),
+			relPath:   relPath,
+			text:      text,
+			clients:   make(map[*collabClient]bool),
+			savedText: text,
+			savedSHA1: doc.SHA1,
+			editors:   make(map[string]bool),
+			events:    fileEvents.Subscribe(owner),
+		}
+		collabSessions.sessions[relPath] = session
+		go session.watchFileEvents()
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.nextID++
+	client := &collabClient{
+		id:   fmt.Sprintf("c%d", session.nextID),
+		user: user,
+		conn: conn,
+		send: make(chan collabMessage, 256),
+	}
+
+	content := string(utf16.Decode(session.text))
+	peers := []collabPeer{}
+	for peer := range session.clients {
+		peers = append(peers, collabPeer{ClientID: peer.id, User: peer.user, Cursor: peer.cursor})
+	}
+	client.send <- collabMessage{Type: "init", Rev: len(session.history), Content: &content, SHA1: calculateSHA1([]byte(content)), ClientID: client.id, User: client.user, Path: session.subPath, Peers: peers}
+	session.clients[client] = true
+	session.broadcast(client, collabMessage{Type: "join", ClientID: client.id, User: client.user})
+	return session, client
+}
+
+// broadcast sends msg to every client of the session except except. The
+// caller must hold the session lock.
+func (s *collabSession) broadcast(except *collabClient, msg collabMessage) {
+	for client := range s.clients {
+		if client != except {
+			client.enqueue(msg)
+		}
+	}
+}
+
+// enqueue queues msg for the client. A client that cannot keep up is
+// disconnected and has to reconnect.
+func (c *collabClient) enqueue(msg collabMessage) {
+	select {
+	case c.send <- msg:
+	default:
+		c.conn.Close()
+	}
+}
+
+// receive applies an operation of the client based on revision rev.
+func (s *collabSession) receive(client *collabClient, rev int, op textOperation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rev < 0 || rev > len(s.history) {
+		return fmt.Errorf("invalid revision %d", rev)
+	}
+	if err := s.apply(op, rev, client.id); err != nil {
+		return err
+	}
+	s.editors[client.user] = true
+	client.enqueue(collabMessage{Type: "ack", Rev: len(s.history)})
+	s.scheduleFlush()
+	return nil
+}
+
+// apply transforms op from revision rev to the current one, applies it and
+// broadcasts it to every client except the author. The caller must hold the
+// session lock.
+func (s *collabSession) apply(op textOperation, rev int, author string) error {
+	for _, concurrent := range s.history[rev:] {
+		var err error
+		if op, _, err = transformOps(op, concurrent); err != nil {
+			return err
+		}
+	}
+	text, err := op.apply(s.text)
+	if err != nil {
+		return err
+	}
+	s.text = text
+	s.history = append(s.history, op)
+
+	for client := range s.clients {
+		// Cursors are shared with the writers of other clients and are
+		// replaced rather than modified.
+		if client.cursor != nil && client.id != author {
+			client.cursor = &collabCursor{
+				Position:     op.transformPosition(client.cursor.Position),
+				SelectionEnd: op.transformPosition(client.cursor.SelectionEnd),
+			}
+		}
+		if client.id != author {
+			client.enqueue(collabMessage{Type: "op", Rev: len(s.history), Op: op, ClientID: author})
+		}
+	}
+	return nil
+}
+
+// moveCursor records the cursor of the client, given at revision rev, and
+// shares it with the other clients.
+func (s *collabSession) moveCursor(client *collabClient, rev int, cursor *collabCursor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cursor == nil || rev < 0 || rev > len(s.history) {
+		return errors.New("invalid cursor")
+	}
+	for _, op := range s.history[rev:] {
+		cursor.Position = op.transformPosition(cursor.Position)
+		cursor.SelectionEnd = op.transformPosition(cursor.SelectionEnd)
+	}
+	cursor.Position = max(0, min(cursor.Position, len(s.text)))
+	cursor.SelectionEnd = max(0, min(cursor.SelectionEnd, len(s.text)))
+	client.cursor = cursor
+	s.broadcast(client, collabMessage{Type: "cursor", Rev: len(s.history), ClientID: client.id, User: client.user, Cursor: cursor})
+	return nil
+}
+
+// scheduleFlush writes the text once editing pauses for collabFlushDelay,
+// but at least every collabMaxFlushDelay while edits keep coming. The caller
+// must hold the session lock.
+func (s *collabSession) scheduleFlush() {
+	if s.dirtySince.IsZero() {
+		s.dirtySince = time.Now()
+	}
+	delay := min(collabFlushDelay, max(0, collabMaxFlushDelay-time.Since(s.dirtySince)))
+	if s.flushTimer == nil {
+		s.flushTimer = time.AfterFunc(delay, func() {
+			var flush *collabFlush
+			s.mu.Lock()
+			if !s.closed {
+				flush = s.startFlush()
+			}
+			s.mu.Unlock()
+			s.writeFlush(flush)
+		})
+		return
+	}
+	s.flushTimer.Reset(delay)
+}
+
+// startFlush prepares writing the text if it changed since the last write
+// and no other write is running. The caller must hold the session lock and
+// pass the result to writeFlush once it has released the lock.
+func (s *collabSession) startFlush() *collabFlush {
+	if s.flushing || len(s.history) == s.savedRev {
+		return nil
+	}
+	content := string(utf16.Decode(s.text))
+	flush := &collabFlush{
+		subPath:      s.subPath,
+		text:         s.text,
+		rev:          len(s.history),
+		sha1:         calculateSHA1([]byte(content)),
+		previousSHA1: s.savedSHA1,
+		editors:      s.editors,
+	}
+	// The change event of the write must not be merged as an external
+	// change.
+	s.savedSHA1 = flush.sha1
+	s.editors = make(map[string]bool)
+	s.flushing = true
+	return flush
+}
+
+// writeFlush writes the text through saveDocument, which records a version
+// and updates the cache, without holding the session lock. Edits made
+// meanwhile are written by the next flush, and external changes that arrived
+// meanwhile are merged afterwards.
+func (s *collabSession) writeFlush(flush *collabFlush) {
+	for flush != nil {
+		editors := make([]string, 0, len(flush.editors))
+		for editor := range flush.editors {
+			editors = append(editors, editor)
+		}
+		sort.Strings(editors)
+		comment := "Collaborative edit"
+		if len(editors) > 0 {
+			comment += " by " + strings.Join(editors, ", ")
+		}
+		sha1, _, err := saveDocument(s.user, flush.subPath, string(utf16.Decode(flush.text)), comment)
+
+		s.mu.Lock()
+		s.flushing = false
+		if err != nil {
+			s.savedSHA1 = flush.previousSHA1
+			for editor := range flush.editors {
+				s.editors[editor] = true
+			}
+			log.Printf("Failed to save collaborative edit of %s: %v", s.relPath, err)
+			s.broadcast(nil, collabMessage{Type: "error", Message: "Failed to save: " + err.Error()})
+			s.mu.Unlock()
+			return
+		}
+		s.savedText = flush.text
+		s.savedRev = flush.rev
+		s.broadcast(nil, collabMessage{Type: "saved", Rev: s.savedRev, SHA1: sha1})
+
+		flush = nil
+		dirty := len(s.history) > s.savedRev
+		switch {
+		case s.mergePending && !s.closed:
+			s.mergePending = false
+			flush = s.mergeExternal()
+		case dirty && s.closed:
+			flush = s.startFlush()
+		case dirty:
+			s.scheduleFlush()
+		default:
+			s.dirtySince = time.Time{}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// watchFileEvents merges changes made to the file outside the session.
+func (s *collabSession) watchFileEvents() {
+	for event := range s.events {
+		var flush *collabFlush
+		collabSessions.Lock()
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			collabSessions.Unlock()
+			return
+		}
+		switch {
+		case event.Type == "renamed" && event.OldPath == s.subPath:
+			if collabSessions.sessions[s.relPath] == s {
+				delete(collabSessions.sessions, s.relPath)
+			}
+			_, _, s.relPath, _ = resolveUserPath(s.user, event.Path)
+			s.subPath = event.Path
+			collabSessions.sessions[s.relPath] = s
+			s.broadcast(nil, collabMessage{Type: "renamed", Path: s.subPath})
+			flush = s.mergeExternal()
+		case event.Path != s.subPath:
+		case event.Type == "deleted":
+			if collabSessions.sessions[s.relPath] == s {
+				delete(collabSessions.sessions, s.relPath)
+			}
+			s.closed = true
+			s.broadcast(nil, collabMessage{Type: "deleted", Path: s.subPath})
+			for client := range s.clients {
+				client.conn.Close()
+			}
+		case event.SHA1 != s.savedSHA1:
+			flush = s.mergeExternal()
+		}
+		s.mu.Unlock()
+		collabSessions.Unlock()
+		s.writeFlush(flush)
+	}
+}
+
+// mergeExternal applies the difference between the last saved text and the
+// cached content as an operation of the server based on the saved revision,
+// so that concurrent edits of the clients are kept, and returns the write of
+// the result. While a write runs, the merge is postponed until it ends. The
+// caller must hold the session lock.
+func (s *collabSession) mergeExternal() *collabFlush {
+	if s.flushing {
+		s.mergePending = true
+		return nil
+	}
+	store.RLock()
+	doc, ok := store.docs.Get(s.relPath)
+	store.RUnlock()
+	if !ok || doc.SHA1 == s.savedSHA1 {
+		return nil
+	}
+
+	op := diffOperation(string(utf16.Decode(s.savedText)), doc.Content)
+	if err := s.apply(op, s.savedRev, "server"); err != nil {
+		log.Printf("Failed to merge external change of %s: %v", s.relPath, err)
+		return nil
+	}
+	s.savedText = utf16.Encode([]rune(doc.Content))
+	s.savedSHA1 = doc.SHA1
+	return s.startFlush()
+}
+
+// leave removes the client. The last client to leave writes pending edits
+// and ends the session.
+func (s *collabSession) leave(client *collabClient) {
+	var flush *collabFlush
+	defer func() { s.writeFlush(flush) }()
+	collabSessions.Lock()
+	defer collabSessions.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.clients, client)
+	close(client.send)
+	s.broadcast(nil, collabMessage{Type: "leave", ClientID: client.id, User: client.user})
+	if len(s.clients) > 0 {
+		return
+	}
+	if !s.closed {
+		flush = s.startFlush()
+	}
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+	}
+	s.closed = true
+	fileEvents.Unsubscribe(s.user, s.events)
+	close(s.events)
+	if collabSessions.sessions[s.relPath] == s {
+		delete(collabSessions.sessions, s.relPath)
+	}
+}
+
+func (c *collabClient) writeLoop() {
+	ping := time.NewTicker(collabPingInterval)
+	defer ping.Stop()
+	defer c.conn.Close()
+	for {
+		select {
+		case msg, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			if err := c.conn.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-ping.C:
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// --- semantic.go ---
+
+const embeddingChunkBucket = "chunks"
+const embeddingDocBucket = "docs"
+
+// EmbeddingProvider turns texts into vectors. Name identifies the provider
+// and model; stored vectors are recomputed when it changes.
+type EmbeddingProvider interface {
+	Name() string
+	Embed(texts []string) ([][]float32, error)
+}
+
+// HashEmbedder is a dependency-free embedder based on feature hashing of
+// words and CJK character bigrams. It captures lexical overlap rather than
+// meaning, but works fully offline.
+type HashEmbedder struct {
+	Dimensions int
+}
+
+func (h *HashEmbedder) Name() string {
+	return fmt.Sprintf("hash-%d", h.Dimensions)
+}
+
+func (h *HashEmbedder) Embed(texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vec := make([]float32, h.Dimensions)
+		counts := make(map[string]int)
+		for _, token := range embeddingTokens(text) {
+			counts[token]++
+		}
+		for token, n := range counts {
+			hasher := fnv.New32a()
+			hasher.Write([]byte(token))
+			sum := hasher.Sum32()
+			weight := float32(1 + math.Log(float64(n)))
+			if sum&0x80000000 != 0 {
+				weight = -weight
+			}
+			vec[int(sum%uint32(h.Dimensions))] += weight
+		}
+		normalizeVector(vec)
+		vectors[i] = vec
+	}
+	return vectors, nil
+}
+
+func embeddingTokens(text string) []string {
+	var tokens []string
+	var word []rune
+	var prevCJK rune
+	flush := func() {
+		if len(word) > 1 {
+			tokens = append(tokens, string(word))
+		}
+		word = word[:0]
+	}
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r):
+			flush()
+			tokens = append(tokens, string(r))
+			if prevCJK != 0 {
+				tokens = append(tokens, string([]rune{prevCJK, r}))
+			}
+			prevCJK = r
+			continue
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word = append(word, r)
+		default:
+			flush()
+		}
+		prevCJK = 0
+	}
+	flush()
+	return tokens
+}
+
+// OpenAIEmbedder talks to any server that implements the OpenAI embeddings
+// API (POST {url} with {"model", "input"}), such as a local model server.
+type OpenAIEmbedder struct {
+	URL    string
+	Model  string
+	APIKey string
+	client *http.Client
+}
+
+func (o *OpenAIEmbedder) Name() string {
+	return "openai:" + o.Model
+}
+
+func (o *OpenAIEmbedder) Embed(texts []string) ([][]float32, error) {
+	body, err := json.Marshal(map[string]interface{}{"model": o.Model, "input": texts})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, o.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if o.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+o.APIKey)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("embedding request failed: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var result struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid embedding response: %w", err)
+	}
+	if len(result.Data) != len(texts) {
+		return nil, fmt.Errorf("embedding response has %d vectors for %d inputs", len(result.Data), len(texts))
+	}
+	vectors := make([][]float32, len(texts))
+	for _, item := range result.Data {
+		if item.Index < 0 || item.Index >= len(texts) {
+			return nil, fmt.Errorf("embedding response has invalid index %d", item.Index)
+		}
+		normalizeVector(item.Embedding)
+		vectors[item.Index] = item.Embedding
+	}
+	return vectors, nil
+}
+
+func NewEmbeddingProvider(cfg EmbeddingConfig) (EmbeddingProvider, error) {
+	switch cfg.Provider {
+	case "", "hash":
+		dims := cfg.Dimensions
+		if dims <= 0 {
+			dims = 256
+		}
+		return &HashEmbedder{Dimensions: dims}, nil
+	case "openai":
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("embedding provider 'openai' requires a url")
+		}
+		return &OpenAIEmbedder{URL: cfg.URL, Model: cfg.Model, APIKey: cfg.APIKey, client: &http.Client{Timeout: 2 * time.Minute}}, nil
+	}
+	return nil, fmt.Errorf("unknown embedding provider %q", cfg.Provider)
+}
+
+func normalizeVector(vec []float32) {
+	var sum float64
+	for _, v := range vec {
+		sum += float64(v) * float64(v)
+	}
+	if sum == 0 {
+		return
+	}
+	norm := float32(math.Sqrt(sum))
+	for i := range vec {
+		vec[i] /= norm
+	}
+}
+
+func dotProduct(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var sum float64
+	for i := range a {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
+
+// chunkDocument splits content into pieces of at most size runes, breaking at
+// blank lines where possible. The note's title is prefixed to every chunk so
+// that each one carries some context of its own.
+func chunkDocument(title, content string, size int) []string {
+	var chunks []string
+	var current strings.Builder
+	currentLen := 0
+	emit := func() {
+		if text := strings.TrimSpace(current.String()); text != "" {
+			chunks = append(chunks, title+"\n\n"+text)
+		}
+		current.Reset()
+		currentLen = 0
+	}
+	for _, para := range strings.Split(content, "\n\n") {
+		runes := []rune(para)
+		for len(runes) > size {
+			emit()
+			current.WriteString(string(runes[:size]))
+			currentLen = size
+			runes = runes[size:]
+		}
+		if currentLen+len(runes) > size {
+			emit()
+		}
+		current.WriteString(string(runes))
+		current.WriteString("\n\n")
+		currentLen += len(runes) + 2
+	}
+	emit()
+	if len(chunks) == 0 {
+		chunks = append(chunks, title)
+	}
+	return chunks
+}
+
+type embeddedChunk struct {
+	Text   string    `json:"text"`
+	Vector []float32 `json:"vector"`
+}
+
+type embeddedDocState struct {
+	SHA1     string `json:"sha1"`
+	Provider string `json:"provider"`
+}
+
+// SemanticIndex keeps chunk embeddings for every document in each user's
+// .extra/embeddings.db. Documents are (re)embedded asynchronously after the
+// store reports a change; queries read the vectors from an in-memory copy.
+type SemanticIndex struct {
+	provider  EmbeddingProvider
+	chunkSize int
+
+	mu      sync.Mutex
+	pending map[string]bool
+	wake    chan struct{}
+
+	dbMu    sync.Mutex
+	dbs     map[string]*bbolt.DB
+	vectors map[string]map[string][]embeddedChunk // user -> relPath -> chunks
+}
+
+var semanticIndex *SemanticIndex
+
+func StartSemanticIndex() {
+	if !AppConfig.Embedding.Enabled {
+		log.Println("Semantic search is disabled.")
+		return
+	}
+	provider, err := NewEmbeddingProvider(AppConfig.Embedding)
+	if err != nil {
+		log.Fatalf("FATAL: Invalid embedding configuration: %v", err)
+	}
+	chunkSize := AppConfig.Embedding.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = 1000
+	}
+	idx := &SemanticIndex{
+		provider:  provider,
+		chunkSize: chunkSize,
+		pending:   make(map[string]bool),
+		wake:      make(chan struct{}, 1),
+		dbs:       make(map[string]*bbolt.DB),
+		vectors:   make(map[string]map[string][]embeddedChunk),
+	}
+
+	store.RLock()
+	for relPath := range store.docs.Documents("", false) {
+		idx.pending[relPath] = true
+	}
+	store.RUnlock()
+	// Notes deleted while the server was down are still in the embeddings
+	// databases. indexDoc drops the vectors of notes that are not cached.
+	for _, relPath := range idx.indexedDocuments() {
+		idx.pending[relPath] = true
+	}
+
+	semanticIndex = idx
+	log.Printf("Semantic index started with provider '%s'.", provider.Name())
+	go idx.run()
+	idx.Enqueue("")
+}
+
+// indexedDocuments returns the notes that have vectors in the existing
+// embeddings databases.
+func (idx *SemanticIndex) indexedDocuments() []string {
+	users, err := os.ReadDir(AppConfig.MarkdownDir)
+	if err != nil {
+		return nil
+	}
+	idx.dbMu.Lock()
+	defer idx.dbMu.Unlock()
+	var docs []string
+	for _, entry := range users {
+		user := entry.Name()
+		dbPath := filepath.Join(AppConfig.MarkdownDir, user, ".extra", "embeddings.db")
+		if _, err := os.Stat(dbPath); err != nil {
+			continue
+		}
+		db, err := idx.db(user)
+		if err != nil {
+			log.Printf("Could not open the embeddings of %s: %v", user, err)
+			continue
+		}
+		db.View(func(tx *bbolt.Tx) error {
+			for _, bucket := range []string{embeddingDocBucket, embeddingChunkBucket} {
+				tx.Bucket([]byte(bucket)).ForEach(func(k, _ []byte) error {
+					docs = append(docs, filepath.Join(user, filepath.FromSlash(string(k))))
+					return nil
+				})
+			}
+			return nil
+		})
+	}
+	return docs
+}
+
+// Enqueue schedules relPath for (re)embedding. It is safe to call on a nil
+// index, which is how the store calls it when semantic search is disabled.
+func (idx *SemanticIndex) Enqueue(relPath string) {
+	if idx == nil {
+		return
+	}
+	idx.mu.Lock()
+	if relPath != "" {
+		idx.pending[relPath] = true
+	}
+	idx.mu.Unlock()
+	select {
+	case idx.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Release closes the embeddings databases of users (all users if nil) and
+// forgets their vectors while fn replaces their files. It is safe to call on
+// a nil index.
+func (idx *SemanticIndex) Release(users []string, fn func() error) error {
+	if idx == nil {
+		return fn()
+	}
+	released := make(map[string]bool)
+	for _, user := range users {
+		released[user] = true
+	}
+	idx.dbMu.Lock()
+	defer idx.dbMu.Unlock()
+	for user, db := range idx.dbs {
+		if users == nil || released[user] {
+			db.Close()
+			delete(idx.dbs, user)
+			delete(idx.vectors, user)
+		}
+	}
+	return fn()
+}
+
+// EnqueueUsers schedules every document of users (all users if nil) for
+// (re)embedding.
+func (idx *SemanticIndex) EnqueueUsers(users []string) {
+	if idx == nil {
+		return
+	}
+	scopes := users
+	if scopes == nil {
+		scopes = []string{""}
+	}
+	store.RLock()
+	idx.mu.Lock()
+	for _, scope := range scopes {
+		for relPath := range store.docs.Documents(scope, false) {
+			idx.pending[relPath] = true
+		}
+	}
+	idx.mu.Unlock()
+	store.RUnlock()
+	idx.Enqueue("")
+}
+
+func (idx *SemanticIndex) run() {
+	for range idx.wake {
+		for {
+			idx.mu.Lock()
+			var relPath string
+			for p := range idx.pending {
+				relPath = p
+				break
+			}
+			if relPath == "" {
+				idx.mu.Unlock()
+				break
+			}
+			delete(idx.pending, relPath)
+			idx.mu.Unlock()
+
+			if err := idx.indexDoc(relPath); err != nil {
+				log.Printf("Error embedding %s: %v", relPath, err)
+			}
+		}
+	}
+}
+
+func splitUserPath(relPath string) (user, subPath string) {
+	user, subPath, _ = strings.Cut(relPath, string(filepath.Separator))
+	return user, subPath
+}
+
+func (idx *SemanticIndex) db(user string) (*bbolt.DB, error) {
+	if db, ok := idx.dbs[user]; ok {
+		return db, nil
+	}
+	dbPath := filepath.Join(AppConfig.MarkdownDir, user, ".extra", "embeddings.db")
+	os.MkdirAll(filepath.Dir(dbPath), 0755)
+	db, err := bbolt.Open(dbPath, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists([]byte(embeddingChunkBucket)); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists([]byte(embeddingDocBucket))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	idx.dbs[user] = db
+	return db, nil
+}
+
+// userVectors returns the in-memory vectors of user, loading them from disk
+// on first use. The caller must hold dbMu.
+func (idx *SemanticIndex) userVectors(user string) (map[string][]embeddedChunk, error) {
+	if vectors, ok := idx.vectors[user]; ok {
+		return vectors, nil
+	}
+	db, err := idx.db(user)
+	if err != nil {
+		return nil, err
+	}
+	vectors := make(map[string][]embeddedChunk)
+	err = db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(embeddingChunkBucket)).ForEach(func(k, v []byte) error {
+			var chunks []embeddedChunk
+			if err := json.Unmarshal(v, &chunks); err == nil {
+				vectors[string(k)] = chunks
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	idx.vectors[user] = vectors
+	return vectors, nil
+}
+
+func (idx *SemanticIndex) indexDoc(relPath string) error {
+	user, subPath := splitUserPath(relPath)
+	key := []byte(filepath.ToSlash(subPath))
+
+	store.RLock()
+	doc, exists := store.docs.Get(relPath)
+	store.RUnlock()
+
+	idx.dbMu.Lock()
+	db, err := idx.db(user)
+	if err != nil {
+		idx.dbMu.Unlock()
+		return err
+	}
+	var state embeddedDocState
+	db.View(func(tx *bbolt.Tx) error {
+		if v := tx.Bucket([]byte(embeddingDocBucket)).Get(key); v != nil {
+			json.Unmarshal(v, &state)
+		}
+		return nil
+	})
+	idx.dbMu.Unlock()
+
+	if !exists {
+		return idx.storeChunks(user, key, nil, nil)
+	}
+	if state.SHA1 == doc.SHA1 && state.Provider == idx.provider.Name() {
+		return nil
+	}
+
+	title := strings.TrimSuffix(filepath.Base(subPath), filepath.Ext(subPath))
+	texts := chunkDocument(title, doc.Content, idx.chunkSize)
+	var chunks []embeddedChunk
+	for start := 0; start < len(texts); start += 64 {
+		end := start + 64
+		if end > len(texts) {
+			end = len(texts)
+		}
+		vectors, err := idx.provider.Embed(texts[start:end])
+		if err != nil {
+			return err
+		}
+		for i, vec := range vectors {
+			chunks = append(chunks, embeddedChunk{Text: texts[start+i], Vector: vec})
+		}
+	}
+	return idx.storeChunks(user, key, chunks, &embeddedDocState{SHA1: doc.SHA1, Provider: idx.provider.Name()})
+}
+
+func (idx *SemanticIndex) storeChunks(user string, key []byte, chunks []embeddedChunk, state *embeddedDocState) error {
+	idx.dbMu.Lock()
+	defer idx.dbMu.Unlock()
+
+	db, err := idx.db(user)
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		chunkBucket := tx.Bucket([]byte(embeddingChunkBucket))
+		docBucket := tx.Bucket([]byte(embeddingDocBucket))
+		if state == nil {
+			if err := chunkBucket.Delete(key); err != nil {
+				return err
+			}
+			return docBucket.Delete(key)
+		}
+		buf, err := json.Marshal(chunks)
+		if err != nil {
+			return err
+		}
+		if err := chunkBucket.Put(key, buf); err != nil {
+			return err
+		}
+		buf, err = json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		return docBucket.Put(key, buf)
+	})
+	if err != nil {
+		return err
+	}
+
+	if vectors, ok := idx.vectors[user]; ok {
+		if state == nil {
+			delete(vectors, string(key))
+		} else {
+			vectors[string(key)] = chunks
+		}
+	}
+	return nil
+}
+
+// rank scores every document of user against the query vectors and returns
+// the best matches. A document's score is its best chunk similarity.
+func (idx *SemanticIndex) rank(user string, queries [][]float32, exclude string, limit int) ([]SearchResult, error) {
+	idx.dbMu.Lock()
+	defer idx.dbMu.Unlock()
+
+	vectors, err := idx.userVectors(user)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]SearchResult, 0)
+	for path, chunks := range vectors {
+		if path == exclude {
+			continue
+		}
+		best, bestChunk := -1.0, -1
+		for i, chunk := range chunks {
+			for _, q := range queries {
+				if score := dotProduct(q, chunk.Vector); score > best {
+					best, bestChunk = score, i
+				}
+			}
+		}
+		if bestChunk < 0 || best <= 0 {
+			continue
+		}
+		_, text, _ := strings.Cut(chunks[bestChunk].Text, "\n\n")
+		result := SearchResult{
+			Path:    path,
+			Score:   best,
+			Context: []string{semanticSnippet(text)},
+		}
+		store.RLock()
+		if doc, ok := store.docs.Stat(filepath.Join(user, filepath.FromSlash(path))); ok {
+			result.ModTime = doc.ModTime
+			result.Size = doc.Size
+		}
+		store.RUnlock()
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+func semanticSnippet(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if runes := []rune(text); len(runes) > 200 {
+		return string(runes[:200]) + "…"
+	}
+	return text
+}
+
+func (idx *SemanticIndex) Search(user, query string, limit int) ([]SearchResult, error) {
+	vectors, err := idx.provider.Embed([]string{query})
+	if err != nil {
+		return nil, err
+	}
+	return idx.rank(user, vectors, "", limit)
+}
+
+// Related returns the notes closest to the note at subPath, using all of its
+// chunk vectors as queries.
+func (idx *SemanticIndex) Related(user, subPath string, limit int) ([]SearchResult, error) {
+	key := filepath.ToSlash(subPath)
+
+	idx.dbMu.Lock()
+	vectors, err := idx.userVectors(user)
+	var queries [][]float32
+	if err == nil {
+		for _, chunk := range vectors[key] {
+			queries = append(queries, chunk.Vector)
+		}
+	}
+	idx.dbMu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("note is not indexed yet: %s", key)
+	}
+	return idx.rank(user, queries, key, limit)
+}
+
+// --- saved_search.go ---
+
+// savedSearchRoot is the virtual directory under which saved searches are
+// listed by handleList. It never exists on disk.
+const savedSearchRoot = ".saved"
+
+type SavedSearch struct {
+	Name           string `json:"name"`
+	Query          string `json:"query"`
+	Regex          bool   `json:"regex,omitempty"`
+	Path           string `json:"path,omitempty"`
+	Sort           string `json:"sort,omitempty"`
+	ModifiedAfter  string `json:"modified_after,omitempty"`
+	ModifiedBefore string `json:"modified_before,omitempty"`
+}
+
+// Options converts the stored search into SearchOptions. Relative dates such
+// as "7d" are resolved against now, so the folder contents stay current.
+func (s SavedSearch) Options(now time.Time) (SearchOptions, error) {
+	opts := SearchOptions{Query: s.Query, Regex: s.Regex, Scope: s.Path, Sort: s.Sort}
+	if opts.Sort == "" {
+		opts.Sort = "path"
+	}
+	if err := checkSearchSort(opts.Sort); err != nil {
+		return opts, err
+	}
+	var err error
+	if opts.ModifiedAfter, err = parseTimeFilter(s.ModifiedAfter, now, false); err != nil {
+		return opts, err
+	}
+	if opts.ModifiedBefore, err = parseTimeFilter(s.ModifiedBefore, now, true); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+var savedSearchMutex sync.Mutex
+
+func savedSearchFile(user string) string {
+	return filepath.Join(AppConfig.MarkdownDir, user, ".extra", "saved_searches.json")
+}
+
+func LoadSavedSearches(user string) ([]SavedSearch, error) {
+	data, err := os.ReadFile(savedSearchFile(user))
+	if os.IsNotExist(err) {
+		return []SavedSearch{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var searches []SavedSearch
+	if err := json.Unmarshal(data, &searches); err != nil {
+		return nil, err
+	}
+	return searches, nil
+}
+
+func storeSavedSearches(user string, searches []SavedSearch) error {
+	path := savedSearchFile(user)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(searches, "", "  ")
+	if err != nil {
+		return err
+	}
+	return withWriteGate(func() error { return writeFileAtomic(path, data, 0644) })
+}
+
+// PutSavedSearch adds a saved search or replaces the one with the same name.
+func PutSavedSearch(user string, search SavedSearch) error {
+	savedSearchMutex.Lock()
+	defer savedSearchMutex.Unlock()
+
+	searches, err := LoadSavedSearches(user)
+	if err != nil {
+		return err
+	}
+	for i := range searches {
+		if searches[i].Name == search.Name {
+			searches[i] = search
+			return storeSavedSearches(user, searches)
+		}
+	}
+	return storeSavedSearches(user, append(searches, search))
+}
+
+func DeleteSavedSearch(user, name string) (bool, error) {
+	savedSearchMutex.Lock()
+	defer savedSearchMutex.Unlock()
+
+	searches, err := LoadSavedSearches(user)
+	if err != nil {
+		return false, err
+	}
+	for i := range searches {
+		if searches[i].Name == name {
+			return true, storeSavedSearches(user, append(searches[:i], searches[i+1:]...))
+		}
+	}
+	return false, nil
+}
+
+// savedSearchFolders returns one virtual directory per saved search. With
+// withChildren set, each folder is filled with the notes that currently match.
+func savedSearchFolders(user string, withChildren bool) []*TreeItem {
+	searches, err := LoadSavedSearches(user)
+	if err != nil {
+		log.Printf("Could not load saved searches for %s: %v", user, err)
+		return nil
+	}
+	items := make([]*TreeItem, 0, len(searches))
+	for _, search := range searches {
+		item := &TreeItem{
+			Name:    search.Name,
+			IsDir:   true,
+			Path:    savedSearchRoot + "/" + search.Name,
+			Virtual: true,
+		}
+		if withChildren {
+			item.Children = savedSearchResults(user, search)
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// savedSearchResults evaluates search against the in-memory store and returns
+// the matching notes as tree items that carry their real path.
+func savedSearchResults(user string, search SavedSearch) []*TreeItem {
+	seen := make(map[string]bool)
+	items := make([]*TreeItem, 0)
+	opts, err := search.Options(time.Now())
+	if err != nil {
+		log.Printf("Invalid saved search '%s' for %s: %v", search.Name, user, err)
+		return items
+	}
+	for _, result := range SearchInMemory(user, opts) {
+		if seen[result.Path] {
+			continue
+		}
+		seen[result.Path] = true
+
+		_, fullPath, _, err := resolveUserPath(user, result.Path)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			continue
+		}
+		item := &TreeItem{
+			Name:    filepath.Base(fullPath),
+			Path:    result.Path,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+		if attachEntries, err := os.ReadDir(fullPath + ".attach"); err == nil {
+			item.AttachCount = len(attachEntries)
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// --- extract.go ---
+
+const maxAttachmentExtractSize = 32 << 20
+
+var plainTextAttachmentExts = map[string]bool{
+	".txt": true, ".md": true, ".markdown": true, ".csv": true, ".tsv": true, ".log": true,
+	".json": true, ".xml": true, ".yaml": true, ".yml": true, ".toml": true, ".ini": true,
+	".conf": true, ".cfg": true, ".html": true, ".htm": true, ".css": true, ".svg": true,
+	".go": true, ".py": true, ".js": true, ".mjs": true, ".ts": true, ".tsx": true, ".jsx": true,
+	".vue": true, ".java": true, ".kt": true, ".c": true, ".h": true, ".cpp": true, ".hpp": true,
+	".cc": true, ".cs": true, ".rs": true, ".rb": true, ".php": true, ".swift": true, ".scala": true,
+	".lua": true, ".pl": true, ".r": true, ".sql": true, ".sh": true, ".bash": true, ".ps1": true,
+	".bat": true, ".cmd": true, ".tex": true, ".rst": true, ".org": true,
+}
+
+// isExtractableAttachment reports whether text can be extracted from files
+// of the type of path.
+func isExtractableAttachment(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return plainTextAttachmentExts[ext] || ext == ".docx" || ext == ".pdf"
+}
+
+// extractAttachmentText returns the searchable text of an attachment. Plain
+// text and source files are read as-is, .docx and .pdf files are decoded with
+// the built-in extractors. ok is false for unsupported or unreadable files.
+func extractAttachmentText(path string) (text string, ok bool) {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() || info.Size() > maxAttachmentExtractSize {
+		return "", false
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	switch {
+	case plainTextAttachmentExts[ext]:
+		data, err := os.ReadFile(path)
+		if err != nil || !utf8.Valid(data) {
+			return "", false
+		}
+		return string(data), true
+	case ext == ".docx":
+		text, err := extractDocxText(path)
+		if err != nil {
+			log.Printf("Could not extract text from %s: %v", path, err)
+			return "", false
+		}
+		return text, true
+	case ext == ".pdf":
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", false
+		}
+		return extractPDFText(data), true
+	}
+	return "", false
+}
+
+func extractDocxText(path string) (string, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return "", err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		if f.Name != "word/document.xml" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+
+		var sb strings.Builder
+		decoder := xml.NewDecoder(rc)
+		inText := false
+		for {
+			tok, err := decoder.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return sb.String(), err
+			}
+			switch t := tok.(type) {
+			case xml.StartElement:
+				switch t.Name.Local {
+				case "t":
+					inText = true
+				case "tab":
+					sb.WriteByte('\t')
+				case "br", "cr":
+					sb.WriteByte('\n')
+				}
+			case xml.EndElement:
+				switch t.Name.Local {
+				case "t":
+					inText = false
+				case "p":
+					sb.WriteByte('\n')
+				}
+			case xml.CharData:
+				if inText {
+					sb.Write(t)
+				}
+			}
+		}
+		return sb.String(), nil
+	}
+	return "", fmt.Errorf("word/document.xml not found")
+}
+
+var (
+	pdfStreamRe  = regexp.MustCompile(`stream\r?\n`)
+	pdfBfCharRe  = regexp.MustCompile(`<([0-9A-Fa-f]{4})>\s*<([0-9A-Fa-f]+)>`)
+	pdfBfRangeRe = regexp.MustCompile(`<([0-9A-Fa-f]{4})>\s*<([0-9A-Fa-f]{4})>\s*<([0-9A-Fa-f]+)>`)
+)
+
+// extractPDFText pulls the text out of the content streams of a PDF. It is a
+// best-effort extractor: it understands uncompressed and Flate-compressed
+// streams, simple fonts and two-byte fonts that ship a ToUnicode CMap, which
+// covers the PDFs produced by common office suites and browsers.
+func extractPDFText(data []byte) string {
+	var contents [][]byte
+	cmap := make(map[uint16]string)
+
+	for _, loc := range pdfStreamRe.FindAllIndex(data, -1) {
+		if loc[0] > 0 && (data[loc[0]-1] >= 'a' && data[loc[0]-1] <= 'z') {
+			continue // "endstream"
+		}
+		dictStart := bytes.LastIndex(data[:loc[0]], []byte("obj"))
+		if dictStart < 0 {
+			continue
+		}
+		dict := data[dictStart:loc[0]]
+		end := bytes.Index(data[loc[1]:], []byte("endstream"))
+		if end < 0 {
+			continue
+		}
+		raw := data[loc[1] : loc[1]+end]
+
+		if bytes.Contains(dict, []byte("/Image")) || bytes.Contains(dict, []byte("/XRef")) ||
+			bytes.Contains(dict, []byte("/Length1")) || bytes.Contains(dict, []byte("/Length2")) {
+			continue
+		}
+		if bytes.Contains(dict, []byte("/Filter")) {
+			if !bytes.Contains(dict, []byte("/FlateDecode")) {
+				continue
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(raw))
+			if err != nil {
+				continue
+			}
+			// Truncated streams are common, keep whatever could be inflated.
+			raw, _ = io.ReadAll(zr)
+			zr.Close()
+		}
+
+		if bytes.Contains(raw, []byte("beginbfchar")) || bytes.Contains(raw, []byte("beginbfrange")) {
+			parsePDFToUnicode(raw, cmap)
+			continue
+		}
+		contents = append(contents, raw)
+	}
+
+	var sb strings.Builder
+	for _, content := range contents {
+		extractPDFContentText(content, cmap, &sb)
+	}
+	return sb.String()
+}
+
+func parsePDFToUnicode(raw []byte, cmap map[uint16]string) {
+	for _, section := range bytes.Split(raw, []byte("beginbfrange")) {
+		if end := bytes.Index(section, []byte("endbfrange")); end >= 0 {
+			for _, m := range pdfBfRangeRe.FindAllSubmatch(section[:end], -1) {
+				lo, _ := strconv.ParseUint(string(m[1]), 16, 16)
+				hi, _ := strconv.ParseUint(string(m[2]), 16, 16)
+				dst := []rune(decodeUTF16Hex(string(m[3])))
+				if len(dst) == 0 || hi < lo || hi-lo > 0xFFFF {
+					continue
+				}
+				for code := lo; code <= hi; code++ {
+					r := append([]rune{}, dst...)
+					r[len(r)-1] += rune(code - lo)
+					cmap[uint16(code)] = string(r)
+				}
+			}
+		}
+	}
+	for _, section := range bytes.Split(raw, []byte("beginbfchar")) {
+		if end := bytes.Index(section, []byte("endbfchar")); end >= 0 {
+			for _, m := range pdfBfCharRe.FindAllSubmatch(section[:end], -1) {
+				code, _ := strconv.ParseUint(string(m[1]), 16, 16)
+				cmap[uint16(code)] = decodeUTF16Hex(string(m[2]))
+			}
+		}
+	}
+}
+
+func decodeUTF16Hex(h string) string {
+	b, err := hex.DecodeString(h)
+	if err != nil || len(b)%2 != 0 {
+		return ""
+	}
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+	}
+	return string(utf16.Decode(u))
+}
+
+// decodePDFString maps the bytes of a string operand to text. Mostly
+// printable strings are treated as single-byte text, anything else is looked
+// up two bytes at a time in the ToUnicode map.
+func decodePDFString(b []byte, cmap map[uint16]string) string {
+	printable := 0
+	for _, c := range b {
+		if c >= 0x20 && c < 0x7F || c >= 0xA0 || c == '\n' || c == '\t' {
+			printable++
+		}
+	}
+	if len(cmap) > 0 && len(b)%2 == 0 && printable*10 < len(b)*9 {
+		var sb strings.Builder
+		for i := 0; i+1 < len(b); i += 2 {
+			sb.WriteString(cmap[uint16(b[i])<<8|uint16(b[i+1])])
+		}
+		return sb.String()
+	}
+	if printable*10 < len(b)*9 {
+		return ""
+	}
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+func extractPDFContentText(content []byte, cmap map[uint16]string, sb *strings.Builder) {
+	var operands [][]byte
+	var array [][]byte
+	inArray := false
+
+	for i := 0; i < len(content); {
+		c := content[i]
+		switch {
+		case c == '(':
+			str, next := readPDFLiteralString(content, i)
+			if inArray {
+				array = append(array, str)
+			} else {
+				operands = append(operands, str)
+			}
+			i = next
+		case c == '<' && i+1 < len(content) && content[i+1] != '<':
+			end := bytes.IndexByte(content[i:], '>')
+			if end < 0 {
+				return
+			}
+			h := strings.Map(func(r rune) rune {
+				if strings.ContainsRune(" \t\r\n", r) {
+					return -1
+				}
+				return r
+			}, string(content[i+1:i+end]))
+			if len(h)%2 == 1 {
+				h += "0"
+			}
+			str, _ := hex.DecodeString(h)
+			if inArray {
+				array = append(array, str)
+			} else {
+				operands = append(operands, str)
+			}
+			i += end + 1
+		case c == '[':
+			inArray = true
+			array = nil
+			i++
+		case c == ']':
+			inArray = false
+			i++
+		case c == '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+		case c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c == '\'' || c == '"' || c == '*':
+			start := i
+			for i < len(content) && (content[i] >= 'A' && content[i] <= 'Z' || content[i] >= 'a' && content[i] <= 'z' || content[i] == '*' || content[i] == '\'' || content[i] == '"') {
+				i++
+			}
+			switch string(content[start:i]) {
+			case "Tj":
+				if len(operands) > 0 {
+					sb.WriteString(decodePDFString(operands[len(operands)-1], cmap))
+				}
+			case "'", "\"":
+				sb.WriteByte('\n')
+				if len(operands) > 0 {
+					sb.WriteString(decodePDFString(operands[len(operands)-1], cmap))
+				}
+			case "TJ":
+				for _, str := range array {
+					sb.WriteString(decodePDFString(str, cmap))
+				}
+				array = nil
+			case "Td", "TD", "T*":
+				sb.WriteByte('\n')
+			case "ET":
+				sb.WriteByte('\n')
+			}
+			if !inArray {
+				operands = operands[:0]
+			}
+		default:
+			i++
+		}
+	}
+}
+
+func readPDFLiteralString(content []byte, start int) ([]byte, int) {
+	var out []byte
+	depth := 0
+	for i := start; i < len(content); i++ {
+		c := content[i]
+		switch c {
+		case '\\':
+			i++
+			if i >= len(content) {
+				return out, i
+			}
+			switch e := content[i]; e {
+			case 'n':
+				out = append(out, '\n')
+			case 'r':
+				out = append(out, '\r')
+			case 't':
+				out = append(out, '\t')
+			case 'b', 'f':
+			case '\r', '\n':
+				// Line continuation.
+			default:
+				if e >= '0' && e <= '7' {
+					v := 0
+					j := 0
+					for ; j < 3 && i+j < len(content) && content[i+j] >= '0' && content[i+j] <= '7'; j++ {
+						v = v*8 + int(content[i+j]-'0')
+					}
+					out = append(out, byte(v))
+					i += j - 1
+				} else {
+					out = append(out, e)
+				}
+			}
+		case '(':
+			if depth > 0 {
+				out = append(out, c)
+			}
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return out, i + 1
+			}
+			out = append(out, c)
+		default:
+			out = append(out, c)
+		}
+	}
+	return out, len(content)
+}
+
+// --- replace.go ---
+
+type ReplaceFileResult struct {
+	Path    string `json:"path"`
+	Matches int    `json:"matches"`
+	Diff    string `json:"diff,omitempty"`
+	SHA1    string `json:"sha1,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type ReplaceSummary struct {
+	DryRun       bool                `json:"dry_run"`
+	Comment      string              `json:"comment,omitempty"`
+	FilesMatched int                 `json:"files_matched"`
+	FilesChanged int                 `json:"files_changed"`
+	TotalMatches int                 `json:"total_matches"`
+	Files        []ReplaceFileResult `json:"files"`
+}
+
+func compileReplacePattern(query string, useRegex, ignoreCase bool) (*regexp.Regexp, error) {
+	pattern := query
+	if !useRegex {
+		pattern = regexp.QuoteMeta(query)
+	}
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+// ReplaceInUserDocs replaces every match of re in the user's documents below
+// scope. In regex mode the replacement may reference capture groups ($1,
+// ${name}); otherwise it is inserted literally. With dryRun set nothing is
+// written and a line diff is returned for each affected file.
+func ReplaceInUserDocs(user, scopeRelPath string, re *regexp.Regexp, replacement string, useRegex, dryRun bool, comment string) ReplaceSummary {
+	userPrefix := user + string(filepath.Separator)
+
+	type candidate struct {
+		subPath string
+		content string
+	}
+	var candidates []candidate
+
+	store.RLock()
+	for relPath, doc := range store.docs.Documents(scopeRelPath, true) {
+		if !isWithin(relPath, scopeRelPath) {
+			continue
+		}
+		if re.MatchString(doc.Content) {
+			candidates = append(candidates, candidate{
+				subPath: filepath.ToSlash(strings.TrimPrefix(relPath, userPrefix)),
+				content: doc.Content,
+			})
+		}
+	}
+	store.RUnlock()
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].subPath < candidates[j].subPath })
+
+	summary := ReplaceSummary{DryRun: dryRun, Comment: comment, Files: []ReplaceFileResult{}}
+	for _, c := range candidates {
+		matches := len(re.FindAllStringIndex(c.content, -1))
+		var newContent string
+		if useRegex {
+			newContent = re.ReplaceAllString(c.content, replacement)
+		} else {
+			newContent = re.ReplaceAllLiteralString(c.content, replacement)
+		}
+		if newContent == c.content {
+			continue
+		}
+
+		result := ReplaceFileResult{Path: c.subPath, Matches: matches}
+		summary.FilesMatched++
+		summary.TotalMatches += matches
+
+		if dryRun {
+			result.Diff = lineDiff(c.content, newContent)
+		} else {
+			sha1, changed, err := saveDocument(user, c.subPath, newContent, comment)
+			if err != nil {
+				result.Error = err.Error()
+			} else if changed {
+				result.SHA1 = sha1
+				summary.FilesChanged++
+			}
+		}
+		summary.Files = append(summary.Files, result)
+	}
+	return summary
+}
+
+type diffLine struct {
+	op   diffmatchpatch.Operation
+	text string
+}
+
+// lineDiff renders the difference between two texts as a unified diff with
+// two lines of context around each change.
+func lineDiff(oldText, newText string) string {
+	const contextLines = 2
+
+	dmp := diffmatchpatch.New()
+	a, b, lineArray := dmp.DiffLinesToChars(oldText, newText)
+	diffs := dmp.DiffCharsToLines(dmp.DiffMain(a, b, false), lineArray)
+
+	var lines []diffLine
+	for _, d := range diffs {
+		text := strings.TrimSuffix(d.Text, "\n")
+		for _, line := range strings.Split(text, "\n") {
+			lines = append(lines, diffLine{op: d.Type, text: line})
+		}
+	}
+
+	var sb strings.Builder
+	oldLine, newLine := 1, 1
+	for i := 0; i < len(lines); {
+		if lines[i].op == diffmatchpatch.DiffEqual {
+			oldLine++
+			newLine++
+			i++
+			continue
+		}
+
+		// Extend the hunk until the next run of unchanged lines is long
+		// enough to separate it from the following change.
+		start := i - contextLines
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for end < len(lines) {
+			if lines[end].op != diffmatchpatch.DiffEqual {
+				end++
+				continue
+			}
+			run := end
+			for run < len(lines) && lines[run].op == diffmatchpatch.DiffEqual {
+				run++
+			}
+			if run == len(lines) || run-end > 2*contextLines {
+				break
+			}
+			end = run
+		}
+		stop := end + contextLines
+		if stop > len(lines) {
+			stop = len(lines)
+		}
+
+		hunkOld, hunkNew := oldLine-(i-start), newLine-(i-start)
+		var oldCount, newCount int
+		var body strings.Builder
+		for _, l := range lines[start:stop] {
+			switch l.op {
+			case diffmatchpatch.DiffEqual:
+				body.WriteString(" " + l.text + "\n")
+				oldCount++
+				newCount++
+			case diffmatchpatch.DiffDelete:
+				body.WriteString("-" + l.text + "\n")
+				oldCount++
+			case diffmatchpatch.DiffInsert:
+				body.WriteString("+" + l.text + "\n")
+				newCount++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", hunkOld, oldCount, hunkNew, newCount)
+		sb.WriteString(body.String())
+
+		for _, l := range lines[i:stop] {
+			if l.op != diffmatchpatch.DiffInsert {
+				oldLine++
+			}
+			if l.op != diffmatchpatch.DiffDelete {
+				newLine++
+			}
+		}
+		i = stop
+	}
+	return sb.String()
+}
+
+// --- export.go ---
+
+// exportHistoryDir is the folder of an export holding the past versions of
+// the exported notes.
+const exportHistoryDir = "_history"
+
+// ExportOptions selects what exportNotes writes. Path is relative to the
+// user root; empty exports everything.
+type ExportOptions struct {
+	Path    string
+	History bool
+}
+
+// exportNotes writes the notes and attachments of user below opts.Path to w
+// as a zip archive, with paths relative to the user root so that links keep
+// working. With History, every recorded version of a note in scope is added
+// as _history/<note path>/<id>_<time>.md, with a versions.json listing the
+// times and comments.
+func exportNotes(user string, opts ExportOptions, w io.Writer) error {
+	basePath, fullPath, _, err := resolveUserPath(user, opts.Path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return err
+	}
+
+	roots := []string{fullPath}
+	if !info.IsDir() {
+		// A single note is exported with its attachments.
+		roots = append(roots, fullPath+".attach")
+	}
+
+	zw := zip.NewWriter(w)
+	for _, root := range roots {
+		err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if p == root && errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() {
+				if isInternalDir(d.Name()) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if strings.HasPrefix(d.Name(), ".") && strings.HasSuffix(d.Name(), ".tmp") {
+				return nil
+			}
+			rel, err := filepath.Rel(basePath, p)
+			if err != nil {
+				return err
+			}
+			return addFileToZip(zw, filepath.ToSlash(rel), p)
+		})
+		if err != nil {
+			break
+		}
+	}
+	if err == nil && opts.History {
+		scope := filepath.ToSlash(filepath.Clean(opts.Path))
+		if scope == "." {
+			scope = ""
+		}
+		err = exportHistory(zw, user, scope)
+	}
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func addFileToZip(zw *zip.Writer, name, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	dst, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+// exportedVersion is an entry of the versions.json of a note in the history
+// folder of an export.
+type exportedVersion struct {
+	ID        uint64    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Comment   string    `json:"comment"`
+	File      string    `json:"file"`
+}
+
+// exportHistory adds the versions of every note at or below scope, including
+// notes that have since been renamed or deleted.
+func exportHistory(zw *zip.Writer, user, scope string) error {
+	vm, err := openVersionHistory(user)
+	if err != nil {
+		return fmt.Errorf("could not open version history: %w", err)
+	}
+	defer vm.Close()
+	keys, err := vm.Files()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		// Notes are keyed by the path the client used when saving them.
+		notePath := path.Clean("/" + filepath.ToSlash(key))[1:]
+		if scope != "" && notePath != scope && !strings.HasPrefix(notePath, scope+"/") {
+			continue
+		}
+		history, err := vm.GetHistory(key)
+		if err != nil {
+			return err
+		}
+		dir := path.Join(exportHistoryDir, notePath)
+		versions := make([]exportedVersion, 0, len(history))
+		for i := len(history) - 1; i >= 0; i-- {
+			record := history[i]
+			content, err := vm.GetVersionContent(key, record.ID)
+			if err != nil {
+				log.Printf("Skipping version %d of %s in export: %v", record.ID, notePath, err)
+				continue
+			}
+			name := fmt.Sprintf("%06d_%s.md", record.ID, record.Timestamp.Local().Format(backupTimeFormat))
+			dst, err := zw.CreateHeader(&zip.FileHeader{Name: path.Join(dir, name), Method: zip.Deflate, Modified: record.Timestamp})
+			if err != nil {
+				return err
+			}
+			if _, err := io.WriteString(dst, content); err != nil {
+				return err
+			}
+			versions = append(versions, exportedVersion{ID: record.ID, Timestamp: record.Timestamp, Comment: record.Comment, File: name})
+		}
+		data, _ := json.MarshalIndent(versions, "", "  ")
+		dst, err := zw.CreateHeader(&zip.FileHeader{Name: path.Join(dir, "versions.json"), Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// --- import.go ---
+
+// importMaxSize limits the total uncompressed size of an archive imported
+// from the command line, importHTTPMaxSize that of an uploaded archive.
+const (
+	importMaxSize     = 1 << 30
+	importHTTPMaxSize = 100 << 20
+)
+
+var (
+	notionIDRe = regexp.MustCompile(` [0-9a-f]{32}$`)
+	imageExtRe = regexp.MustCompile(`(?i)\.(png|jpe?g|gif|webp|svg|bmp|avif)$`)
+
+	errInvalidImport = errors.New("invalid import")
+)
+
+// importFormats are the formats importNotes understands. "markdown" is any
+// folder of notes with attachments referenced by relative links.
+var importFormats = []string{"gonote", "obsidian", "joplin", "notion", "markdown"}
+
+// importSource holds the files of an archive or folder to import by their
+// slash-separated path. Hidden files and folders are left out. The content
+// stays on disk: the entries of an archive are spooled to a temporary
+// folder, the files of a folder are read in place. Close removes the
+// temporary folder.
+type importSource struct {
+	dir      string
+	files    map[string]string // path in the source -> file with its content
+	obsidian bool              // the source contains an .obsidian folder
+	size     int64             // size of the spooled entries
+	limit    int64
+}
+
+// newImportSource creates a source whose spooled entries may have limit
+// bytes in total.
+func newImportSource(limit int64) (*importSource, error) {
+	dir, err := os.MkdirTemp("", "gonote-import-")
+	if err != nil {
+		return nil, err
+	}
+	return &importSource{dir: dir, files: make(map[string]string), limit: limit}, nil
+}
+
+func (src *importSource) Close() error {
+	return os.RemoveAll(src.dir)
+}
+
+// cleanName makes name relative to the root of the source. It returns false
+// for names leaving it and for hidden files.
+func (src *importSource) cleanName(name string) (string, bool) {
+	name = path.Clean("/" + strings.ReplaceAll(name, `\`, "/"))[1:]
+	if name == "" {
+		return "", false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".obsidian" {
+			src.obsidian = true
+		}
+		if strings.HasPrefix(part, ".") || part == "__MACOSX" {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// add spools the content of a file of the source from r.
+func (src *importSource) add(name string, r io.Reader) error {
+	name, ok := src.cleanName(name)
+	if !ok {
+		return nil
+	}
+	spooled, n, err := src.spool(io.LimitReader(r, src.limit-src.size+1))
+	if err != nil {
+		return err
+	}
+	src.size += n
+	if src.size > src.limit {
+		return fmt.Errorf("%w: larger than %d bytes", errInvalidImport, src.limit)
+	}
+	src.files[name] = spooled
+	return nil
+}
+
+// spool copies r to a new file in the temporary folder.
+func (src *importSource) spool(r io.Reader) (string, int64, error) {
+	f, err := os.CreateTemp(src.dir, "file-")
+	if err != nil {
+		return "", 0, err
+	}
+	n, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return f.Name(), n, err
+}
+
+// stripRoot removes a folder that contains everything else, as archives of
+// a vault or an export folder usually have one.
+func (src *importSource) stripRoot() {
+	root := ""
+	for name := range src.files {
+		first, _, ok := strings.Cut(name, "/")
+		if !ok || (root != "" && first != root) {
+			return
+		}
+		root = first
+	}
+	if root == "" {
+		return
+	}
+	files := make(map[string]string, len(src.files))
+	for name, file := range src.files {
+		files[strings.TrimPrefix(name, root+"/")] = file
+	}
+	src.files = files
+}
+
+// readImportZip spools the entries of a zip archive, which may have limit
+// bytes uncompressed.
+func readImportZip(r io.ReaderAt, size, limit int64) (*importSource, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidImport, err)
+	}
+	src, err := newImportSource(limit)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			src.Close()
+			return nil, fmt.Errorf("%w: %s: %v", errInvalidImport, f.Name, err)
+		}
+		err = src.add(f.Name, rc)
+		rc.Close()
+		if err != nil {
+			src.Close()
+			return nil, err
+		}
+	}
+	src.stripRoot()
+	return src, nil
+}
+
+func readImportDir(dir string) (*importSource, error) {
+	src, err := newImportSource(0)
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if name, ok := src.cleanName(filepath.ToSlash(rel)); ok {
+			src.files[name] = p
+		}
+		return nil
+	})
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	return src, nil
+}
+
+// detectImportFormat guesses the tool that produced src: GoNote exports
+// have .md.attach folders, Obsidian vaults an .obsidian folder, Joplin
+// exports a _resources folder and Notion exports IDs in their file names.
+func detectImportFormat(src *importSource) string {
+	if src.obsidian {
+		return "obsidian"
+	}
+	var gonote, joplin, notion bool
+	for name := range src.files {
+		gonote = gonote || strings.HasPrefix(name, exportHistoryDir+"/") || strings.Contains(name, ".md.attach/")
+		joplin = joplin || strings.HasPrefix(name, "_resources/")
+		notion = notion || notionIDRe.MatchString(strings.TrimSuffix(path.Base(name), path.Ext(name)))
+	}
+	switch {
+	case gonote:
+		return "gonote"
+	case joplin:
+		return "joplin"
+	case notion:
+		return "notion"
+	}
+	return "markdown"
+}
+
+// stripNotionIDs removes the IDs Notion appends to page names, turning
+// "Projects 0123...ef/Plan 4567...ab.md" into "Projects/Plan.md".
+func stripNotionIDs(name string) string {
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		ext := path.Ext(part)
+		if notionIDRe.MatchString(part) {
+			parts[i] = notionIDRe.ReplaceAllString(part, "")
+		} else if stem := strings.TrimSuffix(part, ext); notionIDRe.MatchString(stem) {
+			parts[i] = notionIDRe.ReplaceAllString(stem, "") + ext
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func isNotePath(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), ".md")
+}
+
+// ImportResult reports the files importNotes wrote, with paths relative to
+// the user root. Files that already exist are skipped, never overwritten.
+type ImportResult struct {
+	Format  string   `json:"format"`
+	Notes   int      `json:"notes"`
+	Files   int      `json:"files"`
+	Skipped []string `json:"skipped"`
+	Errors  []string `json:"errors"`
+}
+
+// importConverter maps the files of a source onto GoNote's layout: every
+// file a note references moves into the note's .attach folder, and the
+// links of the notes are rewritten to the new locations. The rewritten
+// notes are spooled to the source's temporary folder.
+type importConverter struct {
+	src     *importSource
+	files   map[string]string
+	renamed map[string]string   // source path -> path in GoNote
+	byName  map[string][]string // lower-case base name -> source paths
+	out     map[string]string   // path in GoNote -> file with its content
+	used    map[string]bool     // source files moved into an .attach folder
+}
+
+func newImportConverter(src *importSource, rename func(string) string) *importConverter {
+	files := src.files
+	c := &importConverter{
+		src:     src,
+		files:   files,
+		renamed: make(map[string]string, len(files)),
+		byName:  make(map[string][]string),
+		out:     make(map[string]string, len(files)),
+		used:    make(map[string]bool),
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	taken := make(map[string]bool, len(files))
+	for _, name := range names {
+		newName := rename(name)
+		if taken[newName] {
+			newName = name
+		}
+		taken[newName] = true
+		c.renamed[name] = newName
+		base := strings.ToLower(path.Base(name))
+		c.byName[base] = append(c.byName[base], name)
+	}
+	return c
+}
+
+// resolve finds the source file a link of a note in dir refers to. Like
+// Obsidian, it falls back to a file of the same name anywhere in the
+// source, preferring the note's folder and then the shortest path.
+func (c *importConverter) resolve(dir, linkPath string) (string, bool) {
+	if _, ok := c.files[linkPath]; ok {
+		return linkPath, true
+	}
+	if rooted := path.Clean(strings.TrimPrefix(linkPath, dir+"/")); rooted != linkPath {
+		if _, ok := c.files[rooted]; ok {
+			return rooted, true
+		}
+	}
+	best := ""
+	for _, candidate := range c.byName[strings.ToLower(path.Base(linkPath))] {
+		if best == "" || betterLinkCandidate(candidate, best, dir) {
+			best = candidate
+		}
+	}
+	return best, best != ""
+}
+
+// convertNote rewrites the links of the note at name and copies the files
+// it references into its .attach folder.
+func (c *importConverter) convertNote(name string) error {
+	newName := c.renamed[name]
+	dir, newDir := path.Dir(name), path.Dir(newName)
+	attached := make(map[string]string) // source path -> attachment path
+	attachNames := make(map[string]bool)
+
+	attach := func(source string) string {
+		if dst, ok := attached[source]; ok {
+			return dst
+		}
+		base := path.Base(c.renamed[source])
+		ext := path.Ext(base)
+		for i := 2; attachNames[strings.ToLower(base)]; i++ {
+			base = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(path.Base(c.renamed[source]), ext), i, ext)
+		}
+		attachNames[strings.ToLower(base)] = true
+		dst := newName + ".attach/" + base
+		attached[source] = dst
+		c.out[dst] = c.files[source]
+		c.used[source] = true
+		return dst
+	}
+
+	data, err := os.ReadFile(c.files[name])
+	if err != nil {
+		return err
+	}
+	content := string(data)
+	_, body, _ := splitFrontMatter(content)
+	frontMatter := content[:len(content)-len(body)]
+	body = mapProse(body, func(text string) string {
+		text = markdownLinkRe.ReplaceAllStringFunc(text, func(m string) string {
+			sub := markdownLinkRe.FindStringSubmatch(m)
+			linkPath, ok := markdownLinkPath(dir, sub[2])
+			if !ok {
+				return m
+			}
+			source, ok := c.resolve(dir, linkPath)
+			if !ok {
+				return m
+			}
+			target := c.renamed[source]
+			if !isNotePath(source) {
+				target = attach(source)
+			} else if source == linkPath && target == source && newDir == dir {
+				return m
+			}
+			return sub[1] + formatLinkTarget(sub[2], newDir, target) + sub[3]
+		})
+		return wikiLinkRe.ReplaceAllStringFunc(text, func(m string) string {
+			sub := wikiLinkRe.FindStringSubmatch(m)
+			target, _, _ := strings.Cut(sub[1], "#")
+			target = strings.TrimSpace(target)
+			if !strings.HasPrefix(m, "!") || target == "" || isNotePath(target) {
+				return m
+			}
+			source, ok := c.resolve(dir, path.Clean(target))
+			if !ok || isNotePath(source) {
+				return m
+			}
+			dst := attach(source)
+			link := formatLinkTarget("", newDir, dst)
+			if imageExtRe.MatchString(dst) {
+				return "![" + path.Base(dst) + "](" + link + ")"
+			}
+			return "[" + path.Base(dst) + "](" + link + ")"
+		})
+	})
+	converted, _, err := c.src.spool(strings.NewReader(frontMatter + body))
+	if err != nil {
+		return err
+	}
+	c.out[newName] = converted
+	return nil
+}
+
+// convert returns the files to write by their path in GoNote. Files no note
+// references keep their place.
+func (c *importConverter) convert() (map[string]string, error) {
+	for name := range c.files {
+		if isNotePath(name) {
+			if err := c.convertNote(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for name, file := range c.files {
+		if !isNotePath(name) && !c.used[name] {
+			if _, taken := c.out[c.renamed[name]]; !taken {
+				c.out[c.renamed[name]] = file
+			}
+		}
+	}
+	return c.out, nil
+}
+
+// importNotes writes the notes and files of src below dest, a folder
+// relative to the root of user. format is one of importFormats, or "auto" or
+// empty to detect it. Notes are written through saveDocument.
+func importNotes(user, dest string, src *importSource, format string) (*ImportResult, error) {
+	if format == "" || format == "auto" {
+		format = detectImportFormat(src)
+	} else if !slices.Contains(importFormats, format) {
+		return nil, fmt.Errorf("%w: unknown format %q", errInvalidImport, format)
+	}
+	dest = filepath.ToSlash(filepath.Clean(dest))
+	if dest == "." || dest == "/" {
+		dest = ""
+	}
+	if _, _, _, err := resolveUserPath(user, filepath.FromSlash(dest)); err != nil {
+		return nil, err
+	}
+
+	var files map[string]string
+	var err error
+	switch format {
+	case "gonote":
+		// GoNote exports already use its layout; only the history is left out.
+		files = make(map[string]string, len(src.files))
+		for name, file := range src.files {
+			if !strings.HasPrefix(name, exportHistoryDir+"/") {
+				files[name] = file
+			}
+		}
+	case "notion":
+		files, err = newImportConverter(src, stripNotionIDs).convert()
+	default:
+		files, err = newImportConverter(src, func(name string) string { return name }).convert()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result := &ImportResult{Format: format, Skipped: []string{}, Errors: []string{}}
+	comment := "Imported from " + format
+	for _, name := range names {
+		subPath := path.Join(dest, name)
+		_, fullPath, relPath, err := resolveUserPath(user, filepath.FromSlash(subPath))
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", subPath, err))
+			continue
+		}
+		if _, err := os.Stat(fullPath); err == nil {
+			result.Skipped = append(result.Skipped, subPath)
+			continue
+		}
+		if isNotePath(name) {
+			data, err := os.ReadFile(files[name])
+			if err == nil {
+				_, _, err = saveDocument(user, subPath, string(data), comment)
+			}
+			if err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", subPath, err))
+				continue
+			}
+			result.Notes++
+			continue
+		}
+		if err := importFile(user, subPath, fullPath, files[name], comment); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", subPath, err))
+			continue
+		}
+		store.UpdateAttachment(relPath)
+		result.Files++
+	}
+	return result, nil
+}
+
+// importFile copies the file at source to fullPath. The copy is staged
+// before the write gate is taken, so that a large file does not hold up
+// other writes.
+func importFile(user, subPath, fullPath, source, comment string) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+	tmpPath, err := stageFile(fullPath, f, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	return withWriteGate(func() error {
+		return withGitCommit(user, comment, []string{subPath}, func() error {
+			return replaceFile(tmpPath, fullPath)
+		})
+	})
+}
+
+// --- webdav.go ---
+
+// davPrefix is the path the WebDAV server is mounted at. Each user sees their
+// own tree below it.
+const davPrefix = "/dav"
+
+// davMethods are the WebDAV methods the router has to accept in addition to
+// the standard HTTP methods.
+var davMethods = []string{"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK"}
+
+var errDavWriteOnly = errors.New("file is open for writing")
+
+// davReplaceKey marks the context of COPY and MOVE requests, which remove an
+// existing destination before they copy or move the source onto it.
+type davReplaceKey struct{}
+
+// davBodyKey holds the *davBody of a PUT request in its context.
+type davBodyKey struct{}
+
+// davBody records whether reading a request body failed, so that an upload
+// the client broke off is discarded instead of saved.
+type davBody struct {
+	io.ReadCloser
+	err error
+}
+
+func (b *davBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+var (
+	davLocksMu sync.Mutex
+	davLocks   = make(map[string]webdav.LockSystem)
+)
+
+// davLockSystem returns the lock system of user. Locks are kept in memory
+// only; clients take them again after a restart.
+func davLockSystem(user string) webdav.LockSystem {
+	davLocksMu.Lock()
+	defer davLocksMu.Unlock()
+	ls, ok := davLocks[user]
+	if !ok {
+		ls = webdav.NewMemLS()
+		davLocks[user] = ls
+	}
+	return ls
+}
+
+// mountWebDAV serves the notes of the authenticated user at davPrefix.
+func mountWebDAV(r chi.Router) {
+	for _, method := range davMethods {
+		chi.RegisterMethod(method)
+	}
+	r.Route(davPrefix, func(r chi.Router) {
+		r.Use(AuthMiddleware)
+		r.Handle("/", http.HandlerFunc(handleWebDAV))
+		r.Handle("/*", http.HandlerFunc(handleWebDAV))
+	})
+}
+
+func handleWebDAV(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(string)
+	basePath, _, _, err := resolveUserPath(user, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := os.MkdirAll(basePath, 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+	switch r.Method {
+	case "COPY", "MOVE":
+		ctx = context.WithValue(ctx, davReplaceKey{}, true)
+	case http.MethodPut:
+		body := &davBody{ReadCloser: r.Body}
+		r.Body = body
+		ctx = context.WithValue(ctx, davBodyKey{}, body)
+	}
+
+	handler := &webdav.Handler{
+		Prefix:     davPrefix,
+		FileSystem: davFS{user: user},
+		LockSystem: davLockSystem(user),
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("WebDAV %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// davFS is the tree of a user as a webdav.FileSystem. The internal
+// directories do not exist for clients, notes are saved through saveDocument
+// and other changes are made the way the corresponding API handlers make
+// them, so that versions, the cache and the change journal stay current.
+type davFS struct {
+	user string
+}
+
+// resolve maps the WebDAV path name into the user's tree.
+func (d davFS) resolve(name string) (subPath, fullPath, relPath string, err error) {
+	subPath = strings.TrimPrefix(path.Clean("/"+name), "/")
+	for _, part := range strings.Split(subPath, "/") {
+		if isInternalDir(part) {
+			return "", "", "", fs.ErrNotExist
+		}
+	}
+	subPath = filepath.FromSlash(subPath)
+	_, fullPath, relPath, err = resolveUserPath(d.user, subPath)
+	return subPath, fullPath, relPath, err
+}
+
+// isDavNote reports whether the file at relPath is a note rather than an
+// attachment or another file.
+func isDavNote(relPath string) bool {
+	_, isAttachment := attachmentParent(relPath)
+	return strings.HasSuffix(strings.ToLower(relPath), ".md") && !isAttachment
+}
+
+func (d davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	_, fullPath, _, err := d.resolve(name)
+	if err != nil {
+		return err
+	}
+	return withWriteGate(func() error {
+		return os.Mkdir(fullPath, perm)
+	})
+}
+
+func (d davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	subPath, fullPath, relPath, err := d.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		f, err := os.Open(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		return davFile{f}, nil
+	}
+
+	// The handler only opens files for writing to replace them as a whole.
+	if flag&os.O_TRUNC == 0 {
+		return nil, fs.ErrInvalid
+	}
+	if info, err := os.Stat(filepath.Dir(fullPath)); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fs.ErrNotExist
+	}
+	if info, err := os.Stat(fullPath); err == nil && info.IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+
+	upload := &davUpload{fs: d, name: path.Base(name), subPath: subPath, fullPath: fullPath, relPath: relPath}
+	upload.body, _ = ctx.Value(davBodyKey{}).(*davBody)
+	if !isDavNote(relPath) {
+		upload.tmp, err = createStaged(fullPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return upload, nil
+}
+
+func (d davFS) RemoveAll(ctx context.Context, name string) error {
+	subPath, fullPath, relPath, err := d.resolve(name)
+	if err != nil {
+		return err
+	}
+	if subPath == "." {
+		return fs.ErrPermission
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.IsDir():
+		_, gitPath := splitUserPath(relPath)
+		err := withWriteGate(func() error {
+			return withGitCommit(d.user, "Delete "+filepath.ToSlash(gitPath), []string{gitPath}, func() error {
+				return os.RemoveAll(fullPath)
+			})
+		})
+		if err != nil {
+			return err
+		}
+		store.RemoveTree(relPath)
+		return nil
+	case isDavNote(relPath):
+		// COPY and MOVE replace the content of an existing note in place,
+		// which keeps its previous content in the note's history.
+		if replace, _ := ctx.Value(davReplaceKey{}).(bool); replace {
+			return nil
+		}
+		// Clients show the .attach folder as a folder of its own, so it is
+		// left alone. Editors that save by deleting and recreating a note
+		// would lose its attachments otherwise.
+		return deleteDocument(d.user, subPath, false)
+	default:
+		return d.removeFile(fullPath, relPath)
+	}
+}
+
+// removeFile deletes a file that is not a note, like handleAttachDelete.
+func (d davFS) removeFile(fullPath, relPath string) error {
+	_, gitPath := splitUserPath(relPath)
+	err := withWriteGate(func() error {
+		return withGitCommit(d.user, "Delete "+filepath.ToSlash(gitPath), []string{gitPath}, func() error {
+			return os.Remove(fullPath)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	store.DeleteAttachments(relPath)
+	return nil
+}
+
+// Rename moves a file or folder. Links to it are left alone, since clients
+// also rename files to save them safely. A file moved onto a note becomes a
+// new version of that note; editors that write a temporary file and rename
+// it over the note thereby save it like the web editor does.
+func (d davFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldSubPath, oldFullPath, oldRelPath, err := d.resolve(oldName)
+	if err != nil {
+		return err
+	}
+	newSubPath, newFullPath, newRelPath, err := d.resolve(newName)
+	if err != nil {
+		return err
+	}
+	if oldSubPath == "." || newSubPath == "." {
+		return fs.ErrPermission
+	}
+	info, err := os.Stat(oldFullPath)
+	if err != nil {
+		return err
+	}
+
+	oldNote := !info.IsDir() && isDavNote(oldRelPath)
+	if !info.IsDir() && isDavNote(newRelPath) {
+		if _, err := os.Stat(newFullPath); err == nil || !oldNote {
+			return d.replaceNote(oldSubPath, oldFullPath, oldRelPath, newSubPath, oldNote)
+		}
+		return renameDocument(d.user, oldSubPath, newSubPath)
+	}
+
+	rename := newLinkRename(oldRelPath, newRelPath, info.IsDir())
+	return withWriteGate(func() error {
+		return withGitCommit(d.user, fmt.Sprintf("Rename %s to %s", rename.From, rename.To), []string{rename.From, rename.To}, func() error {
+			if err := os.Rename(oldFullPath, newFullPath); err != nil {
+				return err
+			}
+			if info.IsDir() {
+				store.RenameDir(oldRelPath, newRelPath)
+				return nil
+			}
+			if oldNote {
+				store.DeleteDoc(oldRelPath)
+			}
+			store.DeleteAttachments(oldRelPath)
+			store.UpdateAttachment(newRelPath)
+			return nil
+		})
+	})
+}
+
+// replaceNote saves the content of the file at oldSubPath as the note at
+// newSubPath and then removes the file.
+func (d davFS) replaceNote(oldSubPath, oldFullPath, oldRelPath, newSubPath string, oldNote bool) error {
+	content, err := os.ReadFile(oldFullPath)
+	if err != nil {
+		return err
+	}
+	if _, _, err := saveDocument(d.user, newSubPath, string(content), ""); err != nil {
+		return err
+	}
+	if oldNote {
+		return deleteDocument(d.user, oldSubPath, false)
+	}
+	return d.removeFile(oldFullPath, oldRelPath)
+}
+
+func (d davFS) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	_, fullPath, _, err := d.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(fullPath)
+}
+
+// davFile is a file or folder opened for reading. Listings leave out the
+// internal directories.
+type davFile struct {
+	*os.File
+}
+
+func (f davFile) Readdir(count int) ([]fs.FileInfo, error) {
+	for {
+		infos, err := f.File.Readdir(count)
+		visible := infos[:0]
+		for _, info := range infos {
+			if !isInternalDir(info.Name()) {
+				visible = append(visible, info)
+			}
+		}
+		if len(visible) > 0 || err != nil || count <= 0 {
+			return visible, err
+		}
+	}
+}
+
+// davUpload is a file opened for writing by PUT or COPY. Its content is
+// applied on Close: notes are collected in memory and saved with
+// saveDocument, other files are written to a staged file that replaces the
+// target.
+type davUpload struct {
+	fs       davFS
+	name     string
+	subPath  string
+	fullPath string
+	relPath  string
+	body     *davBody
+	buf      bytes.Buffer
+	tmp      *os.File
+	size     int64
+	modTime  time.Time
+}
+
+func (u *davUpload) Write(p []byte) (int, error) {
+	var n int
+	var err error
+	if u.tmp != nil {
+		n, err = u.tmp.Write(p)
+	} else {
+		n, err = u.buf.Write(p)
+	}
+	u.size += int64(n)
+	return n, err
+}
+
+func (u *davUpload) Close() error {
+	if u.tmp != nil {
+		defer os.Remove(u.tmp.Name())
+	}
+	if u.body != nil && u.body.err != nil {
+		if u.tmp != nil {
+			u.tmp.Close()
+		}
+		return u.body.err
+	}
+
+	if u.tmp == nil {
+		_, _, err := saveDocument(u.fs.user, u.subPath, u.buf.String(), "")
+		return err
+	}
+
+	if err := closeStaged(u.tmp, u.fullPath, 0644); err != nil {
+		return err
+	}
+	_, gitPath := splitUserPath(u.relPath)
+	err := withWriteGate(func() error {
+		return withGitCommit(u.fs.user, "Upload "+filepath.ToSlash(gitPath), []string{gitPath}, func() error {
+			return replaceFile(u.tmp.Name(), u.fullPath)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	store.UpdateAttachment(u.relPath)
+	return nil
+}
+
+func (u *davUpload) Read(p []byte) (int, error) {
+	return 0, errDavWriteOnly
+}
+
+func (u *davUpload) Seek(offset int64, whence int) (int64, error) {
+	return 0, errDavWriteOnly
+}
+
+func (u *davUpload) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, errDavWriteOnly
+}
+
+func (u *davUpload) Stat() (fs.FileInfo, error) {
+	if u.modTime.IsZero() {
+		u.modTime = time.Now()
+	}
+	return davUploadInfo{u}, nil
+}
+
+// davUploadInfo describes a file that is being written.
+type davUploadInfo struct {
+	u *davUpload
+}
+
+func (i davUploadInfo) Name() string       { return i.u.name }
+func (i davUploadInfo) Size() int64        { return i.u.size }
+func (i davUploadInfo) Mode() fs.FileMode  { return 0644 }
+func (i davUploadInfo) ModTime() time.Time { return i.u.modTime }
+func (i davUploadInfo) IsDir() bool        { return false }
+func (i davUploadInfo) Sys() any           { return nil }
+
+// --- handlers.go ---
+
+type TreeItem struct {
+	Name        string                 `json:"name"`
+	IsDir       bool                   `json:"is_dir"`
+	Size        int64                  `json:"size"`
+	ModTime     time.Time              `json:"mod_time"`
+	AttachCount int                    `json:"attach_count,omitempty"`
+	Path        string                 `json:"path,omitempty"`
+	Virtual     bool                   `json:"virtual,omitempty"`
+	Meta        map[string]interface{} `json:"meta,omitempty"`
+	Children    []*TreeItem            `json:"children,omitempty"`
+}
+
+type AttachmentInfo struct {
+	Name       string    `json:"name"`
+	AttachPath string    `json:"attachPath"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mod_time"`
+}
+
+func respondJSON(w http.ResponseWriter, status int, payload interface{}) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
+}
+
+func respondError(w http.ResponseWriter, code int, message string) {
+	respondJSON(w, code, map[string]string{"error": message})
+}
+
+var errInvalidPath = errors.New("invalid path")
+
+func getUserPath(r *http.Request, subPath string) (basePath, fullPath, relPath string, err error) {
+	user := r.Context().Value(userContextKey).(string)
+	return resolveUserPath(user, subPath)
+}
+
+func resolveUserPath(user, subPath string) (basePath, fullPath, relPath string, err error) {
+	basePath = filepath.Join(AppConfig.MarkdownDir, user)
+
+	cleanedSubPath := filepath.Clean(subPath)
+	if strings.HasPrefix(cleanedSubPath, "..") || strings.Contains(cleanedSubPath, string(filepath.Separator)+"..") {
+		return "", "", "", fmt.Errorf("%w: contains '..'", errInvalidPath)
+	}
+	// The saved searches are listed as a virtual folder, which a real folder
+	// of the same name would be hidden behind.
+	if first, _, _ := strings.Cut(cleanedSubPath, string(filepath.Separator)); strings.EqualFold(first, savedSearchRoot) {
+		return "", "", "", fmt.Errorf("%w: %s is reserved for saved searches", errInvalidPath, savedSearchRoot)
+	}
+	// .extra and .git hold server data; a file moved into .git could make
+	// the server's git commands run arbitrary programs.
+	if inInternalDir(cleanedSubPath) {
+		return "", "", "", fmt.Errorf("%w: .extra and .git are reserved", errInvalidPath)
+	}
+
+	fullPath = filepath.Join(basePath, cleanedSubPath)
+	relPath = filepath.Join(user, cleanedSubPath)
+
+	if !strings.HasPrefix(fullPath, basePath) {
+		return "", "", "", fmt.Errorf("%w: outside of user directory", errInvalidPath)
+	}
+	return
+}
+
+func getSafeAttachmentPath(r *http.Request, mdPath, attachPath string) (string, error) {
+	userBasePath, _, _, err := getUserPath(r, "")
+	if err != nil {
+		return "", err
+	}
+
+	_, mdFileAbsPath, _, err := getUserPath(r, mdPath)
+	if err != nil {
+		return "", err
+	}
+	mdDirAbsPath := filepath.Dir(mdFileAbsPath)
+
+	resolvedPath := filepath.Join(mdDirAbsPath, attachPath)
+	cleanedPath := filepath.Clean(resolvedPath)
+
+	if !strings.HasPrefix(cleanedPath, userBasePath) {
+		return "", fmt.Errorf("invalid attachment path: access denied, path escapes user root")
+	}
+	if rel, _ := filepath.Rel(userBasePath, cleanedPath); inInternalDir(rel) {
+		return "", fmt.Errorf("invalid attachment path: access denied, .extra and .git are reserved")
+	}
+
+	return cleanedPath, nil
+}
+
+func handleDirOp(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Action      string `json:"action"`
+		Path        string `json:"path"`
+		NewPath     string `json:"new_path,omitempty"`
+		UpdateLinks *bool  `json:"update_links,omitempty"`
+		Preview     bool   `json:"preview,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	_, fullPath, relPath, err := getUserPath(r, req.Path)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switch req.Action {
+	case "create":
+		if err := os.MkdirAll(fullPath, 0755); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to create directory: "+err.Error())
+			return
+		}
+	case "delete":
+		user := r.Context().Value(userContextKey).(string)
+		_, gitPath := splitUserPath(relPath)
+		err := withWriteGate(func() error {
+			return withGitCommit(user, "Delete "+filepath.ToSlash(gitPath), []string{gitPath}, func() error {
+				return os.RemoveAll(fullPath)
+			})
+		})
+		if err != nil {
 			respondError(w, http.StatusInternalServerError, "Failed to delete directory: "+err.Error())
 			return
 		}
@@ -874,558 +10149,1590 @@ func handleDirOp(w http.ResponseWriter, r *http.Request) {
 			respondError(w, http.StatusBadRequest, "Missing new_path for rename action")
 			return
 		}
-		_, newFullPath, _, err := getUserPath(r, req.NewPath)
+		_, newFullPath, newRelPath, err := getUserPath(r, req.NewPath)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		user := r.Context().Value(userContextKey).(string)
+		rename := newLinkRename(relPath, newRelPath, true)
+		var rewrites []linkRewrite
+		if req.UpdateLinks == nil || *req.UpdateLinks {
+			rewrites = planLinkRewrites(user, rename)
+		}
+		if req.Preview {
+			respondLinkRewrites(w, "preview", applyLinkRewrites(user, rewrites, true, ""))
+			return
+		}
+
+		err = withWriteGate(func() error {
+			return withGitCommit(user, fmt.Sprintf("Rename %s to %s", rename.From, rename.To), []string{rename.From, rename.To}, func() error {
+				if err := os.Rename(fullPath, newFullPath); err != nil {
+					return err
+				}
+				store.RenameDir(relPath, newRelPath)
+				return nil
+			})
+		})
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to rename directory: "+err.Error())
+			return
+		}
+
+		comment := fmt.Sprintf("Update links after renaming %s to %s", rename.From, rename.To)
+		respondLinkRewrites(w, "success", applyLinkRewrites(user, rewrites, false, comment))
+		return
+	default:
+		respondError(w, http.StatusBadRequest, "Invalid action")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"status": "success"})
+}
+
+func newLinkRename(relPath, newRelPath string, dir bool) LinkRename {
+	_, from := splitUserPath(relPath)
+	_, to := splitUserPath(newRelPath)
+	return LinkRename{From: filepath.ToSlash(from), To: filepath.ToSlash(to), Dir: dir}
+}
+
+func respondLinkRewrites(w http.ResponseWriter, status string, files []ReplaceFileResult) {
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"status":        status,
+		"updated_files": len(files),
+		"files":         files,
+	})
+}
+
+func handleFileWrite(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Path    string `json:"path"`
+		Content string `json:"content"`
+		Comment string `json:"comment,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if !strings.HasSuffix(strings.ToLower(req.Path), ".md") {
+		respondError(w, http.StatusBadRequest, "File must have a .md extension")
+		return
+	}
+
+	user := r.Context().Value(userContextKey).(string)
+	newSHA1, changed, err := saveDocument(user, req.Path, req.Content, req.Comment)
+	if err != nil {
+		switch {
+		case errors.Is(err, errInvalidPath):
+			respondError(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, syscall.ENOSPC):
+			respondError(w, http.StatusInsufficientStorage, err.Error())
+		default:
+			respondError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	if !changed {
+		respondJSON(w, http.StatusOK, map[string]string{"status": "no change"})
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"status": "success", "sha1": newSHA1})
+}
+
+// errNoteChanged is returned by saveDocumentIf, deleteDocumentIf and
+// renameDocumentIf when the note is not the version the caller expected.
+var errNoteChanged = errors.New("the note has changed")
+
+// noteLocks serializes saveDocument, deleteDocument and renameDocument per
+// note, so that they can compare the note with the expected version and
+// change it in one step. They are taken after the read lock of writeGate.
+var noteLocks = struct {
+	sync.Mutex
+	locks map[string]*noteLock
+}{locks: make(map[string]*noteLock)}
+
+type noteLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockNotes locks the notes at relPaths, in sorted order so that writers of
+// several notes cannot deadlock, and returns the function that unlocks them.
+func lockNotes(relPaths ...string) func() {
+	relPaths = slices.Clone(relPaths)
+	slices.Sort(relPaths)
+	relPaths = slices.Compact(relPaths)
+	locks := make([]*noteLock, len(relPaths))
+	noteLocks.Lock()
+	for i, relPath := range relPaths {
+		lock := noteLocks.locks[relPath]
+		if lock == nil {
+			lock = &noteLock{}
+			noteLocks.locks[relPath] = lock
+		}
+		lock.refs++
+		locks[i] = lock
+	}
+	noteLocks.Unlock()
+	for _, lock := range locks {
+		lock.Lock()
+	}
+	return func() {
+		noteLocks.Lock()
+		defer noteLocks.Unlock()
+		for i, lock := range locks {
+			lock.Unlock()
+			if lock.refs--; lock.refs == 0 {
+				delete(noteLocks.locks, relPaths[i])
+			}
+		}
+	}
+}
+
+// checkNote returns errNoteChanged unless the SHA1 of the note at subPath
+// of user is baseSHA1 (empty for no note) or, if given, one of also. A nil
+// baseSHA1 skips the check. The caller holds the note's lock.
+func checkNote(user, subPath string, baseSHA1 *string, also ...string) error {
+	if baseSHA1 == nil {
+		return nil
+	}
+	current, _, err := currentNote(user, subPath)
+	if err != nil {
+		return err
+	}
+	if current != *baseSHA1 && !slices.Contains(also, current) {
+		return errNoteChanged
+	}
+	return nil
+}
+
+// saveDocument writes a markdown file for user, keeps the cache current and
+// records a version of the previous content, or commits the file for users
+// with git-backed storage. subPath is relative to the
+// user's root and is also the key of the file's version history.
+func saveDocument(user, subPath, content, comment string) (newSHA1 string, changed bool, err error) {
+	return saveDocumentIf(user, subPath, content, comment, nil)
+}
+
+// saveDocumentIf is saveDocument for a note that is expected to have the
+// SHA1 baseSHA1 (empty for no note). If it has another SHA1, other than that
+// of content, nothing is written and errNoteChanged is returned. A nil
+// baseSHA1 skips the check.
+func saveDocumentIf(user, subPath, content, comment string, baseSHA1 *string) (newSHA1 string, changed bool, err error) {
+	_, fullPath, relPath, err := resolveUserPath(user, subPath)
+	if err != nil {
+		return "", false, err
+	}
+
+	writeGate.RLock()
+	defer writeGate.RUnlock()
+	defer lockNotes(relPath)()
+
+	newContentBytes := []byte(content)
+	newSHA1 = calculateSHA1(newContentBytes)
+	if err := checkNote(user, subPath, baseSHA1, newSHA1); err != nil {
+		return "", false, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return "", false, fmt.Errorf("Failed to create directory: %w", err)
+	}
+
+	var oldContent string
+	var oldSHA1 string
+	isNewFile := true
+
+	store.RLock()
+	if doc, exists := store.docs.Get(relPath); exists {
+		oldContent = doc.Content
+		oldSHA1 = doc.SHA1
+		isNewFile = false
+	}
+	store.RUnlock()
+
+	if !isNewFile && oldSHA1 == newSHA1 {
+		return newSHA1, false, nil
+	}
+
+	// The new content is staged and synced first. The version record is
+	// committed only after it has been renamed into place, and the cache is
+	// updated last, so a failure at any step leaves all three unchanged.
+	tmpPath, err := stageFile(fullPath, bytes.NewReader(newContentBytes), 0644)
+	if err != nil {
+		return "", false, fmt.Errorf("Failed to write file: %w", err)
+	}
+	defer os.Remove(tmpPath)
+
+	renamed := false
+	apply := func() error {
+		if err := os.Rename(tmpPath, fullPath); err != nil {
+			return err
+		}
+		renamed = true
+		return syncDir(filepath.Dir(fullPath))
+	}
+
+	repo, err := gitRepoFor(user)
+	if err != nil {
+		return "", false, err
+	}
+	if repo != nil {
+		_, gitPath := splitUserPath(relPath)
+		if comment == "" {
+			comment = "Update " + filepath.ToSlash(gitPath)
+			if isNewFile {
+				comment = "Create " + filepath.ToSlash(gitPath)
+			}
+		}
+		// As in withGitCommit, a failed commit does not undo the save.
+		commitErr := repo.commitWith(user, comment, []string{filepath.ToSlash(gitPath)}, func() error {
+			err = apply()
+			return err
+		})
+		if err == nil && commitErr != nil {
+			log.Printf("Could not commit '%s' for %s: %v", comment, user, commitErr)
+		}
+	} else if isNewFile {
+		err = apply()
+	} else {
+		vm, vmErr := NewVersionManager(user)
+		if vmErr != nil {
+			// The note is still saved, only without a version.
+			log.Printf("Error creating version manager for %s: %v", user, vmErr)
+			err = apply()
+		} else {
+			defer vm.Close()
+			err = vm.CreateBackupWith(subPath, oldSHA1, newSHA1, oldContent, content, comment, apply)
+		}
+	}
+	if err != nil {
+		if renamed {
+			rollbackWrite(fullPath, oldContent, isNewFile)
+		}
+		return "", false, fmt.Errorf("Failed to write file: %w", err)
+	}
+
+	store.UpdateDoc(relPath, newContentBytes)
+
+	return newSHA1, true, nil
+}
+
+func handleFileRead(w http.ResponseWriter, r *http.Request) {
+	pathParam := r.URL.Query().Get("path")
+	if pathParam == "" {
+		respondError(w, http.StatusBadRequest, "Missing path parameter")
+		return
+	}
+
+	_, fullPath, relPath, err := getUserPath(r, pathParam)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	store.RLock()
+	doc, exists := store.docs.Get(relPath)
+	store.RUnlock()
+
+	if !exists {
+		content, err := os.ReadFile(fullPath)
+		if err != nil {
+			respondError(w, http.StatusNotFound, "File not found")
+			return
+		}
+		doc.Content = string(content)
+		doc.Path = relPath
+		doc.SHA1 = calculateSHA1(content)
+		doc.Meta = parseFrontMatter(doc.Content)
+	}
+
+	respondJSON(w, http.StatusOK, doc)
+}
+
+func handleFileOp(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Action      string `json:"action"`
+		Path        string `json:"path"`
+		NewPath     string `json:"new_path,omitempty"`
+		UpdateLinks *bool  `json:"update_links,omitempty"`
+		Preview     bool   `json:"preview,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	_, _, relPath, err := getUserPath(r, req.Path)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user := r.Context().Value(userContextKey).(string)
+	switch req.Action {
+	case "rename":
+		if req.NewPath == "" {
+			respondError(w, http.StatusBadRequest, "Missing new_path for rename action")
+			return
+		}
+		if !strings.HasSuffix(strings.ToLower(req.NewPath), ".md") {
+			respondError(w, http.StatusBadRequest, "New file name must have a .md extension")
+			return
+		}
+		_, _, newRelPath, err := getUserPath(r, req.NewPath)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		rename := newLinkRename(relPath, newRelPath, false)
+		var rewrites []linkRewrite
+		if req.UpdateLinks == nil || *req.UpdateLinks {
+			rewrites = planLinkRewrites(user, rename)
+		}
+		if req.Preview {
+			respondLinkRewrites(w, "preview", applyLinkRewrites(user, rewrites, true, ""))
+			return
+		}
+
+		if err := renameDocument(user, req.Path, req.NewPath); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to rename file: "+err.Error())
+			return
+		}
+
+		comment := fmt.Sprintf("Update links after renaming %s to %s", rename.From, rename.To)
+		respondLinkRewrites(w, "success", applyLinkRewrites(user, rewrites, false, comment))
+		return
+
+	case "delete":
+		if err := deleteDocument(user, req.Path, true); errors.Is(err, fs.ErrNotExist) {
+			respondError(w, http.StatusNotFound, "File not found")
+			return
+		} else if err != nil {
+			respondError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	default:
+		respondError(w, http.StatusBadRequest, "Invalid action")
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"status": "success"})
+}
+
+// renameDocument moves the note at subPath of user, with its attachments, to
+// newSubPath. Links to the note are left alone.
+func renameDocument(user, subPath, newSubPath string) error {
+	return renameDocumentIf(user, subPath, newSubPath, nil)
+}
+
+// renameDocumentIf is renameDocument for a note that is expected to have
+// the SHA1 baseSHA1. It returns errNoteChanged if the note has another
+// SHA1, and fs.ErrExist if there is a note at newSubPath. A nil baseSHA1
+// skips both checks.
+func renameDocumentIf(user, subPath, newSubPath string, baseSHA1 *string) error {
+	_, fullPath, relPath, err := resolveUserPath(user, subPath)
+	if err != nil {
+		return err
+	}
+	_, newFullPath, newRelPath, err := resolveUserPath(user, newSubPath)
+	if err != nil {
+		return err
+	}
+	attachPath := fullPath + ".attach"
+
+	rename := newLinkRename(relPath, newRelPath, false)
+	paths := []string{rename.From, rename.To, rename.From + ".attach", rename.To + ".attach"}
+	return withWriteGate(func() error {
+		defer lockNotes(relPath, newRelPath)()
+		if err := checkNote(user, subPath, baseSHA1); err != nil {
+			return err
+		}
+		if baseSHA1 != nil {
+			if target, _, err := currentNote(user, newSubPath); err != nil {
+				return err
+			} else if target != "" {
+				return fs.ErrExist
+			}
+		}
+		return withGitCommit(user, fmt.Sprintf("Rename %s to %s", rename.From, rename.To), paths, func() error {
+			if err := os.Rename(fullPath, newFullPath); err != nil {
+				return err
+			}
+			if _, err := os.Stat(attachPath); err == nil {
+				newAttachPath := newFullPath + ".attach"
+				os.Rename(attachPath, newAttachPath)
+				store.DeleteAttachments(relPath + ".attach")
+				store.ReindexAttachments(newRelPath + ".attach")
+			}
+
+			content, _ := os.ReadFile(newFullPath)
+			store.RenameDoc(relPath, newRelPath, content)
+			return nil
+		})
+	})
+}
+
+// deleteDocument moves the note at subPath of user to the recycle bin and,
+// if withAttachments is set, removes its attachments. It returns
+// fs.ErrNotExist if there is no note.
+func deleteDocument(user, subPath string, withAttachments bool) error {
+	return deleteDocumentIf(user, subPath, withAttachments, nil)
+}
+
+// deleteDocumentIf is deleteDocument for a note that is expected to have
+// the SHA1 baseSHA1. If it has another SHA1, nothing is deleted and
+// errNoteChanged is returned. A nil baseSHA1 skips the check.
+func deleteDocumentIf(user, subPath string, withAttachments bool, baseSHA1 *string) error {
+	_, fullPath, relPath, err := resolveUserPath(user, subPath)
+	if err != nil {
+		return err
+	}
+	attachPath := fullPath + ".attach"
+
+	store.RLock()
+	doc, exists := store.docs.Stat(relPath)
+	store.RUnlock()
+	if !exists {
+		if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+			return fs.ErrNotExist
+		}
+		content, _ := os.ReadFile(fullPath)
+		doc.SHA1 = calculateSHA1(content)
+	}
+
+	recycleDir := filepath.Join(AppConfig.MarkdownDir, user, ".extra", ".recycle", doc.SHA1)
+	if err := os.MkdirAll(recycleDir, 0755); err != nil {
+		return fmt.Errorf("Failed to create recycle dir: %w", err)
+	}
+
+	_, gitPath := splitUserPath(relPath)
+	paths := []string{gitPath}
+	if withAttachments {
+		paths = append(paths, gitPath+".attach")
+	}
+	return withWriteGate(func() error {
+		defer lockNotes(relPath)()
+		if err := checkNote(user, subPath, baseSHA1); err != nil {
+			return err
+		}
+		return withGitCommit(user, "Delete "+filepath.ToSlash(gitPath), paths, func() error {
+			if err := os.Rename(fullPath, filepath.Join(recycleDir, filepath.Base(fullPath))); err != nil {
+				os.Remove(fullPath)
+			}
+			store.DeleteDoc(relPath)
+			if !withAttachments {
+				return nil
+			}
+			if _, err := os.Stat(attachPath); err == nil {
+				os.RemoveAll(attachPath)
+			}
+			store.DeleteAttachments(relPath + ".attach")
+			return nil
+		})
+	})
+}
+
+func handleList(w http.ResponseWriter, r *http.Request) {
+	pathParam := r.URL.Query().Get("path")
+	recursive := r.URL.Query().Get("recursive") == "true"
+	withMeta := r.URL.Query().Get("meta") == "true"
+	user := r.Context().Value(userContextKey).(string)
+
+	cleanedParam := filepath.ToSlash(filepath.Clean(pathParam))
+	if cleanedParam == savedSearchRoot {
+		respondJSON(w, http.StatusOK, savedSearchFolders(user, recursive))
+		return
+	}
+	if name, ok := strings.CutPrefix(cleanedParam, savedSearchRoot+"/"); ok {
+		searches, err := LoadSavedSearches(user)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to load saved searches: "+err.Error())
+			return
+		}
+		for _, search := range searches {
+			if search.Name == name {
+				respondJSON(w, http.StatusOK, savedSearchResults(user, search))
+				return
+			}
+		}
+		respondError(w, http.StatusNotFound, "Saved search not found")
+		return
+	}
+
+	_, fullPath, _, err := getUserPath(r, pathParam)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var items []*TreeItem
+	var listErr error
+
+	if recursive {
+		items, listErr = buildTree(fullPath, withMeta)
+	} else {
+		entries, err := os.ReadDir(fullPath)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to read directory: "+err.Error())
+			return
+		}
+
+		items = make([]*TreeItem, 0, len(entries))
+		for _, entry := range entries {
+			name := entry.Name()
+			if isInternalDir(name) || strings.HasSuffix(name, ".attach") {
+				continue
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				log.Printf("Could not get file info for %s: %v", name, err)
+				continue
+			}
+
+			item := &TreeItem{
+				Name:    name,
+				IsDir:   info.IsDir(),
+				Size:    info.Size(),
+				ModTime: info.ModTime(),
+			}
+
+			if !info.IsDir() && strings.HasSuffix(strings.ToLower(name), ".md") {
+				attachDir := filepath.Join(fullPath, name+".attach")
+				if attachEntries, err := os.ReadDir(attachDir); err == nil {
+					item.AttachCount = len(attachEntries)
+				}
+				if withMeta {
+					item.Meta = cachedMeta(filepath.Join(fullPath, name))
+				}
+			}
+			items = append(items, item)
+		}
+	}
+
+	if listErr != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to list directory contents: "+listErr.Error())
+		return
+	}
+
+	if cleanedParam == "." {
+		items = append(items, savedSearchFolders(user, recursive)...)
+	}
+
+	respondJSON(w, http.StatusOK, items)
+}
+
+// cachedMeta returns the front matter of the cached note at fullPath.
+func cachedMeta(fullPath string) map[string]interface{} {
+	relPath, err := filepath.Rel(AppConfig.MarkdownDir, fullPath)
+	if err != nil {
+		return nil
+	}
+	store.RLock()
+	defer store.RUnlock()
+	doc, _ := store.docs.Stat(relPath)
+	return doc.Meta
+}
+
+func buildTree(dirPath string, withMeta bool) ([]*TreeItem, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %w", dirPath, err)
+	}
+
+	items := make([]*TreeItem, 0)
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if isInternalDir(name) || strings.HasSuffix(name, ".attach") {
+			continue
+		}
+
+		info, err := entry.Info()
 		if err != nil {
-			respondError(w, http.StatusBadRequest, err.Error())
-			return
+			log.Printf("Could not get file info for %s in %s: %v", name, dirPath, err)
+			continue
 		}
-		if err := os.Rename(fullPath, newFullPath); err != nil {
-			respondError(w, http.StatusInternalServerError, "Failed to rename directory: "+err.Error())
+
+		item := &TreeItem{
+			Name:    name,
+			IsDir:   info.IsDir(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+
+		if info.IsDir() {
+			children, err := buildTree(filepath.Join(dirPath, name), withMeta)
+			if err != nil {
+				log.Printf("Error building subtree for %s: %v", name, err)
+			}
+			item.Children = children
+		} else {
+			if strings.HasSuffix(strings.ToLower(name), ".md") {
+				attachDir := filepath.Join(dirPath, name+".attach")
+				if attachEntries, err := os.ReadDir(attachDir); err == nil {
+					item.AttachCount = len(attachEntries)
+				}
+				if withMeta {
+					item.Meta = cachedMeta(filepath.Join(dirPath, name))
+				}
+			}
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+func handleAttachUpload(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+
+	mdPath := r.FormValue("path")
+	if mdPath == "" {
+		respondError(w, http.StatusBadRequest, "Missing 'path' for markdown file")
+		return
+	}
+
+	_, fullMdPath, relMdPath, err := getUserPath(r, mdPath)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if _, err := os.Stat(fullMdPath); os.IsNotExist(err) {
+		respondError(w, http.StatusNotFound, "Markdown file does not exist")
+		return
+	}
+
+	file, handler, err := r.FormFile("attachment")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Missing 'attachment' file")
+		return
+	}
+	defer file.Close()
+
+	attachDir := fullMdPath + ".attach"
+	if err := os.MkdirAll(attachDir, 0755); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to create attachment directory")
+		return
+	}
+
+	dstPath := filepath.Join(attachDir, handler.Filename)
+	if filepath.Base(dstPath) != handler.Filename {
+		respondError(w, http.StatusBadRequest, "Invalid attachment filename")
+		return
+	}
+
+	// The upload is staged before writeGate is taken, so that a slow copy
+	// does not hold up a backup and, behind it, every other writer.
+	tmpPath, err := stageFile(dstPath, file, 0644)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to write attachment to disk: "+err.Error())
+		return
+	}
+	defer os.Remove(tmpPath)
+
+	user := r.Context().Value(userContextKey).(string)
+	relAttachPath := filepath.Join(relMdPath+".attach", handler.Filename)
+	_, gitPath := splitUserPath(relAttachPath)
+	err = withWriteGate(func() error {
+		return withGitCommit(user, "Upload "+filepath.ToSlash(gitPath), []string{gitPath}, func() error {
+			return replaceFile(tmpPath, dstPath)
+		})
+	})
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to save attachment: "+err.Error())
+		return
+	}
+	store.UpdateAttachment(relAttachPath)
+
+	relativeAttachPath := filepath.ToSlash(filepath.Base(fullMdPath) + ".attach/" + handler.Filename)
+	respondJSON(w, http.StatusOK, map[string]string{
+		"status":     "success",
+		"mdPath":     mdPath,
+		"attachPath": relativeAttachPath,
+	})
+}
+
+func handleAttachList(w http.ResponseWriter, r *http.Request) {
+	mdPath := r.URL.Query().Get("path")
+	if mdPath == "" {
+		respondError(w, http.StatusBadRequest, "Missing 'path' for markdown file")
+		return
+	}
+
+	_, fullMdPath, _, err := getUserPath(r, mdPath)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	attachDir := fullMdPath + ".attach"
+	entries, err := os.ReadDir(attachDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			respondJSON(w, http.StatusOK, map[string]interface{}{"mdPath": mdPath, "attachments": []AttachmentInfo{}})
 			return
 		}
-	default:
-		respondError(w, http.StatusBadRequest, "Invalid action")
+		respondError(w, http.StatusInternalServerError, "Failed to read attachment directory")
 		return
 	}
-	respondJSON(w, http.StatusOK, map[string]string{"status": "success"})
+
+	var attachments []AttachmentInfo
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.IsDir() {
+			continue
+		}
+		relativeAttachPath := filepath.ToSlash(filepath.Base(fullMdPath) + ".attach/" + info.Name())
+		attachments = append(attachments, AttachmentInfo{
+			Name:       info.Name(),
+			AttachPath: relativeAttachPath,
+			Size:       info.Size(),
+			ModTime:    info.ModTime(),
+		})
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"mdPath":      mdPath,
+		"attachments": attachments,
+	})
 }
 
-func handleFileWrite(w http.ResponseWriter, r *http.Request) {
+func handleAttachGet(w http.ResponseWriter, r *http.Request) {
+	requestedPath := chi.URLParam(r, "*")
+	if requestedPath == "" {
+		respondError(w, http.StatusBadRequest, "File path is required.")
+		return
+	}
+
+	_, safeAbsPath, _, err := getUserPath(r, requestedPath)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	info, err := os.Stat(safeAbsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+		} else {
+			respondError(w, http.StatusInternalServerError, "Error checking file: "+err.Error())
+		}
+		return
+	}
+
+	if info.IsDir() {
+		respondError(w, http.StatusBadRequest, "Serving directories is not allowed.")
+		return
+	}
+
+	http.ServeFile(w, r, safeAbsPath)
+}
+
+func handleAttachDelete(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Path    string `json:"path"`
-		Content string `json:"content"`
-		Comment string `json:"comment,omitempty"`
+		MdPath     string `json:"mdPath"`
+		AttachPath string `json:"attachPath"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		respondError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
-	if !strings.HasSuffix(strings.ToLower(req.Path), ".md") {
-		respondError(w, http.StatusBadRequest, "File must have a .md extension")
+	if req.MdPath == "" || req.AttachPath == "" {
+		respondError(w, http.StatusBadRequest, "Missing 'mdPath' or 'attachPath' in request body")
+		return
+	}
+
+	if !strings.Contains(filepath.ToSlash(req.AttachPath), ".md.attach/") {
+		respondError(w, http.StatusBadRequest, "Deletion is only allowed for local attachments inside a '.attach' directory.")
+		return
+	}
+
+	safeAbsPath, err := getSafeAttachmentPath(r, req.MdPath, req.AttachPath)
+	if err != nil {
+		if strings.Contains(err.Error(), "access denied") {
+			respondError(w, http.StatusForbidden, err.Error())
+		} else {
+			respondError(w, http.StatusNotFound, err.Error())
+		}
+		return
+	}
+
+	user := r.Context().Value(userContextKey).(string)
+	gitPath, _ := filepath.Rel(filepath.Join(AppConfig.MarkdownDir, user), safeAbsPath)
+	err = withWriteGate(func() error {
+		return withGitCommit(user, "Delete "+filepath.ToSlash(gitPath), []string{gitPath}, func() error {
+			return os.Remove(safeAbsPath)
+		})
+	})
+	if err != nil {
+		if os.IsNotExist(err) {
+			respondError(w, http.StatusNotFound, "Attachment not found")
+		} else {
+			respondError(w, http.StatusInternalServerError, "Failed to delete attachment: "+err.Error())
+		}
+		return
+	}
+
+	if relAttachPath, err := filepath.Rel(AppConfig.MarkdownDir, safeAbsPath); err == nil {
+		store.DeleteAttachments(relAttachPath)
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{"status": "success"})
+}
+
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(string)
+	filePath := r.URL.Query().Get("path")
+	if filePath == "" {
+		respondError(w, http.StatusBadRequest, "Missing path parameter")
+		return
+	}
+
+	vm, err := openVersionHistory(user)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Could not open version history")
+		return
+	}
+	defer vm.Close()
+
+	history, err := vm.GetHistory(filePath)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to get history: "+err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, history)
+}
+
+func handleVersionGet(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(string)
+	filePath := r.URL.Query().Get("path")
+	versionIDStr := r.URL.Query().Get("id")
+	var versionID uint64
+	fmt.Sscanf(versionIDStr, "%d", &versionID)
+
+	if filePath == "" || versionID == 0 {
+		respondError(w, http.StatusBadRequest, "Missing path or id parameter")
+		return
+	}
+
+	vm, err := openVersionHistory(user)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Could not open version history")
 		return
 	}
+	defer vm.Close()
 
-	_, fullPath, relPath, err := getUserPath(r, req.Path)
+	content, err := vm.GetVersionContent(filePath, versionID)
 	if err != nil {
-		respondError(w, http.StatusBadRequest, err.Error())
+		respondError(w, http.StatusInternalServerError, "Failed to get version content: "+err.Error())
 		return
 	}
+	respondJSON(w, http.StatusOK, map[string]string{"content": content})
+}
 
-	os.MkdirAll(filepath.Dir(fullPath), 0755)
-
-	var oldContent string
-	var oldSHA1 string
-	isNewFile := true
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(string)
+	query := r.URL.Query().Get("q")
+	useRegex := r.URL.Query().Get("regex") == "true"
 
-	store.RLock()
-	if doc, exists := store.docs[relPath]; exists {
-		oldContent = doc.Content
-		oldSHA1 = doc.SHA1
-		isNewFile = false
+	if query == "" {
+		respondJSON(w, http.StatusOK, []SearchResult{})
+		return
 	}
-	store.RUnlock()
-
-	newContentBytes := []byte(req.Content)
-	newSHA1 := calculateSHA1(newContentBytes)
 
-	if !isNewFile && oldSHA1 == newSHA1 {
-		respondJSON(w, http.StatusOK, map[string]string{"status": "no change"})
+	if r.URL.Query().Get("mode") == "semantic" {
+		if semanticIndex == nil {
+			respondError(w, http.StatusServiceUnavailable, "Semantic search is disabled")
+			return
+		}
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		if limit <= 0 {
+			limit = 20
+		}
+		results, err := semanticIndex.Search(user, query, limit)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Semantic search failed: "+err.Error())
+			return
+		}
+		respondJSON(w, http.StatusOK, results)
 		return
 	}
 
-	if err := os.WriteFile(fullPath, newContentBytes, 0644); err != nil {
-		respondError(w, http.StatusInternalServerError, "Failed to write file: "+err.Error())
+	if _, _, _, err := getUserPath(r, r.URL.Query().Get("path")); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	store.UpdateDoc(relPath, newContentBytes)
-
-	if !isNewFile {
-		user := r.Context().Value(userContextKey).(string)
-		vm, err := NewVersionManager(user)
-		if err != nil {
-			log.Printf("Error creating version manager for %s: %v", user, err)
-		} else {
-			defer vm.Close()
-			err := vm.CreateBackup(req.Path, oldSHA1, newSHA1, oldContent, req.Content, req.Comment)
-			if err != nil {
-				log.Printf("Error creating backup for %s: %v", relPath, err)
-			}
-		}
+	opts := SearchOptions{
+		Query: query,
+		Regex: useRegex,
+		Scope: r.URL.Query().Get("path"),
+		Sort:  r.URL.Query().Get("sort"),
+	}
+	if err := checkSearchSort(opts.Sort); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	now := time.Now()
+	var err error
+	if opts.ModifiedAfter, err = parseTimeFilter(r.URL.Query().Get("modified_after"), now, false); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if opts.ModifiedBefore, err = parseTimeFilter(r.URL.Query().Get("modified_before"), now, true); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	respondJSON(w, http.StatusOK, map[string]string{"status": "success", "sha1": newSHA1})
+	results := SearchInMemory(user, opts)
+	respondJSON(w, http.StatusOK, results)
 }
 
-func handleFileRead(w http.ResponseWriter, r *http.Request) {
+func handleRelated(w http.ResponseWriter, r *http.Request) {
+	if semanticIndex == nil {
+		respondError(w, http.StatusServiceUnavailable, "Semantic search is disabled")
+		return
+	}
 	pathParam := r.URL.Query().Get("path")
 	if pathParam == "" {
 		respondError(w, http.StatusBadRequest, "Missing path parameter")
 		return
 	}
-
-	_, fullPath, relPath, err := getUserPath(r, pathParam)
-	if err != nil {
+	if _, _, _, err := getUserPath(r, pathParam); err != nil {
 		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	store.RLock()
-	doc, exists := store.docs[relPath]
-	store.RUnlock()
-
-	if !exists {
-		content, err := os.ReadFile(fullPath)
-		if err != nil {
-			respondError(w, http.StatusNotFound, "File not found")
-			return
-		}
-		doc.Content = string(content)
-		doc.Path = relPath
-		doc.SHA1 = calculateSHA1(content)
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = 10
 	}
 
-	respondJSON(w, http.StatusOK, doc)
-}
-
-func handleFileOp(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Action  string `json:"action"`
-		Path    string `json:"path"`
-		NewPath string `json:"new_path,omitempty"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		respondError(w, http.StatusBadRequest, "Invalid request body")
+	user := r.Context().Value(userContextKey).(string)
+	results, err := semanticIndex.Related(user, filepath.Clean(pathParam), limit)
+	if err != nil {
+		respondError(w, http.StatusNotFound, err.Error())
 		return
 	}
+	respondJSON(w, http.StatusOK, results)
+}
 
-	_, fullPath, relPath, err := getUserPath(r, req.Path)
-	if err != nil {
+func handleMetaQuery(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	scope := query.Get("path")
+	if _, _, _, err := getUserPath(r, scope); err != nil {
 		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	attachPath := fullPath + ".attach"
-
-	switch req.Action {
-	case "rename":
-		if req.NewPath == "" {
-			respondError(w, http.StatusBadRequest, "Missing new_path for rename action")
-			return
-		}
-		if !strings.HasSuffix(strings.ToLower(req.NewPath), ".md") {
-			respondError(w, http.StatusBadRequest, "New file name must have a .md extension")
-			return
-		}
-		_, newFullPath, newRelPath, err := getUserPath(r, req.NewPath)
-		if err != nil {
-			respondError(w, http.StatusBadRequest, err.Error())
-			return
-		}
-		if err := os.Rename(fullPath, newFullPath); err != nil {
-			respondError(w, http.StatusInternalServerError, "Failed to rename file: "+err.Error())
-			return
+	// A field may be given as "meta.<field>", which also reaches fields named
+	// like the parameters of the query itself.
+	filters := make(map[string]string)
+	for field, values := range query {
+		if name, ok := strings.CutPrefix(field, "meta."); ok {
+			filters[name] = values[0]
+			continue
 		}
-		if _, err := os.Stat(attachPath); err == nil {
-			newAttachPath := newFullPath + ".attach"
-			os.Rename(attachPath, newAttachPath)
+		switch field {
+		case "path", "sort", "order", "limit":
+			continue
 		}
-
-		store.DeleteDoc(relPath)
-		content, _ := os.ReadFile(newFullPath)
-		store.UpdateDoc(newRelPath, content)
-
-	case "delete":
-		doc, exists := store.docs[relPath]
-		if !exists {
-			if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-				respondError(w, http.StatusNotFound, "File not found")
-				return
-			}
-			content, _ := os.ReadFile(fullPath)
-			doc.SHA1 = calculateSHA1(content)
+		if _, prefixed := query["meta."+field]; !prefixed {
+			filters[field] = values[0]
 		}
+	}
 
-		user := r.Context().Value(userContextKey).(string)
-		recycleDir := filepath.Join(AppConfig.MarkdownDir, user, ".extra", ".recycle", doc.SHA1)
-		if err := os.MkdirAll(recycleDir, 0755); err != nil {
-			respondError(w, http.StatusInternalServerError, "Failed to create recycle dir")
-			return
-		}
+	user := r.Context().Value(userContextKey).(string)
+	results := QueryMetadata(user, scope, filters, query.Get("sort"), query.Get("order") == "desc")
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	respondJSON(w, http.StatusOK, results)
+}
 
-		if err := os.Rename(fullPath, filepath.Join(recycleDir, filepath.Base(req.Path))); err != nil {
-			os.Remove(fullPath)
-		}
-		if _, err := os.Stat(attachPath); err == nil {
-			os.RemoveAll(attachPath)
-		}
+func handleTagList(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(string)
+	respondJSON(w, http.StatusOK, ListTags(user))
+}
 
-		store.DeleteDoc(relPath)
-	default:
-		respondError(w, http.StatusBadRequest, "Invalid action")
+func handleTagNotes(w http.ResponseWriter, r *http.Request) {
+	tag := r.URL.Query().Get("tag")
+	if normalizeTag(tag) == "" {
+		respondError(w, http.StatusBadRequest, "Missing tag parameter")
 		return
 	}
-	respondJSON(w, http.StatusOK, map[string]string{"status": "success"})
+	user := r.Context().Value(userContextKey).(string)
+	respondJSON(w, http.StatusOK, NotesForTag(user, tag))
 }
 
-func handleList(w http.ResponseWriter, r *http.Request) {
-	pathParam := r.URL.Query().Get("path")
-	recursive := r.URL.Query().Get("recursive") == "true"
-
-	_, fullPath, _, err := getUserPath(r, pathParam)
-	if err != nil {
-		respondError(w, http.StatusBadRequest, err.Error())
+func handleTagRename(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		From    string `json:"from"`
+		To      string `json:"to"`
+		DryRun  bool   `json:"dry_run"`
+		Comment string `json:"comment,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	from, to := normalizeTag(req.From), normalizeTag(req.To)
+	if !isValidTag(from) || !isValidTag(to) || inlineTagRe.FindString("#"+to) != "#"+to {
+		respondError(w, http.StatusBadRequest, "Invalid 'from' or 'to' tag")
 		return
 	}
 
-	var items []*TreeItem
-	var listErr error
-
-	if recursive {
-		items, listErr = buildTree(fullPath)
-	} else {
-		entries, err := os.ReadDir(fullPath)
-		if err != nil {
-			respondError(w, http.StatusInternalServerError, "Failed to read directory: "+err.Error())
-			return
-		}
-
-		items = make([]*TreeItem, 0, len(entries))
-		for _, entry := range entries {
-			name := entry.Name()
-			if name == ".extra" || strings.HasSuffix(name, ".attach") {
-				continue
-			}
-
-			info, err := entry.Info()
-			if err != nil {
-				log.Printf("Could not get file info for %s: %v", name, err)
-				continue
-			}
+	comment := req.Comment
+	if comment == "" {
+		comment = fmt.Sprintf("Rename tag #%s to #%s", from, to)
+	}
 
-			item := &TreeItem{
-				Name:    name,
-				IsDir:   info.IsDir(),
-				Size:    info.Size(),
-				ModTime: info.ModTime(),
-			}
+	user := r.Context().Value(userContextKey).(string)
+	respondJSON(w, http.StatusOK, RenameTag(user, from, to, req.DryRun, comment))
+}
 
-			if !info.IsDir() && strings.HasSuffix(strings.ToLower(name), ".md") {
-				attachDir := filepath.Join(fullPath, name+".attach")
-				if attachEntries, err := os.ReadDir(attachDir); err == nil {
-					item.AttachCount = len(attachEntries)
-				}
-			}
-			items = append(items, item)
-		}
+func handleLinks(w http.ResponseWriter, r *http.Request) {
+	subPath := r.URL.Query().Get("path")
+	user := r.Context().Value(userContextKey).(string)
+	if _, _, _, err := resolveUserPath(user, subPath); err != nil || subPath == "" {
+		respondError(w, http.StatusBadRequest, "Invalid path")
+		return
 	}
-
-	if listErr != nil {
-		respondError(w, http.StatusInternalServerError, "Failed to list directory contents: "+listErr.Error())
+	links, ok := GetLinks(user, path.Clean(filepath.ToSlash(subPath)))
+	if !ok {
+		respondError(w, http.StatusNotFound, "File not found")
 		return
 	}
+	respondJSON(w, http.StatusOK, links)
+}
 
-	respondJSON(w, http.StatusOK, items)
+func handleGraph(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(string)
+	respondJSON(w, http.StatusOK, BuildLinkGraph(user, r.URL.Query().Get("unresolved") == "true"))
 }
 
-func buildTree(dirPath string) ([]*TreeItem, error) {
-	entries, err := os.ReadDir(dirPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read directory %s: %w", dirPath, err)
+func handleCheck(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		MoveOrphans bool `json:"move_orphans"`
 	}
-
-	items := make([]*TreeItem, 0)
-
-	for _, entry := range entries {
-		name := entry.Name()
-		if name == ".extra" || strings.HasSuffix(name, ".attach") {
-			continue
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid request body")
+			return
 		}
+	}
 
-		info, err := entry.Info()
-		if err != nil {
-			log.Printf("Could not get file info for %s in %s: %v", name, dirPath, err)
-			continue
-		}
+	user := r.Context().Value(userContextKey).(string)
+	report, err := CheckUser(user, req.MoveOrphans)
+	if err != nil {
+		respondError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, report)
+}
 
-		item := &TreeItem{
-			Name:    name,
-			IsDir:   info.IsDir(),
-			Size:    info.Size(),
-			ModTime: info.ModTime(),
-		}
+// handleEvents streams the file events of the user as server-sent events.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
 
-		if info.IsDir() {
-			children, err := buildTree(filepath.Join(dirPath, name))
-			if err != nil {
-				log.Printf("Error building subtree for %s: %v", name, err)
-			}
-			item.Children = children
-		} else {
-			if strings.HasSuffix(strings.ToLower(name), ".md") {
-				attachDir := filepath.Join(dirPath, name+".attach")
-				if attachEntries, err := os.ReadDir(attachDir); err == nil {
-					item.AttachCount = len(attachEntries)
-				}
-			}
+	user := r.Context().Value(userContextKey).(string)
+	events := fileEvents.Subscribe(user)
+	defer fileEvents.Unsubscribe(user, events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case event := <-events:
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
 		}
-		items = append(items, item)
+		flusher.Flush()
 	}
-
-	return items, nil
 }
 
-func handleAttachUpload(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		respondError(w, http.StatusBadRequest, "Invalid form data")
+var collabUpgrader = websocket.Upgrader{ReadBufferSize: 4096, WriteBufferSize: 4096}
+
+func handleCollab(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(string)
+	subPath := r.URL.Query().Get("path")
+	if subPath == "" || !strings.HasSuffix(subPath, ".md") {
+		respondError(w, http.StatusBadRequest, "A markdown file path is required")
+		return
+	}
+	owner := r.URL.Query().Get("owner")
+	if owner == "" {
+		owner = user
+	}
+	if !canCollab(user, owner) {
+		respondError(w, http.StatusForbidden, "Not allowed to edit the notes of "+owner)
 		return
 	}
-
-	mdPath := r.FormValue("path")
-	if mdPath == "" {
-		respondError(w, http.StatusBadRequest, "Missing 'path' for markdown file")
+	if _, _, _, err := resolveUserPath(owner, subPath); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid path")
 		return
 	}
 
-	_, fullMdPath, _, err := getUserPath(r, mdPath)
+	conn, err := collabUpgrader.Upgrade(w, r, nil)
 	if err != nil {
-		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	conn.SetReadLimit(collabMaxMessage)
+	session, client := joinCollabSession(owner, user, subPath, conn)
+	go client.writeLoop()
+	defer session.leave(client)
+
+	conn.SetReadDeadline(time.Now().Add(2 * collabPingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * collabPingInterval))
+	})
+	for {
+		var msg collabMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * collabPingInterval))
+		switch msg.Type {
+		case "op":
+			err = session.receive(client, msg.Rev, msg.Op)
+		case "cursor":
+			err = session.moveCursor(client, msg.Rev, msg.Cursor)
+		default:
+			err = fmt.Errorf("unknown message type %q", msg.Type)
+		}
+		if err != nil {
+			client.enqueue(collabMessage{Type: "error", Message: err.Error()})
+			return
+		}
+	}
+}
 
-	if _, err := os.Stat(fullMdPath); os.IsNotExist(err) {
-		respondError(w, http.StatusNotFound, "Markdown file does not exist")
+func handleBackupList(w http.ResponseWriter, r *http.Request) {
+	backups, err := listBackups(r.URL.Query().Get("target"))
+	if errors.Is(err, errBackupNotFound) {
+		respondError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	respondJSON(w, http.StatusOK, backups)
+}
 
-	file, handler, err := r.FormFile("attachment")
+func handleBackupRestore(w http.ResponseWriter, r *http.Request) {
+	var opts BackupRestoreOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	// Extracting to an arbitrary directory would let the request write
+	// anywhere on the server.
+	if opts.To != "" {
+		respondError(w, http.StatusBadRequest, "to is only supported by gonote backup restore")
+		return
+	}
+	result, err := restoreBackup(opts)
 	if err != nil {
-		respondError(w, http.StatusBadRequest, "Missing 'attachment' file")
+		switch {
+		case errors.Is(err, errInvalidPath):
+			respondError(w, http.StatusBadRequest, err.Error())
+		case errors.Is(err, errBackupNotFound):
+			respondError(w, http.StatusNotFound, err.Error())
+		default:
+			respondError(w, http.StatusInternalServerError, err.Error())
+		}
 		return
 	}
-	defer file.Close()
+	respondJSON(w, http.StatusOK, result)
+}
 
-	attachDir := fullMdPath + ".attach"
-	if err := os.MkdirAll(attachDir, 0755); err != nil {
-		respondError(w, http.StatusInternalServerError, "Failed to create attachment directory")
+func handleBackupStatus(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, getBackupStatus())
+}
+
+// handleBackupRun starts a backup to every target in the background. Its
+// outcome is reported by the status endpoint.
+func handleBackupRun(w http.ResponseWriter, r *http.Request) {
+	if !beginBackupRun() {
+		respondError(w, http.StatusConflict, "A backup is already running")
 		return
 	}
+	go func() {
+		defer endBackupRun()
+		log.Println("Starting manual backup...")
+		backupAllTargets()
+	}()
+	respondJSON(w, http.StatusAccepted, map[string]string{"status": "started"})
+}
 
-	dstPath := filepath.Join(attachDir, handler.Filename)
-	if filepath.Base(dstPath) != handler.Filename {
-		respondError(w, http.StatusBadRequest, "Invalid attachment filename")
+func handleBackupVerify(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     string `json:"id"`
+		Target string `json:"target"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	result, err := verifyBackup(req.Target, req.ID)
+	if errors.Is(err, errBackupNotFound) {
+		respondError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		respondError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	respondJSON(w, http.StatusOK, result)
+}
 
-	dst, err := os.Create(dstPath)
+// handleExport streams the notes below the path query parameter as a zip
+// archive. history=true adds the past versions of the notes.
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(string)
+	opts := ExportOptions{Path: r.URL.Query().Get("path"), History: r.URL.Query().Get("history") == "true"}
+	_, fullPath, _, err := resolveUserPath(user, opts.Path)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "Failed to save attachment")
+		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	defer dst.Close()
-
-	if _, err := io.Copy(dst, file); err != nil {
-		respondError(w, http.StatusInternalServerError, "Failed to write attachment to disk")
+	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+		respondError(w, http.StatusNotFound, "Path does not exist")
 		return
 	}
 
-	relativeAttachPath := filepath.ToSlash(filepath.Base(fullMdPath) + ".attach/" + handler.Filename)
-	respondJSON(w, http.StatusOK, map[string]string{
-		"status":     "success",
-		"mdPath":     mdPath,
-		"attachPath": relativeAttachPath,
-	})
+	name := strings.TrimSuffix(filepath.Base(filepath.Clean("/"+opts.Path)), ".md")
+	if name == "/" || name == "" {
+		name = user
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".zip"}))
+	if err := exportNotes(user, opts, w); err != nil {
+		// The response has started; a truncated archive is all we can do.
+		log.Printf("Export for user %s failed: %v", user, err)
+	}
 }
 
-func handleAttachList(w http.ResponseWriter, r *http.Request) {
-	mdPath := r.URL.Query().Get("path")
-	if mdPath == "" {
-		respondError(w, http.StatusBadRequest, "Missing 'path' for markdown file")
+// handleImport imports the zip archive in the "file" form field below the
+// folder in "path". "format" names the tool that produced the archive and
+// is detected when empty.
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(string)
+	r.Body = http.MaxBytesReader(w, r.Body, importHTTPMaxSize)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid form data")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Missing 'file'")
 		return
 	}
+	defer file.Close()
 
-	_, fullMdPath, _, err := getUserPath(r, mdPath)
+	src, err := readImportZip(file, header.Size, importHTTPMaxSize)
 	if err != nil {
 		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	attachDir := fullMdPath + ".attach"
-	entries, err := os.ReadDir(attachDir)
+	defer src.Close()
+	result, err := importNotes(user, r.FormValue("path"), src, r.FormValue("format"))
 	if err != nil {
-		if os.IsNotExist(err) {
-			respondJSON(w, http.StatusOK, map[string]interface{}{"mdPath": mdPath, "attachments": []AttachmentInfo{}})
-			return
+		switch {
+		case errors.Is(err, errInvalidPath), errors.Is(err, errInvalidImport):
+			respondError(w, http.StatusBadRequest, err.Error())
+		default:
+			respondError(w, http.StatusInternalServerError, err.Error())
 		}
-		respondError(w, http.StatusInternalServerError, "Failed to read attachment directory")
 		return
 	}
+	respondJSON(w, http.StatusOK, result)
+}
 
-	var attachments []AttachmentInfo
-	for _, entry := range entries {
-		info, err := entry.Info()
-		if err != nil || info.IsDir() {
-			continue
+// handleSyncChanges returns the changes to the user's notes after the
+// sequence number since, or a full listing when the client has to start
+// over. content=true includes the content of the notes.
+func handleSyncChanges(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(string)
+	query := r.URL.Query()
+	var since uint64
+	if v := query.Get("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid since parameter")
+			return
 		}
-		relativeAttachPath := filepath.ToSlash(filepath.Base(fullMdPath) + ".attach/" + info.Name())
-		attachments = append(attachments, AttachmentInfo{
-			Name:       info.Name(),
-			AttachPath: relativeAttachPath,
-			Size:       info.Size(),
-			ModTime:    info.ModTime(),
-		})
+	}
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	if limit <= 0 || limit > journalMaxEntries {
+		limit = 1000
 	}
 
-	respondJSON(w, http.StatusOK, map[string]interface{}{
-		"mdPath":      mdPath,
-		"attachments": attachments,
-	})
+	// Changes the client just pushed are journaled before it is answered.
+	fileEvents.Wait()
+	result, err := changeJournal.Changes(user, query.Get("journal"), since, limit, query.Get("content") == "true")
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to read change journal: "+err.Error())
+		return
+	}
+	respondJSON(w, http.StatusOK, result)
 }
 
-func handleAttachGet(w http.ResponseWriter, r *http.Request) {
-	requestedPath := chi.URLParam(r, "*")
-	if requestedPath == "" {
-		respondError(w, http.StatusBadRequest, "File path is required.")
+// handleSyncPush applies a batch of changes made offline, in order, and
+// reports the outcome of each.
+func handleSyncPush(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Changes []SyncChange `json:"changes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
-	_, safeAbsPath, _, err := getUserPath(r, requestedPath)
+	user := r.Context().Value(userContextKey).(string)
+	results := make([]SyncResult, 0, len(req.Changes))
+	for _, change := range req.Changes {
+		results = append(results, applySyncChange(user, change))
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+}
+
+func handleReplace(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Query       string `json:"query"`
+		Replacement string `json:"replacement"`
+		Regex       bool   `json:"regex"`
+		IgnoreCase  bool   `json:"ignore_case"`
+		Path        string `json:"path"`
+		DryRun      bool   `json:"dry_run"`
+		Comment     string `json:"comment,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if req.Query == "" {
+		respondError(w, http.StatusBadRequest, "Missing query")
+		return
+	}
+
+	_, _, scopeRelPath, err := getUserPath(r, req.Path)
 	if err != nil {
 		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	info, err := os.Stat(safeAbsPath)
+	re, err := compileReplacePattern(req.Query, req.Regex, req.IgnoreCase)
 	if err != nil {
-		if os.IsNotExist(err) {
-			http.NotFound(w, r)
-		} else {
-			respondError(w, http.StatusInternalServerError, "Error checking file: "+err.Error())
-		}
+		respondError(w, http.StatusBadRequest, "Invalid regular expression: "+err.Error())
 		return
 	}
 
-	if info.IsDir() {
-		respondError(w, http.StatusBadRequest, "Serving directories is not allowed.")
-		return
+	comment := req.Comment
+	if comment == "" {
+		comment = fmt.Sprintf("Replace %q with %q", req.Query, req.Replacement)
 	}
 
-	http.ServeFile(w, r, safeAbsPath)
+	user := r.Context().Value(userContextKey).(string)
+	summary := ReplaceInUserDocs(user, scopeRelPath, re, req.Replacement, req.Regex, req.DryRun, comment)
+	respondJSON(w, http.StatusOK, summary)
 }
 
-func handleAttachDelete(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		MdPath     string `json:"mdPath"`
-		AttachPath string `json:"attachPath"`
+func handleSavedSearchList(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(string)
+	searches, err := LoadSavedSearches(user)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to load saved searches: "+err.Error())
+		return
 	}
+	respondJSON(w, http.StatusOK, searches)
+}
+
+func handleSavedSearchPut(w http.ResponseWriter, r *http.Request) {
+	var req SavedSearch
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		respondError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
-
-	if req.MdPath == "" || req.AttachPath == "" {
-		respondError(w, http.StatusBadRequest, "Missing 'mdPath' or 'attachPath' in request body")
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || strings.ContainsAny(req.Name, "/\\") || req.Name == "." || req.Name == ".." {
+		respondError(w, http.StatusBadRequest, "Invalid saved search name")
 		return
 	}
-
-	if !strings.Contains(filepath.ToSlash(req.AttachPath), ".md.attach/") {
-		respondError(w, http.StatusBadRequest, "Deletion is only allowed for local attachments inside a '.attach' directory.")
+	if req.Query == "" {
+		respondError(w, http.StatusBadRequest, "Missing query")
 		return
 	}
-
-	safeAbsPath, err := getSafeAttachmentPath(r, req.MdPath, req.AttachPath)
-	if err != nil {
-		if strings.Contains(err.Error(), "access denied") {
-			respondError(w, http.StatusForbidden, err.Error())
-		} else {
-			respondError(w, http.StatusNotFound, err.Error())
+	if req.Regex {
+		if _, err := regexp.Compile(req.Query); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid regular expression: "+err.Error())
+			return
 		}
+	}
+	if _, err := req.Options(time.Now()); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-
-	if err := os.Remove(safeAbsPath); err != nil {
-		if os.IsNotExist(err) {
-			respondError(w, http.StatusNotFound, "Attachment not found")
-		} else {
-			respondError(w, http.StatusInternalServerError, "Failed to delete attachment: "+err.Error())
-		}
+	if _, _, _, err := getUserPath(r, req.Path); err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	user := r.Context().Value(userContextKey).(string)
+	if err := PutSavedSearch(user, req); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to save search: "+err.Error())
+		return
+	}
 	respondJSON(w, http.StatusOK, map[string]string{"status": "success"})
 }
 
-func handleHistory(w http.ResponseWriter, r *http.Request) {
-	user := r.Context().Value(userContextKey).(string)
-	filePath := r.URL.Query().Get("path")
-	if filePath == "" {
-		respondError(w, http.StatusBadRequest, "Missing path parameter")
+func handleSavedSearchDelete(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		respondError(w, http.StatusBadRequest, "Missing name parameter")
 		return
 	}
 
-	vm, err := NewVersionManager(user)
+	user := r.Context().Value(userContextKey).(string)
+	found, err := DeleteSavedSearch(user, name)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "Could not open version db")
+		respondError(w, http.StatusInternalServerError, "Failed to delete saved search: "+err.Error())
 		return
 	}
-	defer vm.Close()
-
-	history, err := vm.GetHistory(filePath)
-	if err != nil {
-		respondError(w, http.StatusInternalServerError, "Failed to get history: "+err.Error())
+	if !found {
+		respondError(w, http.StatusNotFound, "Saved search not found")
 		return
 	}
-	respondJSON(w, http.StatusOK, history)
+	respondJSON(w, http.StatusOK, map[string]string{"status": "success"})
 }
 
-func handleVersionGet(w http.ResponseWriter, r *http.Request) {
-	user := r.Context().Value(userContextKey).(string)
-	filePath := r.URL.Query().Get("path")
-	versionIDStr := r.URL.Query().Get("id")
-	var versionID uint64
-	fmt.Sscanf(versionIDStr, "%d", &versionID)
+// --- utils.go ---
 
-	if filePath == "" || versionID == 0 {
-		respondError(w, http.StatusBadRequest, "Missing path or id parameter")
-		return
-	}
+func calculateSHA1(data []byte) string {
+	h := sha1.New()
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
 
-	vm, err := NewVersionManager(user)
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, so that readers and a crash never see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmpPath, err := stageFile(path, bytes.NewReader(data), perm)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "Could not open version db")
-		return
+		return err
 	}
-	defer vm.Close()
+	return replaceFile(tmpPath, path)
+}
 
-	content, err := vm.GetVersionContent(filePath, versionID)
+// stageFile copies r to a temporary file next to path and syncs it to disk.
+// The caller moves the returned file into place with replaceFile or removes
+// it.
+func stageFile(path string, r io.Reader, perm os.FileMode) (string, error) {
+	tmp, err := createStaged(path)
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "Failed to get version content: "+err.Error())
-		return
+		return "", err
 	}
-	respondJSON(w, http.StatusOK, map[string]string{"content": content})
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := closeStaged(tmp, path, perm); err != nil {
+		return "", err
+	}
+	return tmp.Name(), nil
 }
 
-func handleSearch(w http.ResponseWriter, r *http.Request) {
-	user := r.Context().Value(userContextKey).(string)
-	query := r.URL.Query().Get("q")
-	useRegex := r.URL.Query().Get("regex") == "true"
+// createStaged creates the temporary file that a write of path is staged in.
+// Its name starts with a dot and ends in .tmp, which keeps it out of the
+// cache, exports and git.
+func createStaged(path string) (*os.File, error) {
+	return os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+}
 
-	if query == "" {
-		respondJSON(w, http.StatusOK, []SearchResult{})
-		return
+// closeStaged syncs and closes a file created by createStaged for path. It
+// gets the mode of the file at path, or perm if there is none yet. The file
+// is removed if that fails.
+func closeStaged(tmp *os.File, path string, perm os.FileMode) error {
+	err := tmp.Sync()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if info, statErr := os.Stat(path); statErr == nil {
+		perm = info.Mode().Perm()
 	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
 
-	results := SearchInMemory(query, useRegex, user)
-	respondJSON(w, http.StatusOK, results)
+// replaceFile renames the staged file tmpPath to path and syncs the directory.
+// tmpPath is removed if the rename fails.
+func replaceFile(tmpPath, path string) error {
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
 }
 
-// --- utils.go ---
+// syncDir syncs a directory so that renames within it survive a crash.
+// Directories cannot be synced on Windows, where renames are journaled.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
 
-func calculateSHA1(data []byte) string {
-	h := sha1.New()
-	h.Write(data)
-	return hex.EncodeToString(h.Sum(nil))
+// rollbackWrite restores a file replaced by a write that could not be
+// completed: the old content is written back, or a new file is removed.
+func rollbackWrite(path, oldContent string, isNewFile bool) {
+	var err error
+	if isNewFile {
+		err = os.Remove(path)
+	} else {
+		err = writeFileAtomic(path, []byte(oldContent), 0644)
+	}
+	if err != nil {
+		log.Printf("Failed to roll back write of %s: %v", path, err)
+	}
+}
+
+// isWithin reports whether relPath is scope itself or lies below it.
+func isWithin(relPath, scope string) bool {
+	return relPath == scope || strings.HasPrefix(relPath, scope+string(filepath.Separator))
 }
 
 func itob(v uint64) []byte {
@@ -1519,6 +11826,9 @@ func unpackEmbeddedFS(destDir string) error {
 
 func main() {
 	LoadConfig()
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
 
 	if AppConfig.VisitLog != "" {
 		logFile, err := os.OpenFile(AppConfig.VisitLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
@@ -1557,10 +11867,20 @@ func main() {
 		}
 	}
 
+	var err error
+	if serverLock, err = lockServer(); err != nil {
+		log.Printf("WARNING: Could not lock the markdown directory: %v", err)
+	}
+
 	LoadUsers()
 	store.Scan()
+	StartChangeJournal()
+	// The watcher updates the semantic index, which therefore has to be set
+	// up before it starts.
+	StartSemanticIndex()
 	WatchMarkdownDir()
 	StartBackupScheduler() // 新增: 启动备份调度器
+	StartGitSync()
 
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
@@ -1597,8 +11917,37 @@ func main() {
 		r.Get("/history", handleHistory)
 		r.Get("/version", handleVersionGet)
 		r.Get("/search", handleSearch)
+		r.Get("/related", handleRelated)
+		r.Get("/meta/query", handleMetaQuery)
+		r.Get("/tags", handleTagList)
+		r.Get("/tags/notes", handleTagNotes)
+		r.Post("/tags/rename", handleTagRename)
+		r.Get("/links", handleLinks)
+		r.Get("/graph", handleGraph)
+		r.Get("/check", handleCheck)
+		r.Post("/check", handleCheck)
+		r.Get("/events", handleEvents)
+		r.Get("/sync/changes", handleSyncChanges)
+		r.Post("/sync/push", handleSyncPush)
+		r.Get("/collab", handleCollab)
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(AdminMiddleware)
+			r.Get("/backups", handleBackupList)
+			r.Post("/backups/restore", handleBackupRestore)
+			r.Post("/backups/verify", handleBackupVerify)
+			r.Get("/backups/status", handleBackupStatus)
+			r.Post("/backups/run", handleBackupRun)
+		})
+		r.Post("/replace", handleReplace)
+		r.Get("/export", handleExport)
+		r.Post("/import", handleImport)
+		r.Get("/saved-searches", handleSavedSearchList)
+		r.Post("/saved-searches", handleSavedSearchPut)
+		r.Delete("/saved-searches", handleSavedSearchDelete)
 	})
 
+	mountWebDAV(r)
+
 	if _, err := os.Stat(filepath.Join(AppConfig.WWWDir, "index.html")); os.IsNotExist(err) {
 		log.Println("index.html not found in 'www' directory. Unpacking embedded assets...")
 		if err := unpackEmbeddedFS(AppConfig.WWWDir); err != nil {